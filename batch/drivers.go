@@ -0,0 +1,62 @@
+package batch
+
+import (
+	"context"
+
+	"github.com/rafaft/truck-pad/models"
+	"github.com/rafaft/truck-pad/store"
+)
+
+// DriverStringColumns are the CSV columns of a Driver that are JSON
+// strings, the other ones are numbers or booleans
+var DriverStringColumns = []string{"cpf", "name", "birth_date", "gender", "cnh_type"}
+
+// ImportDrivers validates each row as a Driver and adds the valid ones.
+// Drivers whose CPF already exists are replaced if replace is true,
+// otherwise skipped. On a dry run nothing is written, but the report is
+// the same.
+func ImportDrivers(ctx context.Context, drivers store.DriverStore, rows []Row, replace, dryRun bool) (*models.BatchReport, error) {
+	results := make([]*models.BatchRow, len(rows))
+	valid := make([]*models.Driver, 0, len(rows))
+	validRows := make([]*models.BatchRow, 0, len(rows))
+	for i, row := range rows {
+		results[i] = &models.BatchRow{Row: i + 1}
+		if row.Err != nil {
+			results[i].Invalidate(row.Err)
+			continue
+		}
+
+		driver, err := models.NewDriver(row.JSON)
+		if err != nil {
+			results[i].Invalidate(err)
+			continue
+		}
+
+		results[i].ID = string(*driver.CPF)
+		valid = append(valid, driver)
+		validRows = append(validRows, results[i])
+	}
+
+	imported, err := drivers.ImportDrivers(ctx, valid, replace, dryRun)
+	if err != nil {
+		return nil, err
+	}
+	for i, result := range imported {
+		switch result {
+		case store.ImportCreated:
+			validRows[i].Status = models.RowCreated
+		case store.ImportReplaced:
+			validRows[i].Status = models.RowUpdated
+		case store.ImportSkipped:
+			validRows[i].Status = models.RowSkipped
+			validRows[i].Reason = "there is already a driver with this cpf"
+		}
+	}
+
+	report := &models.BatchReport{DryRun: dryRun}
+	for _, result := range results {
+		report.Add(result)
+	}
+
+	return report, nil
+}
@@ -0,0 +1,130 @@
+// Package batch reads the rows of batch uploads (NDJSON or CSV) as JSON
+// objects, so each row is validated by the models' unmarshallers, and
+// imports them.
+package batch
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Row is a row of a batch upload as a JSON object, or the error that kept
+// it from being read as one (e.g.: a CSV record with the wrong number of
+// fields), which only invalidates the row, not the whole batch
+type Row struct {
+	JSON []byte
+	Err  error
+}
+
+// ReadNDJSON returns each non blank line, up to maxRows+1 rows (so callers
+// can tell there are too many)
+func ReadNDJSON(body io.Reader, maxRows int) ([]Row, error) {
+	rows := make([]Row, 0)
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		rows = append(rows, Row{JSON: append([]byte(nil), line...)})
+		if len(rows) > maxRows {
+			break
+		}
+	}
+
+	return rows, scanner.Err()
+}
+
+// ReadCSV converts each CSV record into a JSON object, whose fields are
+// named by the header, up to maxRows+1 rows. Dots on column names are
+// nested objects, e.g.: "origin.latitude". Empty cells are left out, and
+// values of columns that are not strings are kept as is when they're
+// valid JSON (numbers and booleans), so type errors are reported by the
+// model's validation. A record with more or less fields than the header
+// is returned as an invalid Row, but a malformed CSV (e.g.: unbalanced
+// quotes) is an error, since the records after it can't be told apart.
+func ReadCSV(body io.Reader, stringColumns []string, maxRows int) ([]Row, error) {
+	reader := csv.NewReader(body)
+	reader.TrimLeadingSpace = true
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return []Row{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid CSV: %v", err)
+	}
+	for i := range header {
+		header[i] = strings.TrimSpace(header[i])
+	}
+
+	rows := make([]Row, 0)
+	for len(rows) <= maxRows {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid CSV: %v", err)
+		}
+		if len(record) != len(header) {
+			rows = append(rows, Row{Err: fmt.Errorf(
+				"the row has %d fields, but the header has %d", len(record), len(header),
+			)})
+			continue
+		}
+
+		object := make(map[string]interface{})
+		for i, column := range header {
+			if len(record[i]) == 0 {
+				continue
+			}
+
+			var value interface{} = record[i]
+			if !containsString(stringColumns, column) && json.Valid([]byte(record[i])) {
+				value = json.RawMessage(record[i])
+			}
+			setNestedField(object, strings.Split(column, "."), value)
+		}
+
+		row, err := json.Marshal(object)
+		if err != nil {
+			return nil, err
+		}
+		rows = append(rows, Row{JSON: row})
+	}
+
+	return rows, nil
+}
+
+// setNestedField sets object[path[0]][path[1]]... to value
+func setNestedField(object map[string]interface{}, path []string, value interface{}) {
+	for _, key := range path[:len(path)-1] {
+		child, ok := object[key].(map[string]interface{})
+		if !ok {
+			child = make(map[string]interface{})
+			object[key] = child
+		}
+		object = child
+	}
+
+	object[path[len(path)-1]] = value
+}
+
+func containsString(values []string, s string) bool {
+	for _, value := range values {
+		if value == s {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,124 @@
+// Command import-drivers adds the Drivers of a CSV file (or NDJSON, when
+// the file ends with ".ndjson" or ".jsonl"), like "POST /drivers:import".
+// The CSV's header names the columns as the Driver's JSON fields: cpf,
+// name, birth_date, gender, has_vehicle and cnh_type.
+//
+// Registered CPFs are skipped, or replaced with -mode=upsert. Each row is
+// validated on it's own, and invalid rows are reported and left out, so
+// run it with -dry-run first to check a file without writing anything.
+//
+// Set FIRESTORE_EMULATOR_HOST to run it against the Firestore emulator.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"cloud.google.com/go/firestore"
+
+	"github.com/rafaft/truck-pad/batch"
+	"github.com/rafaft/truck-pad/store"
+)
+
+// maxRows is the maximum number of rows of a file
+const maxRows = 100000
+
+func main() {
+	kind := flag.String("store", "firestore", "where to import the drivers: firestore or sqlite")
+	project := flag.String("project", "truck-pad", "Google Cloud project ID")
+	sqlitePath := flag.String("sqlite-path", "truck-pad.db", "SQLite database file")
+	mode := flag.String("mode", "skip", "what to do with registered CPFs: skip or upsert")
+	dryRun := flag.Bool("dry-run", false, "only report what would be imported")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] FILE\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *mode != "skip" && *mode != "upsert" {
+		log.Fatalf("unknown -mode=%s", *mode)
+	}
+
+	ctx := context.Background()
+	var drivers store.DriverStore
+	switch *kind {
+	case "firestore":
+		client, err := firestore.NewClient(ctx, *project)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer client.Close()
+
+		drivers = store.NewFirestoreStore(client, store.SubcollectionTrips)
+	case "sqlite":
+		db, err := store.NewSQLiteStore(*sqlitePath)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		drivers = db
+	default:
+		log.Fatalf("unknown -store=%s", *kind)
+	}
+
+	path := flag.Arg(0)
+	file, err := os.Open(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer file.Close()
+
+	var rows []batch.Row
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".ndjson", ".jsonl":
+		rows, err = batch.ReadNDJSON(file, maxRows)
+	default:
+		rows, err = batch.ReadCSV(file, batch.DriverStringColumns, maxRows)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(rows) > maxRows {
+		log.Fatalf("%s has more than %d rows", path, maxRows)
+	}
+
+	report, err := batch.ImportDrivers(ctx, drivers, rows, *mode == "upsert", *dryRun)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, row := range report.Rows {
+		line := fmt.Sprintf("row=%d %s", row.Row, row.Status)
+		if len(row.ID) > 0 {
+			line += " cpf=" + row.ID
+		}
+		if len(row.Reason) > 0 {
+			line += ": " + row.Reason
+		}
+		fmt.Println(line)
+
+		for _, violation := range row.Violations {
+			fmt.Printf("\t%s: %s\n", violation.Field, violation.Message)
+		}
+	}
+
+	summary := fmt.Sprintf("%d created, %d updated, %d skipped, %d invalid",
+		report.Created, report.Updated, report.Skipped, report.Invalid)
+	if *dryRun {
+		summary += " (dry run, nothing was written)"
+	}
+	fmt.Println(summary)
+
+	if report.Invalid > 0 {
+		os.Exit(1)
+	}
+}
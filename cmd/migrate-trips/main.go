@@ -0,0 +1,214 @@
+// Command migrate-trips copies every Trip from the "drivers/{cpf}/trips"
+// subcollections into the top level "trips" collection, using the Trip's ID
+// as document ID, like the server does with FIRESTORE_TRIPS_LAYOUT=toplevel.
+// Trips that still have a legacy (timestamp) ID are given a ULID derived
+// from their Driver and timestamp, keeping the legacy ID to be found by
+// it, and every Trip gets it's origin and destination geohashes (Trips
+// created before them can't be found by area).
+//
+// Drivers are migrated one at a time, ordered by CPF, and the last fully
+// migrated Driver is saved to a checkpoint file, so an interrupted run
+// resumes where it stopped. Writes are idempotent, so re-running it is safe.
+//
+// Set FIRESTORE_EMULATOR_HOST to run it against the Firestore emulator.
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+
+	"cloud.google.com/go/firestore"
+	"github.com/oklog/ulid"
+
+	"github.com/rafaft/truck-pad/models"
+)
+
+// Firestore doesn't accept more than 500 writes per batch
+const maxBatchSize = 500
+
+type checkpoint struct {
+	LastDriver string `json:"last_driver"`
+	Copied     int    `json:"copied"`
+}
+
+func main() {
+	project := flag.String("project", "truck-pad", "Google Cloud project ID")
+	checkpointPath := flag.String("checkpoint", "migrate-trips.checkpoint", "file used to resume an interrupted migration")
+	dryRun := flag.Bool("dry-run", false, "only report what would be copied")
+	flag.Parse()
+
+	ctx := context.Background()
+	client, err := firestore.NewClient(ctx, *project)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer client.Close()
+
+	cp, err := loadCheckpoint(*checkpointPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(cp.LastDriver) > 0 {
+		log.Printf("resuming after driver=%s (%d trips already copied)", cp.LastDriver, cp.Copied)
+	}
+
+	mismatches := 0
+	// DocumentRefs also returns "missing" Driver documents, which exist
+	// when a Trip was added through /trips for an unregistered Driver
+	refs, err := client.Collection("drivers").DocumentRefs(ctx).GetAll()
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, driverRef := range pendingDrivers(refs, cp) {
+		source, target, err := migrateDriver(ctx, client, driverRef, *dryRun)
+		if err != nil {
+			log.Fatalf("driver=%s: %v", driverRef.ID, err)
+		}
+
+		result := "ok"
+		if *dryRun {
+			result = "dry-run"
+		} else if source != target {
+			result = "MISMATCH"
+			mismatches++
+		}
+		fmt.Printf("driver=%s source=%d target=%d %s\n", driverRef.ID, source, target, result)
+
+		if *dryRun {
+			continue
+		}
+
+		cp.LastDriver = driverRef.ID
+		cp.Copied += source
+		if err = saveCheckpoint(*checkpointPath, cp); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	fmt.Printf("%d trips copied, %d drivers with mismatching counts\n", cp.Copied, mismatches)
+	if mismatches > 0 {
+		os.Exit(1)
+	}
+}
+
+// pendingDrivers returns the Drivers that weren't migrated yet, the ones
+// after the checkpoint's last Driver, ordered by CPF
+func pendingDrivers(refs []*firestore.DocumentRef, cp checkpoint) []*firestore.DocumentRef {
+	pending := make([]*firestore.DocumentRef, 0, len(refs))
+	for _, ref := range refs {
+		if ref.ID > cp.LastDriver {
+			pending = append(pending, ref)
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].ID < pending[j].ID
+	})
+
+	return pending
+}
+
+// migrateDriver copies all Trips of a Driver and returns how many Trips
+// the Driver has on each layout after copying them
+func migrateDriver(ctx context.Context, client *firestore.Client, driverRef *firestore.DocumentRef, dryRun bool) (source, target int, err error) {
+	docs, err := driverRef.Collection("trips").Documents(ctx).GetAll()
+	if err != nil {
+		return 0, 0, err
+	}
+	source = len(docs)
+
+	if !dryRun {
+		batch := client.Batch()
+		batchSize := 0
+		for _, doc := range docs {
+			var trip models.Trip
+			if err = doc.DataTo(&trip); err != nil {
+				return 0, 0, fmt.Errorf("trip=%s: %v", doc.Ref.ID, err)
+			}
+
+			// the legacy ID is kept, so the Trip is still found by it.
+			// Firestore doesn't keep the offset Trips were sent with, so
+			// for Trips that never had one it's on UTC.
+			if models.IsLegacyTripID(trip.ID) {
+				trip.LegacyID = trip.ID
+				trip.ID = legacyTripULID(&trip)
+			} else if len(trip.LegacyID) == 0 {
+				trip.LegacyID = models.LegacyTripID(trip.Time.UTC())
+			}
+			// Trips created before geohashes existed can't be found by area
+			if err = trip.SetGeohashes(); err != nil {
+				return 0, 0, fmt.Errorf("trip=%s: %v", doc.Ref.ID, err)
+			}
+
+			batch.Set(client.Collection("trips").Doc(trip.ID), &trip)
+			batchSize++
+
+			if batchSize == maxBatchSize {
+				if _, err = batch.Commit(ctx); err != nil {
+					return 0, 0, err
+				}
+				batch = client.Batch()
+				batchSize = 0
+			}
+		}
+		if batchSize > 0 {
+			if _, err = batch.Commit(ctx); err != nil {
+				return 0, 0, err
+			}
+		}
+	}
+
+	migrated, err := client.Collection("trips").Where("driver_id", "==", driverRef.ID).Select().Documents(ctx).GetAll()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return source, len(migrated), nil
+}
+
+// legacyTripULID returns a ULID for a Trip with a legacy ID. Its entropy
+// comes from the Driver and the legacy ID, so that re-running the
+// migration always gives the Trip the same ID.
+func legacyTripULID(trip *models.Trip) string {
+	hash := sha256.Sum256([]byte(string(*trip.DriverID) + trip.ID))
+	id := ulid.MustNew(ulid.Timestamp(*trip.Time), bytes.NewReader(hash[:]))
+	return id.String()
+}
+
+func loadCheckpoint(path string) (checkpoint, error) {
+	var cp checkpoint
+
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return cp, nil
+	}
+	if err != nil {
+		return cp, err
+	}
+
+	err = json.Unmarshal(content, &cp)
+	return cp, err
+}
+
+func saveCheckpoint(path string, cp checkpoint) error {
+	content, err := json.Marshal(&cp)
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file first, so a crash never leaves a
+	// truncated checkpoint behind
+	tmp := path + ".tmp"
+	if err = ioutil.WriteFile(tmp, content, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/oklog/ulid"
+	"google.golang.org/genproto/googleapis/type/latlng"
+
+	"github.com/rafaft/truck-pad/models"
+)
+
+func newTestTrip(cpf, id string, tripTime time.Time) *models.Trip {
+	driverID := models.DriverID(cpf)
+	hasLoad := true
+	vehicleType := models.VehicleType(1)
+
+	return &models.Trip{
+		ID:          id,
+		DriverID:    &driverID,
+		HasLoad:     &hasLoad,
+		VehicleType: &vehicleType,
+		Time:        &tripTime,
+		Origin:      &latlng.LatLng{Latitude: -23.55, Longitude: -46.63},
+		Destination: &latlng.LatLng{Latitude: -22.9, Longitude: -43.2},
+	}
+}
+
+func TestLegacyTripULID(t *testing.T) {
+	tripTime := time.Date(2019, 6, 1, 12, 0, 0, 0, time.FixedZone("-03", -3*60*60))
+	trip := newTestTrip("52998224725", "20190601120000", tripTime)
+
+	id := legacyTripULID(trip)
+	if again := legacyTripULID(trip); again != id {
+		t.Errorf("got %s and %s for the same trip, want the same ULID", id, again)
+	}
+
+	parsed, err := ulid.Parse(id)
+	if err != nil {
+		t.Fatalf("%s is not a ULID: %v", id, err)
+	}
+	if got := ulid.Time(parsed.Time()); !got.Equal(tripTime) {
+		t.Errorf("got ULID time %s, want the trip's %s", got, tripTime)
+	}
+
+	// the same time of another Driver gets another ID
+	other := newTestTrip("48372162000", "20190601120000", tripTime)
+	if legacyTripULID(other) == id {
+		t.Errorf("got the same ULID %s for trips of different drivers", id)
+	}
+}
+
+func TestPendingDrivers(t *testing.T) {
+	refs := []*firestore.DocumentRef{{ID: "52998224725"}, {ID: "14912725544"}, {ID: "48372162000"}}
+
+	tests := []struct {
+		lastDriver string
+		pending    []string
+	}{
+		{"", []string{"14912725544", "48372162000", "52998224725"}},
+		{"14912725544", []string{"48372162000", "52998224725"}},
+		// a Driver added after the checkpoint, before the last Driver
+		{"30000000000", []string{"48372162000", "52998224725"}},
+		{"52998224725", []string{}},
+	}
+	for _, test := range tests {
+		pending := make([]string, 0)
+		for _, ref := range pendingDrivers(refs, checkpoint{LastDriver: test.lastDriver}) {
+			pending = append(pending, ref.ID)
+		}
+		if !reflect.DeepEqual(pending, test.pending) {
+			t.Errorf("after %q: got %v, want %v", test.lastDriver, pending, test.pending)
+		}
+	}
+}
+
+func TestCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "migrate-trips")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "checkpoint")
+
+	// a missing checkpoint starts from the beginning
+	cp, err := loadCheckpoint(path)
+	if err != nil || cp != (checkpoint{}) {
+		t.Fatalf("got %+v, %v, want an empty checkpoint", cp, err)
+	}
+
+	saved := checkpoint{LastDriver: "48372162000", Copied: 12}
+	if err = saveCheckpoint(path, saved); err != nil {
+		t.Fatal(err)
+	}
+	if cp, err = loadCheckpoint(path); err != nil || cp != saved {
+		t.Errorf("got %+v, %v, want %+v", cp, err, saved)
+	}
+	if _, err = os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("the temporary checkpoint was left behind")
+	}
+}
+
+// TestMigrateDriver runs against the Firestore emulator, it's skipped
+// unless FIRESTORE_EMULATOR_HOST is set
+func TestMigrateDriver(t *testing.T) {
+	if os.Getenv("FIRESTORE_EMULATOR_HOST") == "" {
+		t.Skip("FIRESTORE_EMULATOR_HOST is not set")
+	}
+
+	ctx := context.Background()
+	client, err := firestore.NewClient(ctx, "truck-pad-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	cpf := "52998224725"
+	driverRef := client.Collection("drivers").Doc(cpf)
+	tripTime := time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	legacy := newTestTrip(cpf, "20190601120000", tripTime)
+	current := newTestTrip(cpf, ulid.MustNew(ulid.Timestamp(tripTime.Add(time.Hour)), nil).String(), tripTime.Add(time.Hour))
+
+	// legacy Trips have random document IDs
+	if _, _, err = driverRef.Collection("trips").Add(ctx, legacy); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = driverRef.Collection("trips").Doc(current.ID).Set(ctx, current); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		docs, _ := client.Collection("trips").Where("driver_id", "==", cpf).Documents(ctx).GetAll()
+		subcollection, _ := driverRef.Collection("trips").Documents(ctx).GetAll()
+		for _, doc := range append(docs, subcollection...) {
+			doc.Ref.Delete(ctx)
+		}
+	}()
+
+	// re-running it doesn't duplicate Trips
+	for run := 0; run < 2; run++ {
+		source, target, err := migrateDriver(ctx, client, driverRef, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if source != 2 || target != 2 {
+			t.Fatalf("run %d: got source=%d target=%d, want 2", run, source, target)
+		}
+	}
+
+	for _, id := range []string{legacyTripULID(legacy), current.ID} {
+		doc, err := client.Collection("trips").Doc(id).Get(ctx)
+		if err != nil {
+			t.Fatalf("trip=%s: %v", id, err)
+		}
+
+		var trip models.Trip
+		if err = doc.DataTo(&trip); err != nil {
+			t.Fatal(err)
+		}
+		if trip.ID != id || len(trip.OriginGeohashes) == 0 {
+			t.Errorf("trip=%s: got id %s and %d origin geohashes", id, trip.ID, len(trip.OriginGeohashes))
+		}
+		// it's still found by the legacy ID
+		if id == legacyTripULID(legacy) && trip.LegacyID != legacy.ID {
+			t.Errorf("trip=%s: got legacy_id %q, want %s", id, trip.LegacyID, legacy.ID)
+		}
+	}
+}
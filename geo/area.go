@@ -0,0 +1,127 @@
+package geo
+
+import (
+	"math"
+)
+
+const earthRadiusKm = 6371.0
+
+// BoundingBox is an area between two latitudes and two longitudes. If
+// MinLng is greater than MaxLng, the box crosses the antimeridian.
+type BoundingBox struct {
+	MinLat, MinLng, MaxLat, MaxLng float64
+}
+
+func (b BoundingBox) Contains(lat, lng float64) bool {
+	if lat < b.MinLat || lat > b.MaxLat {
+		return false
+	}
+	if b.MinLng <= b.MaxLng {
+		return lng >= b.MinLng && lng <= b.MaxLng
+	}
+
+	return lng >= b.MinLng || lng <= b.MaxLng
+}
+
+// split returns the box as two boxes if it crosses the antimeridian
+func (b BoundingBox) split() []BoundingBox {
+	if b.MinLng <= b.MaxLng {
+		return []BoundingBox{b}
+	}
+
+	east := b
+	east.MaxLng = 180
+	west := b
+	west.MinLng = -180
+
+	return []BoundingBox{east, west}
+}
+
+// Area is where a Trip's origin or destination must be: either within
+// RadiusKm of a point (when Box is nil) or within Box
+type Area struct {
+	Lat, Lng float64
+	RadiusKm float64
+	Box      *BoundingBox
+}
+
+func NewCircle(lat, lng, radiusKm float64) *Area {
+	return &Area{
+		Lat:      lat,
+		Lng:      lng,
+		RadiusKm: radiusKm,
+	}
+}
+
+func NewBox(box BoundingBox) *Area {
+	return &Area{
+		Box: &box,
+	}
+}
+
+func (a *Area) Contains(lat, lng float64) bool {
+	if a.Box != nil {
+		return a.Box.Contains(lat, lng)
+	}
+
+	return DistanceKm(a.Lat, a.Lng, lat, lng) <= a.RadiusKm
+}
+
+// Bounds returns the smallest BoundingBox that contains the Area
+func (a *Area) Bounds() BoundingBox {
+	if a.Box != nil {
+		return *a.Box
+	}
+
+	// one degree of latitude is always the same distance, while a degree
+	// of longitude shrinks towards the poles
+	deltaLat := a.RadiusKm / earthRadiusKm * 180 / math.Pi
+	minLat := a.Lat - deltaLat
+	maxLat := a.Lat + deltaLat
+	if minLat <= -90 || maxLat >= 90 {
+		// a pole is within the circle, so is every longitude
+		return BoundingBox{
+			MinLat: math.Max(minLat, -90),
+			MinLng: -180,
+			MaxLat: math.Min(maxLat, 90),
+			MaxLng: 180,
+		}
+	}
+
+	deltaLng := deltaLat / math.Cos(a.Lat*math.Pi/180)
+	if deltaLng >= 180 {
+		return BoundingBox{MinLat: minLat, MinLng: -180, MaxLat: maxLat, MaxLng: 180}
+	}
+
+	return BoundingBox{
+		MinLat: minLat,
+		MinLng: normalizeLng(a.Lng - deltaLng),
+		MaxLat: maxLat,
+		MaxLng: normalizeLng(a.Lng + deltaLng),
+	}
+}
+
+// DistanceKm returns the great-circle distance between two points,
+// using the haversine formula
+func DistanceKm(lat1, lng1, lat2, lng2 float64) float64 {
+	phi1 := lat1 * math.Pi / 180
+	phi2 := lat2 * math.Pi / 180
+	deltaPhi := (lat2 - lat1) * math.Pi / 180
+	deltaLambda := (lng2 - lng1) * math.Pi / 180
+
+	h := math.Sin(deltaPhi/2)*math.Sin(deltaPhi/2) +
+		math.Cos(phi1)*math.Cos(phi2)*math.Sin(deltaLambda/2)*math.Sin(deltaLambda/2)
+
+	return 2 * earthRadiusKm * math.Asin(math.Sqrt(math.Min(h, 1)))
+}
+
+func normalizeLng(lng float64) float64 {
+	if lng > 180 {
+		return lng - 360
+	}
+	if lng < -180 {
+		return lng + 360
+	}
+
+	return lng
+}
@@ -0,0 +1,102 @@
+package geo
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestDistanceKm(t *testing.T) {
+	// São Paulo to Rio de Janeiro
+	if d := DistanceKm(-23.55, -46.63, -22.9, -43.2); math.Abs(d-357) > 2 {
+		t.Errorf("got %fkm, want about 357km", d)
+	}
+	// across the antimeridian
+	if d := DistanceKm(0, 179.5, 0, -179.5); math.Abs(d-111.2) > 0.5 {
+		t.Errorf("got %fkm, want about 111km", d)
+	}
+}
+
+func TestBounds(t *testing.T) {
+	tests := []struct {
+		name   string
+		area   *Area
+		bounds BoundingBox
+	}{
+		{"circle", NewCircle(0, 0, 111.195), BoundingBox{-1, -1, 1, 1}},
+		{"circle across the antimeridian", NewCircle(0, 179.5, 111.195), BoundingBox{-1, 178.5, 1, -179.5}},
+		{"circle around a pole", NewCircle(89.5, 10, 111.195), BoundingBox{88.5, -180, 90, 180}},
+		{"box", NewBox(BoundingBox{-26.7, -54.6, -22.5, -48}), BoundingBox{-26.7, -54.6, -22.5, -48}},
+	}
+	for _, test := range tests {
+		bounds := test.area.Bounds()
+		for _, pair := range [][2]float64{
+			{bounds.MinLat, test.bounds.MinLat},
+			{bounds.MinLng, test.bounds.MinLng},
+			{bounds.MaxLat, test.bounds.MaxLat},
+			{bounds.MaxLng, test.bounds.MaxLng},
+		} {
+			if math.Abs(pair[0]-pair[1]) > 0.001 {
+				t.Errorf("%s: got %+v, want %+v", test.name, bounds, test.bounds)
+				break
+			}
+		}
+	}
+}
+
+func TestContains(t *testing.T) {
+	antimeridian := NewBox(BoundingBox{MinLat: -20, MinLng: 170, MaxLat: -10, MaxLng: -170})
+	circle := NewCircle(-23.55, -46.63, 50)
+
+	tests := []struct {
+		name     string
+		area     *Area
+		lat, lng float64
+		contains bool
+	}{
+		{"east of the antimeridian", antimeridian, -15, 175, true},
+		{"west of the antimeridian", antimeridian, -15, -175, true},
+		{"on the antimeridian", antimeridian, -15, 180, true},
+		{"between the box's longitudes", antimeridian, -15, 0, false},
+		{"south of the box", antimeridian, -25, 175, false},
+		{"center", circle, -23.55, -46.63, true},
+		{"inside the radius", circle, -23.9, -46.63, true},
+		// within the bounding box, but not the circle
+		{"corner of the bounds", circle, -23.9, -46.98, false},
+		{"outside the radius", circle, -24.1, -46.63, false},
+	}
+	for _, test := range tests {
+		if contains := test.area.Contains(test.lat, test.lng); contains != test.contains {
+			t.Errorf("%s: got %t, want %t", test.name, contains, test.contains)
+		}
+		// the bounds always contain the area
+		if test.contains && !test.area.Bounds().Contains(test.lat, test.lng) {
+			t.Errorf("%s: the bounds don't contain the point", test.name)
+		}
+	}
+}
+
+func TestCover(t *testing.T) {
+	box := BoundingBox{MinLat: -20, MinLng: 170, MaxLat: -10, MaxLng: -170}
+	cells := Cover(box, 6, 10)
+	if len(cells) == 0 || len(cells) > 10 {
+		t.Fatalf("got %d cells, want 1 to 10", len(cells))
+	}
+
+	// every point of the box is in one of the cells, on both sides of
+	// the antimeridian
+	for _, point := range [][2]float64{{-15, 175}, {-15, -175}, {-10, 170}, {-20, -170}, {-19.9, 179.9}} {
+		hash := Encode(point[0], point[1], len(cells[0]))
+		if !strings.Contains(" "+strings.Join(cells, " ")+" ", " "+hash+" ") {
+			t.Errorf("%v: got cells %v without %s", point, cells, hash)
+		}
+	}
+
+	// the cells are as fine as maxCells allows
+	if cells = Cover(BoundingBox{MinLat: -23.56, MinLng: -46.64, MaxLat: -23.54, MaxLng: -46.62}, 6, 10); len(cells) == 0 || len(cells[0]) < 4 {
+		t.Errorf("got cells %v, want fine ones", cells)
+	}
+	if cells = Cover(BoundingBox{MinLat: -90, MinLng: -180, MaxLat: 90, MaxLng: 180}, 6, 10); cells != nil {
+		t.Errorf("got cells %v for the whole world, want none", cells)
+	}
+}
@@ -0,0 +1,108 @@
+package geo
+
+import (
+	"math"
+	"strings"
+)
+
+const base32 = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+// Encode returns the geohash of a point with the given precision
+// (number of characters)
+func Encode(lat, lng float64, precision int) string {
+	minLat, maxLat := -90.0, 90.0
+	minLng, maxLng := -180.0, 180.0
+
+	var hash strings.Builder
+	bit, ch := 0, 0
+	evenBit := true // bits alternate between longitude and latitude
+	for hash.Len() < precision {
+		if evenBit {
+			mid := (minLng + maxLng) / 2
+			if lng >= mid {
+				ch = ch<<1 | 1
+				minLng = mid
+			} else {
+				ch = ch << 1
+				maxLng = mid
+			}
+		} else {
+			mid := (minLat + maxLat) / 2
+			if lat >= mid {
+				ch = ch<<1 | 1
+				minLat = mid
+			} else {
+				ch = ch << 1
+				maxLat = mid
+			}
+		}
+		evenBit = !evenBit
+
+		bit++
+		if bit == 5 {
+			hash.WriteByte(base32[ch])
+			bit, ch = 0, 0
+		}
+	}
+
+	return hash.String()
+}
+
+// Prefixes returns every prefix of the point's geohash, from 1 character
+// up to maxPrecision. Stored on a document, it allows finding it by
+// any geohash cell that contains it with a single equality filter.
+func Prefixes(lat, lng float64, maxPrecision int) []string {
+	hash := Encode(lat, lng, maxPrecision)
+
+	prefixes := make([]string, maxPrecision)
+	for i := range prefixes {
+		prefixes[i] = hash[:i+1]
+	}
+
+	return prefixes
+}
+
+// cellSize returns the height (latitude) and width (longitude) in degrees
+// of a geohash cell with the given precision
+func cellSize(precision int) (float64, float64) {
+	bits := precision * 5
+	lngBits := (bits + 1) / 2
+	latBits := bits / 2
+
+	return 180 / math.Pow(2, float64(latBits)), 360 / math.Pow(2, float64(lngBits))
+}
+
+// Cover returns the geohash cells (of the same precision) that cover box.
+// The precision is the largest, up to maxPrecision, that needs no more
+// than maxCells cells. Returns nil if even one character cells need more
+// than maxCells.
+func Cover(box BoundingBox, maxPrecision, maxCells int) []string {
+	for precision := maxPrecision; precision > 0; precision-- {
+		height, width := cellSize(precision)
+
+		cells := make([]string, 0, maxCells)
+		seen := make(map[string]bool)
+		for _, b := range box.split() {
+			minLat := math.Floor((b.MinLat+90)/height)*height - 90
+			minLng := math.Floor((b.MinLng+180)/width)*width - 180
+
+			for lat := minLat; lat <= b.MaxLat && lat < 90 && len(cells) <= maxCells; lat += height {
+				for lng := minLng; lng <= b.MaxLng && lng < 180 && len(cells) <= maxCells; lng += width {
+					// encode the cell's center, to avoid rounding issues
+					// on it's borders
+					cell := Encode(lat+height/2, lng+width/2, precision)
+					if !seen[cell] {
+						seen[cell] = true
+						cells = append(cells, cell)
+					}
+				}
+			}
+		}
+
+		if len(cells) <= maxCells {
+			return cells
+		}
+	}
+
+	return nil
+}
@@ -5,6 +5,8 @@ go 1.14
 require (
 	cloud.google.com/go/firestore v1.2.0
 	github.com/gorilla/mux v1.7.4
+	github.com/mattn/go-sqlite3 v1.14.6
+	github.com/oklog/ulid v1.3.1
 	google.golang.org/api v0.20.0
 	google.golang.org/genproto v0.0.0-20200702021140-07506425bd67
 	google.golang.org/grpc v1.28.0
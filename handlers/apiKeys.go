@@ -0,0 +1,99 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"github.com/rafaft/truck-pad/models"
+	"github.com/rafaft/truck-pad/store"
+)
+
+// createdAPIKey is an APIKey with the key itself, which is only returned
+// when it's created
+type createdAPIKey struct {
+	*models.APIKey
+	Key string `json:"key"`
+}
+
+// AddAPIKey creates an API key for a client with the given name and role
+func AddAPIKey(keys store.APIKeyStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		content, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			writeBodyError(w, r, err)
+			return
+		}
+
+		apiKey, key, err := models.NewAPIKey(content)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		if err = keys.AddAPIKey(r.Context(), apiKey); err != nil {
+			fmt.Println(err)
+			writeError(w, r, http.StatusInternalServerError, fmt.Errorf("internal server error"))
+			return
+		}
+
+		writeResource(w, r, http.StatusCreated, "/api-keys/"+apiKey.ID, &createdAPIKey{apiKey, key})
+	}
+}
+
+// GetAPIKeys returns every API key, without the keys themselves
+func GetAPIKeys(keys store.APIKeyStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		query := newQueryParser(r)
+		if err := query.Err(); err != nil {
+			writeError(w, r, http.StatusBadRequest, err)
+			return
+		}
+		query.setPreferenceApplied(w)
+
+		result, err := keys.GetAPIKeys(r.Context())
+		if err != nil {
+			fmt.Println(err)
+			writeError(w, r, http.StatusInternalServerError, fmt.Errorf("internal server error"))
+			return
+		}
+
+		b, err := json.Marshal(result)
+		if err != nil {
+			fmt.Println(err)
+			writeError(w, r, http.StatusInternalServerError, fmt.Errorf("internal server error"))
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write(b)
+	}
+}
+
+// DeleteAPIKey revokes an API key, it's client can't authenticate anymore
+func DeleteAPIKey(keys store.APIKeyStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		id := mux.Vars(r)["id"]
+		if err := keys.DeleteAPIKey(r.Context(), id); err != nil {
+			if err == store.ErrNotFound {
+				writeError(w, r, http.StatusNotFound, fmt.Errorf("API key id=%s not found", id))
+			} else {
+				fmt.Println(err)
+				writeError(w, r, http.StatusInternalServerError, fmt.Errorf("internal server error"))
+			}
+			return
+		}
+
+		w.Header().Del("Content-Type")
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
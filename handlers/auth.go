@@ -0,0 +1,163 @@
+package handlers
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/rafaft/truck-pad/models"
+	"github.com/rafaft/truck-pad/store"
+)
+
+// AdminAPIKey is an API key with the admin role that isn't stored, to
+// create the first keys (and for local development). Empty disables it.
+var AdminAPIKey = ""
+
+// Principal is the authenticated client of a request
+type Principal struct {
+	// ID identifies the client, e.g.: the API key's ID
+	ID   string
+	Name string
+	Role models.Role
+	// CPF is the Driver of a driver token, who may only access it's own
+	// resources
+	CPF string
+}
+
+type principalKey struct{}
+
+// principalFrom returns the client of a request, or nil if it isn't
+// authenticated
+func principalFrom(r *http.Request) *Principal {
+	principal, _ := r.Context().Value(principalKey{}).(*Principal)
+	return principal
+}
+
+// Authenticate identifies the client of each request by it's API key, on
+// the "X-API-Key" header, or it's bearer token (see BearerTokens).
+// Requests without either go on unauthenticated, for Authorize to reject
+// them (or not, on public routes), while unknown keys and invalid tokens
+// are rejected right away.
+func Authenticate(keys store.APIKeyStore) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := r.Header.Get("X-API-Key")
+			token, isBearer := bearerToken(r)
+			if len(key) == 0 && !isBearer {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			var principal *Principal
+			if len(key) > 0 {
+				var err error
+				principal, err = apiKeyPrincipal(r.Context(), keys, key)
+				if err != nil {
+					fmt.Println(err)
+					writeError(w, r, http.StatusInternalServerError, fmt.Errorf("internal server error"))
+					return
+				}
+				if principal == nil {
+					writeUnauthorized(w, r, fmt.Errorf("invalid API key"))
+					return
+				}
+			} else {
+				if BearerTokens == nil {
+					writeUnauthorized(w, r, fmt.Errorf("bearer tokens are not accepted"))
+					return
+				}
+				var err error
+				if principal, err = BearerTokens.Principal(token, time.Now()); err != nil {
+					writeUnauthorized(w, r, err)
+					return
+				}
+			}
+
+			ctx := context.WithValue(r.Context(), principalKey{}, principal)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// apiKeyPrincipal returns the client of an API key, or nil if the key is
+// unknown
+func apiKeyPrincipal(ctx context.Context, keys store.APIKeyStore, key string) (*Principal, error) {
+	hash := models.HashAPIKey(key)
+	if len(AdminAPIKey) > 0 &&
+		subtle.ConstantTimeCompare([]byte(hash), []byte(models.HashAPIKey(AdminAPIKey))) == 1 {
+		return &Principal{ID: "admin", Name: "admin", Role: models.RoleAdmin}, nil
+	}
+
+	apiKey, err := keys.GetAPIKeyByHash(ctx, hash)
+	if err == store.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &Principal{ID: apiKey.ID, Name: *apiKey.Name, Role: *apiKey.Role}, nil
+}
+
+// Authorize only lets authenticated clients with one of roles call next.
+// Admins may call every route, and drivers only the ones of their CPF.
+func Authorize(roles []models.Role, next func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal := principalFrom(r)
+		if principal == nil {
+			if BearerTokens != nil {
+				writeUnauthorized(w, r, fmt.Errorf("missing API key on the 'X-API-Key' header or bearer token"))
+			} else {
+				writeUnauthorized(w, r, fmt.Errorf("missing API key on the 'X-API-Key' header"))
+			}
+			return
+		}
+
+		if principal.Role != models.RoleAdmin && !hasRole(roles, principal.Role) {
+			writeError(w, r, http.StatusForbidden, fmt.Errorf("role '%s' can't %s %s", principal.Role, r.Method, r.URL.Path))
+			return
+		}
+		if principal.Role == models.RoleDriver && mux.Vars(r)["cpf"] != principal.CPF {
+			writeError(w, r, http.StatusForbidden, fmt.Errorf("a driver can only access it's own resources"))
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+func hasRole(roles []models.Role, role models.Role) bool {
+	for _, r := range roles {
+		if r == role {
+			return true
+		}
+	}
+
+	return false
+}
+
+// writeUnauthorized writes a 401, with the headers telling how to
+// authenticate
+func writeUnauthorized(w http.ResponseWriter, r *http.Request, err error) {
+	w.Header().Set("WWW-Authenticate", `APIKey header="X-API-Key"`)
+	if BearerTokens != nil {
+		w.Header().Add("WWW-Authenticate", `Bearer realm="truck-pad"`)
+	}
+	writeError(w, r, http.StatusUnauthorized, err)
+}
+
+// bearerToken returns the token of the "Authorization: Bearer" header,
+// and whether there's one
+func bearerToken(r *http.Request) (string, bool) {
+	authorization := r.Header.Get("Authorization")
+	if len(authorization) < 7 || !strings.EqualFold(authorization[:7], "Bearer ") {
+		return "", false
+	}
+
+	return strings.TrimSpace(authorization[7:]), true
+}
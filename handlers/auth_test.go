@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	"github.com/rafaft/truck-pad/models"
+	"github.com/rafaft/truck-pad/store"
+)
+
+// role sets of main.go's routes
+var (
+	testReaders   = []models.Role{models.RoleDispatcher}
+	testTerminals = []models.Role{models.RoleTerminal}
+	testAdmins    []models.Role
+)
+
+func okHandler(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+}
+
+// newAuthTestRouter has a route per role set, behind Authenticate
+func newAuthTestRouter(keys store.APIKeyStore) *mux.Router {
+	router := mux.NewRouter()
+	router.Use(Authenticate(keys))
+
+	router.HandleFunc("/trips", Authorize(testReaders, okHandler)).Methods("GET")
+	router.HandleFunc("/trips", Authorize(testTerminals, okHandler)).Methods("POST")
+	router.HandleFunc("/api-keys", Authorize(testAdmins, okHandler)).Methods("GET")
+
+	return router
+}
+
+// addTestAPIKey stores a key with role and returns the key itself
+func addTestAPIKey(t *testing.T, keys store.APIKeyStore, role models.Role) (*models.APIKey, string) {
+	t.Helper()
+
+	apiKey, key, err := models.NewAPIKey([]byte(`{"name":"test-` + string(role) + `","role":"` + string(role) + `"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = keys.AddAPIKey(context.Background(), apiKey); err != nil {
+		t.Fatal(err)
+	}
+
+	return apiKey, key
+}
+
+// serveWithHeader sends a request with a header to handler
+func serveWithHeader(handler http.Handler, method, target, name, value string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, nil)
+	if len(value) > 0 {
+		r.Header.Set(name, value)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	return w
+}
+
+func TestAPIKeyRoles(t *testing.T) {
+	defer func(key string) { AdminAPIKey = key }(AdminAPIKey)
+	AdminAPIKey = "test-admin-key"
+
+	db := store.NewMemoryStore()
+	router := newAuthTestRouter(db)
+	_, terminal := addTestAPIKey(t, db, models.RoleTerminal)
+	_, dispatcher := addTestAPIKey(t, db, models.RoleDispatcher)
+	_, admin := addTestAPIKey(t, db, models.RoleAdmin)
+
+	tests := []struct {
+		role   string
+		key    string
+		method string
+		path   string
+		status int
+	}{
+		{"terminal", terminal, "GET", "/trips", http.StatusForbidden},
+		{"terminal", terminal, "POST", "/trips", http.StatusOK},
+		{"terminal", terminal, "GET", "/api-keys", http.StatusForbidden},
+		{"dispatcher", dispatcher, "GET", "/trips", http.StatusOK},
+		{"dispatcher", dispatcher, "POST", "/trips", http.StatusForbidden},
+		{"dispatcher", dispatcher, "GET", "/api-keys", http.StatusForbidden},
+		{"admin", admin, "GET", "/trips", http.StatusOK},
+		{"admin", admin, "POST", "/trips", http.StatusOK},
+		{"admin", admin, "GET", "/api-keys", http.StatusOK},
+		{"ADMIN_API_KEY", AdminAPIKey, "GET", "/api-keys", http.StatusOK},
+		{"missing", "", "GET", "/trips", http.StatusUnauthorized},
+		{"unknown", "tpk_unknown", "POST", "/trips", http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		w := serveWithHeader(router, test.method, test.path, "X-API-Key", test.key)
+		if w.Code != test.status {
+			t.Errorf("%s %s %s: got %d, want %d", test.role, test.method, test.path, w.Code, test.status)
+		}
+		if w.Code == http.StatusUnauthorized && len(w.Header().Get("WWW-Authenticate")) == 0 {
+			t.Errorf("%s %s %s: 401 without WWW-Authenticate", test.role, test.method, test.path)
+		}
+	}
+}
+
+func TestRevokedAPIKey(t *testing.T) {
+	db := store.NewMemoryStore()
+	router := newAuthTestRouter(db)
+	apiKey, key := addTestAPIKey(t, db, models.RoleDispatcher)
+
+	expectStatus(t, serveWithHeader(router, "GET", "/trips", "X-API-Key", key), http.StatusOK)
+	if err := db.DeleteAPIKey(context.Background(), apiKey.ID); err != nil {
+		t.Fatal(err)
+	}
+	expectStatus(t, serveWithHeader(router, "GET", "/trips", "X-API-Key", key), http.StatusUnauthorized)
+}
+
+func TestAPIKeyRoleValidation(t *testing.T) {
+	// drivers only come from bearer tokens
+	for _, role := range []string{"driver", "root", ""} {
+		if _, _, err := models.NewAPIKey([]byte(`{"name":"test","role":"` + role + `"}`)); err == nil {
+			t.Errorf("role %q: got an API key, want an error", role)
+		}
+	}
+}
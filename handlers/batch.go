@@ -0,0 +1,197 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+
+	"github.com/rafaft/truck-pad/batch"
+	"github.com/rafaft/truck-pad/models"
+	"github.com/rafaft/truck-pad/store"
+)
+
+// maxBatchRows is the maximum number of rows of a batch of Trips
+const maxBatchRows = 1000
+
+// maxImportRows is the maximum number of rows of a Drivers import
+const maxImportRows = 10000
+
+// query parameters of a Drivers import
+var importParams = []string{"mode", "dry_run"}
+
+// errUnsupportedMediaType is returned for batches that are neither NDJSON
+// nor CSV
+var errUnsupportedMediaType = fmt.Errorf("'Content-Type' must be application/x-ndjson or text/csv")
+
+// tripStringColumns are the CSV columns of a Trip that are JSON strings,
+// the other ones are numbers or booleans
+var tripStringColumns = []string{"id", "driver_id", "time"}
+
+// AddTripsBatch adds many Trips at once, from NDJSON (a Trip per line) or
+// CSV (columns named as the Trip's JSON fields, e.g.: "origin.latitude").
+// Each row is validated and added on it's own, so the response is a
+// report of what happened to each row, instead of failing the whole batch.
+func AddTripsBatch(trips store.TripStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		rows, err := readBatchRows(r, tripStringColumns, maxBatchRows)
+		if err != nil {
+			if err == errUnsupportedMediaType {
+				writeError(w, r, http.StatusUnsupportedMediaType, err)
+			} else {
+				writeBodyError(w, r, err)
+			}
+			return
+		}
+
+		results := make([]*models.BatchRow, len(rows))
+		valid := make([]*models.Trip, 0, len(rows))
+		validRows := make([]*models.BatchRow, 0, len(rows))
+		for i, row := range rows {
+			results[i] = &models.BatchRow{Row: i + 1}
+			if row.Err != nil {
+				results[i].Invalidate(row.Err)
+				continue
+			}
+
+			trip, err := models.NewTrip(row.JSON)
+			if err != nil {
+				results[i].Invalidate(err)
+				continue
+			}
+
+			results[i].ID = trip.ID
+			valid = append(valid, trip)
+			validRows = append(validRows, results[i])
+		}
+
+		added, err := trips.AddTrips(r.Context(), valid)
+		if err != nil {
+			fmt.Println(err)
+			writeError(w, r, http.StatusInternalServerError, fmt.Errorf("internal server error"))
+			return
+		}
+		for i, err := range added {
+			if err == store.ErrConflict {
+				validRows[i].Status = models.RowDuplicate
+				validRows[i].Reason = fmt.Sprintf(
+					"there is already a trip with the same timestamp under driver=%s", *valid[i].DriverID,
+				)
+				validRows[i].ID = ""
+			} else {
+				validRows[i].Status = models.RowCreated
+			}
+		}
+
+		var report models.BatchReport
+		for _, result := range results {
+			report.Add(result)
+		}
+
+		b, err := json.Marshal(&report)
+		if err != nil {
+			fmt.Println(err)
+			writeError(w, r, http.StatusInternalServerError, fmt.Errorf("internal server error"))
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write(b)
+	}
+}
+
+// ImportDrivers adds many Drivers at once, from CSV (columns named as the
+// Driver's JSON fields) or NDJSON. Registered CPFs are skipped, or
+// replaced with "mode=upsert", and "dry_run=true" only reports what would
+// happen.
+func ImportDrivers(drivers store.DriverStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		query := newQueryParser(r, importParams)
+		// mode and dry_run are never ignored, not even on lenient
+		// requests, since a mistyped dry run would write
+		replace := false
+		switch mode := r.Form.Get("mode"); mode {
+		case "", "skip":
+		case "upsert":
+			replace = true
+		default:
+			query.errs.Add("mode", models.RuleEnum, "'mode' must be 'skip' or 'upsert'")
+		}
+		dryRun := false
+		if str_dry_run := r.Form.Get("dry_run"); len(str_dry_run) > 0 {
+			var err error
+			dryRun, err = strconv.ParseBool(str_dry_run)
+			if err != nil {
+				query.errs.Add("dry_run", models.RuleType, "'dry_run' must be a boolean")
+			}
+		}
+		if err := query.Err(); err != nil {
+			writeError(w, r, http.StatusBadRequest, err)
+			return
+		}
+		query.setPreferenceApplied(w)
+
+		rows, err := readBatchRows(r, batch.DriverStringColumns, maxImportRows)
+		if err != nil {
+			if err == errUnsupportedMediaType {
+				writeError(w, r, http.StatusUnsupportedMediaType, err)
+			} else {
+				writeBodyError(w, r, err)
+			}
+			return
+		}
+
+		report, err := batch.ImportDrivers(r.Context(), drivers, rows, replace, dryRun)
+		if err != nil {
+			fmt.Println(err)
+			writeError(w, r, http.StatusInternalServerError, fmt.Errorf("internal server error"))
+			return
+		}
+
+		b, err := json.Marshal(report)
+		if err != nil {
+			fmt.Println(err)
+			writeError(w, r, http.StatusInternalServerError, fmt.Errorf("internal server error"))
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write(b)
+	}
+}
+
+// readBatchRows reads up to maxRows rows of a NDJSON or CSV body as JSON
+// objects
+func readBatchRows(r *http.Request, stringColumns []string, maxRows int) ([]batch.Row, error) {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, errUnsupportedMediaType
+	}
+
+	var rows []batch.Row
+	switch mediaType {
+	case "application/x-ndjson", "application/ndjson", "application/jsonl":
+		rows, err = batch.ReadNDJSON(r.Body, maxRows)
+	case "text/csv":
+		rows, err = batch.ReadCSV(r.Body, stringColumns, maxRows)
+	default:
+		return nil, errUnsupportedMediaType
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("the batch has no rows")
+	}
+	if len(rows) > maxRows {
+		return nil, fmt.Errorf("the batch has more than %d rows", maxRows)
+	}
+
+	return rows, nil
+}
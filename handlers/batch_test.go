@@ -0,0 +1,114 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/rafaft/truck-pad/models"
+	"github.com/rafaft/truck-pad/store"
+)
+
+// serveBatch sends a batch of contentType to handler
+func serveBatch(handler http.Handler, target, contentType, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", target, strings.NewReader(body))
+	r.Header.Set("Content-Type", contentType)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	return w
+}
+
+// expectReport fails the test if the rows of the report don't have the
+// statuses
+func expectReport(t *testing.T, w *httptest.ResponseRecorder, statuses ...string) *models.BatchReport {
+	t.Helper()
+
+	expectStatus(t, w, http.StatusOK)
+	var report models.BatchReport
+	decodeBody(t, w, &report)
+	if len(report.Rows) != len(statuses) {
+		t.Fatalf("got %d rows, want %d: %s", len(report.Rows), len(statuses), w.Body.String())
+	}
+	counts := make(map[string]int)
+	for i, row := range report.Rows {
+		counts[row.Status]++
+		if row.Row != i+1 || row.Status != statuses[i] {
+			t.Errorf("row %d: got row=%d %s (%s), want %s", i+1, row.Row, row.Status, row.Reason, statuses[i])
+		}
+	}
+	if report.Created != counts[models.RowCreated] || report.Duplicates != counts[models.RowDuplicate] ||
+		report.Invalid != counts[models.RowInvalid] {
+		t.Errorf("got counts %d/%d/%d, want %v", report.Created, report.Duplicates, report.Invalid, counts)
+	}
+
+	return &report
+}
+
+func TestAddTripsBatchNDJSON(t *testing.T) {
+	handler := http.HandlerFunc(AddTripsBatch(store.NewMemoryStore()))
+
+	body := strings.Join([]string{
+		testTripJSON(testCPF, "2020-02-14T15:00:00Z", true),
+		`{"driver_id":"` + testCPF + `","has_load":"yes"}`,
+		"",
+		testTripJSON(testCPF, "2020-02-14T15:00:00Z", false),
+		`{"driver_id":`,
+		testTripJSON(otherTestCPF, "2020-02-14T15:00:00Z", false),
+	}, "\n")
+	report := expectReport(t, serveBatch(handler, "/trips:batch", "application/x-ndjson", body),
+		models.RowCreated, models.RowInvalid, models.RowDuplicate, models.RowInvalid, models.RowCreated)
+
+	if len(report.Rows[0].ID) != 26 || len(report.Rows[2].ID) > 0 {
+		t.Errorf("got ids %q and %q, want only the created one's", report.Rows[0].ID, report.Rows[2].ID)
+	}
+	if fields := violationFields(&models.ValidationError{Violations: report.Rows[1].Violations}); !strings.Contains(strings.Join(fields, " "), "has_load:type") {
+		t.Errorf("got violations %s, want has_load's type", fields)
+	}
+
+	// retrying the batch only adds what's missing
+	expectReport(t, serveBatch(handler, "/trips:batch", "application/x-ndjson", body),
+		models.RowDuplicate, models.RowInvalid, models.RowDuplicate, models.RowInvalid, models.RowDuplicate)
+}
+
+func TestAddTripsBatchCSV(t *testing.T) {
+	handler := http.HandlerFunc(AddTripsBatch(store.NewMemoryStore()))
+
+	body := strings.Join([]string{
+		"driver_id,has_load,vehicle_type,time,origin.latitude,origin.longitude,destination.latitude,destination.longitude",
+		testCPF + ",true,1,2020-02-14T15:00:00Z,-23.55,-46.63,-22.9,-43.2",
+		testCPF + ",true,1,2020-02-14T16:00:00Z,-23.55,-46.63,-22.9",
+		testCPF + ",false,1,2020-02-14T15:00:00Z,-23.55,-46.63,-22.9,-43.2",
+		testCPF + ",true,9,2020-02-14T17:00:00Z,-23.55,-46.63,-22.9,-43.2",
+		testCPF + ",true,1,2020-02-14T18:00:00Z,-23.55,-46.63,-22.9,-43.2,extra",
+		`"` + testCPF + `",false,2,2020-02-14T19:00:00Z,-23.55,-46.63,-22.9,-43.2`,
+	}, "\n")
+	report := expectReport(t, serveBatch(handler, "/trips:batch", "text/csv", body),
+		models.RowCreated, models.RowInvalid, models.RowDuplicate, models.RowInvalid, models.RowInvalid, models.RowCreated)
+
+	for _, i := range []int{1, 4} {
+		if !strings.Contains(report.Rows[i].Reason, "fields, but the header has 8") {
+			t.Errorf("row %d: got reason %q, want the field count", i+1, report.Rows[i].Reason)
+		}
+	}
+
+	// a malformed CSV still fails as a whole
+	body = "driver_id,time\n\"" + testCPF + ",2020-02-14T15:00:00Z\n"
+	expectStatus(t, serveBatch(handler, "/trips:batch", "text/csv", body), http.StatusBadRequest)
+}
+
+func TestImportDriversCSV(t *testing.T) {
+	db := store.NewMemoryStore()
+	handler := http.HandlerFunc(ImportDrivers(db))
+
+	body := strings.Join([]string{
+		"cpf,name,birth_date,gender,has_vehicle,cnh_type",
+		testCPF + ",Ana,1980-05-01T00:00:00Z,F,true,E",
+		otherTestCPF + ",Bia,1980-05-01T00:00:00Z,F",
+		"12345678900,Caio,1980-05-01T00:00:00Z,M,false,C",
+		testCPF + ",Ana,1980-05-01T00:00:00Z,F,true,D",
+	}, "\n")
+	expectReport(t, serveBatch(handler, "/drivers:import", "text/csv", body),
+		models.RowCreated, models.RowInvalid, models.RowInvalid, models.RowSkipped)
+}
@@ -0,0 +1,273 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"github.com/rafaft/truck-pad/models"
+	"github.com/rafaft/truck-pad/store"
+)
+
+// UpdateTrip corrects a Trip's fields. A Trip's ID is a ULID of it's time,
+// so correcting the time gives the Trip a new ID (and URL). Every change
+// is recorded as a TripCorrection.
+func UpdateTrip(trips store.TripStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		content, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			writeBodyError(w, r, err)
+			return
+		}
+
+		var patch models.Trip
+		err = json.Unmarshal(content, &patch)
+		var errs models.ValidationError
+		if len(patch.ID) > 0 {
+			errs.Add("id", models.RuleImmutable, "cannot update a Trip's ID, it changes with the Trip's time")
+		}
+		if patch.DriverID != nil {
+			errs.Add("driver_id", models.RuleImmutable, "cannot update a Trip's driver_id")
+		}
+		if err = models.MergeErrors(err, errs.Err()); err != nil {
+			writeError(w, r, http.StatusBadRequest, err)
+			return
+		}
+		if patch.HasLoad == nil &&
+			patch.VehicleType == nil &&
+			patch.Time == nil &&
+			patch.Origin == nil &&
+			patch.Destination == nil {
+			writeError(w, r, http.StatusBadRequest, fmt.Errorf("empty update request"))
+			return
+		}
+
+		old, ok := getDriverTrip(w, r, trips)
+		if !ok || !checkTripPrecondition(w, r, old) {
+			return
+		}
+
+		trip := *old
+		if patch.HasLoad != nil {
+			trip.HasLoad = patch.HasLoad
+		}
+		if patch.VehicleType != nil {
+			trip.VehicleType = patch.VehicleType
+		}
+		if patch.Time != nil {
+			trip.Time = patch.Time
+		}
+		if patch.Origin != nil {
+			trip.Origin = patch.Origin
+		}
+		if patch.Destination != nil {
+			trip.Destination = patch.Destination
+		}
+		if err = trip.ValidateTrip(); err != nil {
+			writeError(w, r, http.StatusBadRequest, err)
+			return
+		}
+		if !trip.Time.Equal(*old.Time) {
+			if err = trip.SetID(); err != nil {
+				writeError(w, r, http.StatusBadRequest, err)
+				return
+			}
+		}
+		if err = trip.SetGeohashes(); err != nil {
+			writeError(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		// nothing to record if the values are the same
+		correction := newTripCorrection(r, old, &trip)
+		if len(correction.Changes) == 0 {
+			w.Header().Set("ETag", tripETag(old))
+			writeResource(w, r, http.StatusOK, tripLocation(old), old)
+			return
+		}
+
+		// the store only replaces old if no other correction came first
+		err = trips.UpdateTrip(r.Context(), old, &trip, correction)
+		if err != nil {
+			if err == store.ErrNotFound {
+				writeError(w, r, http.StatusNotFound, fmt.Errorf("driver or trip id not found"))
+			} else if err == store.ErrPreconditionFailed {
+				writeTripModified(w, r)
+			} else if err == store.ErrConflict {
+				writeError(w, r, http.StatusConflict, fmt.Errorf(
+					"there is already a trip with the same timestamp under driver=%s", *trip.DriverID,
+				))
+			} else {
+				fmt.Println(err)
+				writeError(w, r, http.StatusInternalServerError, fmt.Errorf("internal server error"))
+			}
+			return
+		}
+
+		w.Header().Set("ETag", tripETag(&trip))
+		writeResource(w, r, http.StatusOK, tripLocation(&trip), &trip)
+	}
+}
+
+// DeleteTrip deletes a Trip, recording it's values as a TripCorrection
+func DeleteTrip(trips store.TripStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		trip, ok := getDriverTrip(w, r, trips)
+		if !ok || !checkTripPrecondition(w, r, trip) {
+			return
+		}
+
+		correction := newTripCorrection(r, trip, nil)
+		err := trips.DeleteTrip(r.Context(), trip, correction)
+		if err != nil {
+			if err == store.ErrNotFound {
+				writeError(w, r, http.StatusNotFound, fmt.Errorf("driver or trip id not found"))
+			} else if err == store.ErrPreconditionFailed {
+				writeTripModified(w, r)
+			} else {
+				fmt.Println(err)
+				writeError(w, r, http.StatusInternalServerError, fmt.Errorf("internal server error"))
+			}
+			return
+		}
+
+		w.Header().Del("Content-Type")
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// GetTripCorrections returns the corrections of a Trip, oldest first,
+// including the ones made under the Trip's previous IDs (or later ones,
+// if id is a previous ID)
+func GetTripCorrections(trips store.TripStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		query := newQueryParser(r)
+		if err := query.Err(); err != nil {
+			writeError(w, r, http.StatusBadRequest, err)
+			return
+		}
+		query.setPreferenceApplied(w)
+
+		cpf := mux.Vars(r)["cpf"]
+		id := mux.Vars(r)["id"]
+
+		corrections, err := trips.GetTripCorrections(r.Context(), cpf)
+		if err != nil {
+			fmt.Println(err)
+			writeError(w, r, http.StatusInternalServerError, fmt.Errorf("internal server error"))
+			return
+		}
+
+		// follow the Trip's ID changes, both ways
+		ids := map[string]bool{id: true}
+		for changed := true; changed; {
+			changed = false
+			for _, correction := range corrections {
+				if len(correction.NewTripID) > 0 && ids[correction.TripID] != ids[correction.NewTripID] {
+					ids[correction.TripID] = true
+					ids[correction.NewTripID] = true
+					changed = true
+				}
+			}
+		}
+
+		result := make([]*models.TripCorrection, 0)
+		for _, correction := range corrections {
+			if ids[correction.TripID] {
+				result = append(result, correction)
+			}
+		}
+
+		// a Trip that was never corrected must exist
+		if len(result) == 0 {
+			if _, ok := getDriverTrip(w, r, trips); !ok {
+				return
+			}
+		}
+
+		b, err := json.Marshal(result)
+		if err != nil {
+			fmt.Println(err)
+			writeError(w, r, http.StatusInternalServerError, fmt.Errorf("internal server error"))
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write(b)
+	}
+}
+
+// getDriverTrip reads the Trip of the request's CPF and ID. If it doesn't
+// exist or can't be read, the error is written and ok is false.
+func getDriverTrip(w http.ResponseWriter, r *http.Request, trips store.TripStore) (trip *models.Trip, ok bool) {
+	trip, err := findDriverTrip(r.Context(), trips, mux.Vars(r)["cpf"], mux.Vars(r)["id"])
+	if err != nil {
+		fmt.Println(err)
+		writeError(w, r, http.StatusInternalServerError, fmt.Errorf("internal server error"))
+		return nil, false
+	}
+	if trip == nil {
+		writeError(w, r, http.StatusNotFound, fmt.Errorf("driver or trip id not found"))
+		return nil, false
+	}
+
+	return trip, true
+}
+
+// checkTripPrecondition writes 412 if the request's If-Match doesn't
+// match the Trip, and reports whether the request may go on
+func checkTripPrecondition(w http.ResponseWriter, r *http.Request, trip *models.Trip) bool {
+	if !matchTrip(r, trip) {
+		writeError(w, r, http.StatusPreconditionFailed, fmt.Errorf("trip id=%s was modified since 'If-Match'", trip.ID))
+		return false
+	}
+
+	return true
+}
+
+// writeTripModified writes the error of a Trip that another request
+// corrected or deleted between reading and writing it. With If-Match, the
+// client's precondition failed, without it the client may just retry.
+func writeTripModified(w http.ResponseWriter, r *http.Request) {
+	if len(r.Header.Get("If-Match")) > 0 {
+		writeError(w, r, http.StatusPreconditionFailed, fmt.Errorf("trip was modified since 'If-Match'"))
+	} else {
+		writeError(w, r, http.StatusConflict, fmt.Errorf("trip was modified by another request, retry"))
+	}
+}
+
+// findDriverTrip returns a Driver's Trip, or nil if it doesn't exist
+func findDriverTrip(ctx context.Context, trips store.TripStore, cpf, id string) (*models.Trip, error) {
+	filter := store.TripFilter{DriverID: cpf, Limit: 1}
+
+	result, err := findTrips(ctx, trips, filter, id)
+	if err != nil || len(result) == 0 {
+		return nil, err
+	}
+
+	return result[0], nil
+}
+
+// newTripCorrection records a correction made by the request's client.
+// The author is the authenticated client, the "From" header is only kept
+// apart, since any client could send someone else's.
+func newTripCorrection(r *http.Request, old, trip *models.Trip) *models.TripCorrection {
+	correction := models.NewTripCorrection(old, trip)
+	if principal := principalFrom(r); principal != nil {
+		correction.Author = principal.Name
+		correction.AuthorID = principal.ID
+	}
+	correction.From = r.Header.Get("From")
+
+	return correction
+}
@@ -0,0 +1,173 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/rafaft/truck-pad/models"
+	"github.com/rafaft/truck-pad/store"
+)
+
+// serveAs sends a request to handler as the principal, with headers
+func serveAs(handler http.Handler, principal *Principal, method, target, body string, headers map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	r = r.WithContext(context.WithValue(r.Context(), principalKey{}, principal))
+	for name, value := range headers {
+		r.Header.Set(name, value)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	return w
+}
+
+var testTerminalPrincipal = &Principal{ID: "key-1", Name: "terminal-santos", Role: models.RoleTerminal}
+
+func TestTripCorrectionTrail(t *testing.T) {
+	forEachTestStore(t, func(t *testing.T, db store.Store) {
+		router := newTestRouter(db)
+		trip := addTestTrip(t, router, testCPF, "2020-02-14T15:00:00Z", true)
+		url := tripLocation(trip)
+
+		w := serveAs(router, testTerminalPrincipal, "PATCH", url, `{"vehicle_type":3}`,
+			map[string]string{"From": "ana@terminal.example"})
+		expectStatus(t, w, http.StatusOK)
+
+		// correcting the time moves the Trip
+		w = serveAs(router, testTerminalPrincipal, "PATCH", url, `{"time":"2020-02-14T16:00:00Z"}`, nil)
+		expectStatus(t, w, http.StatusOK)
+		var corrected models.Trip
+		decodeBody(t, w, &corrected)
+		if corrected.ID == trip.ID || w.Header().Get("Location") != tripLocation(&corrected) {
+			t.Fatalf("got id %s and location %s, want a new id", corrected.ID, w.Header().Get("Location"))
+		}
+		expectStatus(t, serve(router, "GET", url, ""), http.StatusNotFound)
+
+		expectStatus(t, serveAs(router, testTerminalPrincipal, "DELETE", tripLocation(&corrected), "", nil), http.StatusNoContent)
+
+		// the trail is found through any of the Trip's IDs
+		for _, id := range []string{trip.ID, corrected.ID} {
+			w = serve(router, "GET", "/drivers/"+testCPF+"/trips/"+id+"/corrections", "")
+			expectStatus(t, w, http.StatusOK)
+			var corrections []*models.TripCorrection
+			decodeBody(t, w, &corrections)
+			if len(corrections) != 3 {
+				t.Fatalf("%s: got %d corrections, want 3", id, len(corrections))
+			}
+
+			first := corrections[0]
+			if first.Action != models.CorrectionUpdate || first.Author != "terminal-santos" || first.AuthorID != "key-1" ||
+				first.From != "ana@terminal.example" || first.TripID != trip.ID || len(first.NewTripID) > 0 {
+				t.Errorf("%s: got first correction %+v", id, first)
+			}
+			if len(first.Changes) != 1 || first.Changes[0].Field != "vehicle_type" ||
+				first.Changes[0].Old != float64(1) || first.Changes[0].New != float64(3) {
+				t.Errorf("%s: got changes %+v, want vehicle_type from 1 to 3", id, first.Changes)
+			}
+			if corrections[1].NewTripID != corrected.ID || corrections[1].From != "" {
+				t.Errorf("%s: got second correction %+v, want the new id", id, corrections[1])
+			}
+			if corrections[2].Action != models.CorrectionDelete || corrections[2].TripID != corrected.ID {
+				t.Errorf("%s: got last correction %+v, want the deletion", id, corrections[2])
+			}
+		}
+	})
+}
+
+func TestTripIfMatch(t *testing.T) {
+	forEachTestStore(t, func(t *testing.T, db store.Store) {
+		router := newTestRouter(db)
+		trip := addTestTrip(t, router, testCPF, "2020-02-14T15:00:00Z", true)
+		url := tripLocation(trip)
+
+		w := serve(router, "GET", url, "")
+		expectStatus(t, w, http.StatusOK)
+		etag := w.Header().Get("ETag")
+		if len(etag) == 0 {
+			t.Fatal("got no ETag")
+		}
+		expectStatus(t, serveWithHeader(router, "GET", url, "If-None-Match", etag), http.StatusNotModified)
+		if w = serve(router, "GET", url+"?fields=has_load", ""); len(w.Header().Get("ETag")) > 0 {
+			t.Errorf("got ETag %s on a partial representation", w.Header().Get("ETag"))
+		}
+
+		// another correction changes the ETag
+		w = serveAs(router, testTerminalPrincipal, "PATCH", url, `{"has_load":false}`, map[string]string{"If-Match": etag})
+		expectStatus(t, w, http.StatusOK)
+		current := w.Header().Get("ETag")
+		if current == etag {
+			t.Fatal("got the same ETag after a correction")
+		}
+
+		w = serveAs(router, testTerminalPrincipal, "PATCH", url, `{"vehicle_type":2}`, map[string]string{"If-Match": etag})
+		expectStatus(t, w, http.StatusPreconditionFailed)
+		w = serveAs(router, testTerminalPrincipal, "DELETE", url, "", map[string]string{"If-Match": etag})
+		expectStatus(t, w, http.StatusPreconditionFailed)
+		w = serveAs(router, testTerminalPrincipal, "DELETE", url, "", map[string]string{"If-Match": "W/" + current})
+		expectStatus(t, w, http.StatusPreconditionFailed)
+
+		w = serveAs(router, testTerminalPrincipal, "PATCH", url, `{"vehicle_type":2}`, map[string]string{"If-Match": etag + ", " + current})
+		expectStatus(t, w, http.StatusOK)
+		w = serveAs(router, testTerminalPrincipal, "DELETE", url, "", map[string]string{"If-Match": "*"})
+		expectStatus(t, w, http.StatusNoContent)
+
+		// only the corrections that were applied are recorded
+		w = serve(router, "GET", url+"/corrections", "")
+		expectStatus(t, w, http.StatusOK)
+		var corrections []*models.TripCorrection
+		decodeBody(t, w, &corrections)
+		if len(corrections) != 3 {
+			t.Errorf("got %d corrections, want 3", len(corrections))
+		}
+	})
+}
+
+func TestUpdateTripPrecondition(t *testing.T) {
+	forEachTestStore(t, func(t *testing.T, db store.Store) {
+		router := newTestRouter(db)
+		ctx := context.Background()
+		trip := addTestTrip(t, router, testCPF, "2020-02-14T15:00:00Z", true)
+
+		// two corrections of the Trip as it was read
+		first, second := *trip, *trip
+		firstType, secondType := models.VehicleType(2), models.VehicleType(3)
+		first.VehicleType = &firstType
+		second.VehicleType = &secondType
+
+		if err := db.UpdateTrip(ctx, trip, &first, models.NewTripCorrection(trip, &first)); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.UpdateTrip(ctx, trip, &second, models.NewTripCorrection(trip, &second)); err != store.ErrPreconditionFailed {
+			t.Errorf("got %v updating a stale Trip, want ErrPreconditionFailed", err)
+		}
+		if err := db.DeleteTrip(ctx, trip, models.NewTripCorrection(trip, nil)); err != store.ErrPreconditionFailed {
+			t.Errorf("got %v deleting a stale Trip, want ErrPreconditionFailed", err)
+		}
+
+		corrections, err := db.GetTripCorrections(ctx, testCPF)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(corrections) != 1 {
+			t.Errorf("got %d corrections, want only the first one", len(corrections))
+		}
+
+		result, _, err := db.GetTrips(ctx, store.TripFilter{DriverID: testCPF, ID: trip.ID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(result) != 1 || *result[0].VehicleType != firstType {
+			t.Errorf("got %+v, want the first correction", result)
+		}
+
+		if err = db.DeleteTrip(ctx, &first, models.NewTripCorrection(&first, nil)); err != nil {
+			t.Fatal(err)
+		}
+		if err = db.DeleteTrip(ctx, &first, models.NewTripCorrection(&first, nil)); err != store.ErrNotFound {
+			t.Errorf("got %v deleting a deleted Trip, want ErrNotFound", err)
+		}
+	})
+}
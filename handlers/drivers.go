@@ -1,69 +1,62 @@
 package handlers
 
 import (
+	"crypto/rand"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
-	"reflect"
+	"strconv"
 	"strings"
 	"time"
 
-	"cloud.google.com/go/firestore"
 	"github.com/gorilla/mux"
-	"google.golang.org/api/iterator"
-	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/status"
+	"github.com/oklog/ulid"
 
 	"github.com/rafaft/truck-pad/models"
+	"github.com/rafaft/truck-pad/store"
 )
 
-func AddDriver(client *firestore.Client) func(w http.ResponseWriter, r *http.Request) {
+func AddDriver(drivers store.DriverStore) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 
 		// get body's content
 		content, err := ioutil.ReadAll(r.Body)
 		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write(createErrorJSON(err))
+			writeBodyError(w, r, err)
 			return
 		}
 
 		// load content into Driver instance
-		var driver models.Driver
-		err = json.Unmarshal(content, &driver)
+		driver, err := models.NewDriver(content)
 		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write(createErrorJSON(err))
+			writeError(w, r, http.StatusBadRequest, err)
 			return
 		}
 
-		err = driver.ValidateDriver()
+		err = drivers.AddDriver(r.Context(), driver)
 		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write(createErrorJSON(err))
-			return
-		}
-
-		collection := client.Collection("drivers")
-		doc := collection.Doc(string(*driver.CPF))
-		_, err = doc.Create(r.Context(), &driver)
-		if err != nil {
-			w.WriteHeader(http.StatusConflict)
-			w.Write(createErrorJSON(fmt.Errorf("CPF=%s already registered", *driver.CPF)))
+			if err == store.ErrConflict {
+				writeError(w, r, http.StatusConflict, fmt.Errorf("CPF=%s already registered", *driver.CPF))
+			} else {
+				fmt.Println(err)
+				writeError(w, r, http.StatusInternalServerError, fmt.Errorf("internal server error"))
+			}
 			return
 		}
 
-		w.WriteHeader(http.StatusCreated)
+		driver.Age = calculateAge(*driver.BirthDate, time.Now())
+		w.Header().Set("ETag", driverETag(driver, false))
+		writeResource(w, r, http.StatusCreated, driverLocation(string(*driver.CPF)), driver)
 	}
 }
 
-func GetAllDrivers(client *firestore.Client) func(w http.ResponseWriter, r *http.Request) {
+func GetAllDrivers(drivers store.DriverStore) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 
-		r.ParseForm()
+		query := newQueryParser(r, driverFilterParams, paginationParams, fieldsParams, formatParams)
 
 		returnAge := true       // age doesnt come from DB, it's calculated
 		returnBirthDate := true // birth date is necessary to calculate age
@@ -72,54 +65,76 @@ func GetAllDrivers(client *firestore.Client) func(w http.ResponseWriter, r *http
 			returnBirthDate = strings.Contains(fields, "birth_date")
 		}
 
-		q := createDriversQuery(client, r)
-		docs, err := q.Documents(r.Context()).GetAll()
-		if err != nil {
-			fmt.Println(err)
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write(createErrorJSON(fmt.Errorf("internal server error")))
+		filter := createDriversFilter(query)
+		filter.PageSize, filter.PageToken = parsePagination(query)
+		format := negotiateFormat(query, driverMediaTypes)
+		if err := query.Err(); err != nil {
+			writeError(w, r, http.StatusBadRequest, err)
 			return
 		}
+		if len(format) == 0 {
+			writeError(w, r, http.StatusNotAcceptable, notAcceptableError(driverMediaTypes))
+			return
+		}
+		query.setPreferenceApplied(w)
+		w.Header().Add("Vary", "Accept")
 
-		result := make([]*models.Driver, len(docs))
-		for i, docSnapShot := range docs {
-			var driver models.Driver
-			err = docSnapShot.DataTo(&driver)
-			if err != nil {
-				fmt.Println(err)
-				w.WriteHeader(http.StatusInternalServerError)
-				w.Write(createErrorJSON(fmt.Errorf("internal server error")))
-				return
-			}
-
+		render := func(driver *models.Driver) {
 			if returnAge {
 				driver.Age = calculateAge(*driver.BirthDate, time.Now())
 			}
 			if !returnBirthDate {
 				driver.BirthDate = nil
 			}
+		}
 
-			result[i] = &driver
+		// a page is read at once, to write the Link header before it,
+		// otherwise Drivers are written as they're read
+		var each func(fn func(item interface{}) error) error
+		if filter.PageSize > 0 {
+			result, nextPageToken, err := drivers.GetDrivers(r.Context(), filter)
+			if err != nil {
+				if err == store.ErrInvalidPageToken {
+					writeError(w, r, http.StatusBadRequest, fmt.Errorf("invalid value for 'page_token'"))
+				} else {
+					fmt.Println(err)
+					writeError(w, r, http.StatusInternalServerError, fmt.Errorf("internal server error"))
+				}
+				return
+			}
+			setNextPageLink(w, r, nextPageToken)
+
+			each = func(fn func(item interface{}) error) error {
+				for _, driver := range result {
+					render(driver)
+					if err := fn(driver); err != nil {
+						return err
+					}
+				}
+				return nil
+			}
+		} else {
+			each = func(fn func(item interface{}) error) error {
+				return drivers.EachDriver(r.Context(), filter, func(driver *models.Driver) error {
+					render(driver)
+					return fn(driver)
+				})
+			}
 		}
 
-		b, err := json.Marshal(result)
-		if err != nil {
+		contentType := formatMediaType(driverMediaTypes, format)
+		if err := streamList(w, contentType, newListEncoder(w, format), each); err != nil {
 			fmt.Println(err)
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write(createErrorJSON(fmt.Errorf("internal server error")))
-			return
+			writeError(w, r, http.StatusInternalServerError, fmt.Errorf("internal server error"))
 		}
-
-		w.WriteHeader(http.StatusOK)
-		w.Write(b)
 	}
 }
 
-func GetDriver(client *firestore.Client) func(w http.ResponseWriter, r *http.Request) {
+func GetDriver(drivers store.DriverStore) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 
-		r.ParseForm()
+		query := newQueryParser(r, fieldsParams, []string{"as_of"}, timeZoneParams)
 
 		returnAge := true       // age doesnt come from DB, it's calculated
 		returnBirthDate := true // birth date is necessary to calculate age
@@ -132,42 +147,67 @@ func GetDriver(client *firestore.Client) func(w http.ResponseWriter, r *http.Req
 		r.Form.Del("has_vehicle")
 		r.Form.Del("cnh_type")
 
-		q := createDriversQuery(client, r)
-		docSnapshot, err := q.Documents(r.Context()).Next()
-		if err != nil {
-			if err == iterator.Done {
+		// "as_of" reconstructs the Driver from it's history
+		asOf := query.parseTime("as_of")
+		filter := createDriversFilter(query)
+		if err := query.Err(); err != nil {
+			writeError(w, r, http.StatusBadRequest, err)
+			return
+		}
+		query.setPreferenceApplied(w)
+
+		var driver *models.Driver
+		if asOf != nil {
+			history, ok := getDriverHistory(w, r, drivers)
+			if !ok {
+				return
+			}
+			version := models.VersionAt(history, *asOf)
+			if version == nil {
 				cpf := mux.Vars(r)["cpf"]
-				w.WriteHeader(http.StatusNotFound)
-				w.Write(createErrorJSON(fmt.Errorf("cpf=%s not found", cpf)))
-			} else {
+				writeError(w, r, http.StatusNotFound, fmt.Errorf("cpf=%s not found as of %s", cpf, r.Form.Get("as_of")))
+				return
+			}
+
+			// the age is the Driver's age at the time
+			driver = store.SelectDriverFields(version.Driver, filter.Fields)
+			driver.Age = calculateAge(*driver.BirthDate, *asOf)
+		} else {
+			result, _, err := drivers.GetDrivers(r.Context(), filter)
+			if err != nil {
 				fmt.Println(err)
-				w.WriteHeader(http.StatusInternalServerError)
-				w.Write(createErrorJSON(fmt.Errorf("internal server error")))
+				writeError(w, r, http.StatusInternalServerError, fmt.Errorf("internal server error"))
+				return
+			}
+			if len(result) == 0 {
+				cpf := mux.Vars(r)["cpf"]
+				writeError(w, r, http.StatusNotFound, fmt.Errorf("cpf=%s not found", cpf))
+				return
 			}
-			return
-		}
 
-		var driver models.Driver
-		err = docSnapshot.DataTo(&driver)
-		if err != nil {
-			fmt.Println(err)
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write(createErrorJSON(fmt.Errorf("internal server error")))
-			return
+			// past versions don't change, only the current one has an ETag
+			driver = result[0]
+			driver.Age = calculateAge(*driver.BirthDate, time.Now())
+			etag := driverETag(driver, len(r.Form.Get("fields")) > 0)
+			w.Header().Set("ETag", etag)
+			if noneMatch(r, etag) {
+				w.Header().Del("Content-Type")
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
 		}
 
-		if returnAge {
-			driver.Age = calculateAge(*driver.BirthDate, time.Now())
+		if !returnAge {
+			driver.Age = 0
 		}
 		if !returnBirthDate {
 			driver.BirthDate = nil
 		}
 
-		b, err := json.Marshal(&driver)
+		b, err := json.Marshal(driver)
 		if err != nil {
 			fmt.Println(err)
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write(createErrorJSON(fmt.Errorf("internal server error")))
+			writeError(w, r, http.StatusInternalServerError, fmt.Errorf("internal server error"))
 			return
 		}
 
@@ -176,73 +216,145 @@ func GetDriver(client *firestore.Client) func(w http.ResponseWriter, r *http.Req
 	}
 }
 
-func UpdateDriver(client *firestore.Client) func(w http.ResponseWriter, r *http.Request) {
+func UpdateDriver(drivers store.DriverStore) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 
 		// get body's content
 		content, err := ioutil.ReadAll(r.Body)
 		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write(createErrorJSON(err))
+			writeBodyError(w, r, err)
 			return
 		}
 
 		// load content into Driver instance
 		var driver models.Driver
 		err = json.Unmarshal(content, &driver)
-		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write(createErrorJSON(err))
+		var errs models.ValidationError
+		if driver.CPF != nil {
+			errs.Add("cpf", models.RuleImmutable, "cannot update a Driver's CPF")
+		}
+		if err = models.MergeErrors(err, errs.Err()); err != nil {
+			writeError(w, r, http.StatusBadRequest, err)
 			return
 		}
-		if driver.CPF != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write(createErrorJSON(fmt.Errorf("cannot update a Driver's CPF")))
+		if driver.Name == nil &&
+			driver.BirthDate == nil &&
+			driver.Gender == nil &&
+			driver.HasVehicle == nil &&
+			driver.CNHType == nil {
+			writeError(w, r, http.StatusBadRequest, fmt.Errorf("empty update request"))
 			return
 		}
 
-		// explicitly convert Driver to map, because it's easier to iterate it
-		mapDriver := map[string]interface{}{
-			"name":        driver.Name,
-			"birth_date":  driver.BirthDate,
-			"gender":      driver.Gender,
-			"has_vehicle": driver.HasVehicle,
-			"cnh_type":    driver.CNHType,
-		}
+		// get CPF (doc ID)
+		cpf := mux.Vars(r)["cpf"]
 
-		// create slice of updates
-		updates := make([]firestore.Update, 0)
-		for fieldName, fieldValue := range mapDriver {
-			if !reflect.ValueOf(fieldValue).IsNil() {
-				update := firestore.Update{
-					Path:  fieldName,
-					Value: fieldValue,
+		// with If-Match, the Driver is only updated if it didn't change
+		// since the client read it (one of the entity tags is current)
+		lastUpdateTimes := []time.Time{{}}
+		if ifMatch := r.Header.Get("If-Match"); len(ifMatch) > 0 && ifMatch != "*" {
+			lastUpdateTimes = lastUpdateTimes[:0]
+			for _, etag := range splitETags(ifMatch) {
+				if lastUpdateTime, ok := parseETag(etag); ok {
+					lastUpdateTimes = append(lastUpdateTimes, lastUpdateTime)
 				}
-				updates = append(updates, update)
 			}
 		}
 
-		// get CPF (doc ID)
+		err = store.ErrPreconditionFailed
+		for _, lastUpdateTime := range lastUpdateTimes {
+			err = drivers.UpdateDriver(r.Context(), cpf, &driver, lastUpdateTime)
+			if err != store.ErrPreconditionFailed {
+				break
+			}
+		}
+		if err != nil {
+			// If-Match (even "*") can't match a Driver that doesn't exist
+			if err == store.ErrNotFound && len(r.Header.Get("If-Match")) > 0 {
+				writeError(w, r, http.StatusPreconditionFailed, fmt.Errorf("cpf=%s not found, 'If-Match' can't match", cpf))
+			} else if err == store.ErrNotFound {
+				writeError(w, r, http.StatusNotFound, fmt.Errorf("cpf=%s not found", cpf))
+			} else if err == store.ErrPreconditionFailed {
+				writeError(w, r, http.StatusPreconditionFailed, fmt.Errorf("cpf=%s was modified since 'If-Match'", cpf))
+			} else {
+				fmt.Println(err)
+				writeError(w, r, http.StatusInternalServerError, fmt.Errorf("internal server error"))
+			}
+			return
+		}
+
+		// return the whole Driver, not only the updated fields
+		result, _, err := drivers.GetDrivers(r.Context(), store.DriverFilter{CPF: cpf})
+		if err != nil || len(result) == 0 {
+			fmt.Println(err)
+			writeError(w, r, http.StatusInternalServerError, fmt.Errorf("internal server error"))
+			return
+		}
+
+		updated := result[0]
+		updated.Age = calculateAge(*updated.BirthDate, time.Now())
+		w.Header().Set("ETag", driverETag(updated, false))
+		writeResource(w, r, http.StatusOK, driverLocation(cpf), updated)
+	}
+}
+
+// DeleteDriver erases a Driver's personal data (LGPD data subject request)
+// and returns a receipt. The Driver's Trips are deleted, unless the query
+// parameter "keep_trips" is true, in which case they're anonymized.
+func DeleteDriver(drivers store.DriverStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		query := newQueryParser(r, []string{"keep_trips"})
+
+		keepTrips := false
+		if strKeepTrips := r.Form.Get("keep_trips"); len(strKeepTrips) > 0 {
+			var err error
+			if keepTrips, err = strconv.ParseBool(strKeepTrips); err != nil {
+				// ignoring it would delete the Trips instead of
+				// anonymizing them, so it's rejected even on lenient
+				// requests
+				query.reject("keep_trips", models.RuleType, "'keep_trips' must be a boolean")
+			}
+		}
+
+		if err := query.Err(); err != nil {
+			writeError(w, r, http.StatusBadRequest, err)
+			return
+		}
+		query.setPreferenceApplied(w)
+
 		cpf := mux.Vars(r)["cpf"]
 
-		doc := client.Doc(fmt.Sprintf("drivers/%s", cpf))
-		_, err = doc.Update(r.Context(), updates)
+		erasure, err := drivers.EraseDriver(r.Context(), cpf, keepTrips)
 		if err != nil {
-			if status.Code(err) == codes.NotFound {
-				w.WriteHeader(http.StatusNotFound)
-				w.Write(createErrorJSON(fmt.Errorf("cpf=%s not found", cpf)))
-			} else if err.Error() == "firestore: no paths to update" {
-				w.WriteHeader(http.StatusBadRequest)
-				w.Write(createErrorJSON(fmt.Errorf("empty update request")))
+			if err == store.ErrNotFound {
+				writeError(w, r, http.StatusNotFound, fmt.Errorf("cpf=%s not found", cpf))
 			} else {
 				fmt.Println(err)
-				w.WriteHeader(http.StatusInternalServerError)
-				w.Write(createErrorJSON(fmt.Errorf("internal server error")))
+				writeError(w, r, http.StatusInternalServerError, fmt.Errorf("internal server error"))
 			}
 			return
 		}
 
+		receipt := models.ErasureReceipt{
+			ID:              ulid.MustNew(ulid.Now(), rand.Reader).String(),
+			CPF:             cpf,
+			ErasedAt:        time.Now().UTC(),
+			DriverDeleted:   erasure.DriverDeleted,
+			TripsDeleted:    erasure.TripsDeleted,
+			TripsAnonymized: erasure.TripsAnonymized,
+		}
+
+		b, err := json.Marshal(&receipt)
+		if err != nil {
+			fmt.Println(err)
+			writeError(w, r, http.StatusInternalServerError, fmt.Errorf("internal server error"))
+			return
+		}
+
 		w.WriteHeader(http.StatusOK)
+		w.Write(b)
 	}
 }
@@ -0,0 +1,182 @@
+package handlers
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/rafaft/truck-pad/models"
+	"github.com/rafaft/truck-pad/store"
+)
+
+// valid CPFs, for test Drivers
+const (
+	testCPF      = "52998224725"
+	otherTestCPF = "48372162000"
+)
+
+func testDriverJSON(cpf, gender, cnhType string) string {
+	return `{"cpf":"` + cpf + `","name":"Ana","birth_date":"1980-05-01T00:00:00Z",` +
+		`"gender":"` + gender + `","has_vehicle":true,"cnh_type":"` + cnhType + `"}`
+}
+
+func TestAddDriver(t *testing.T) {
+	router := newTestRouter(store.NewMemoryStore())
+
+	w := serve(router, "POST", "/drivers", testDriverJSON("529.982.247-25", "F", "B"))
+	expectStatus(t, w, http.StatusCreated)
+	if location := w.Header().Get("Location"); location != "/drivers/"+testCPF {
+		t.Errorf("got Location %q, want /drivers/%s", location, testCPF)
+	}
+
+	var driver models.Driver
+	decodeBody(t, w, &driver)
+	if driver.CPF == nil || string(*driver.CPF) != testCPF {
+		t.Errorf("got cpf %v, want the normalized %s", driver.CPF, testCPF)
+	}
+
+	w = serve(router, "GET", "/drivers/"+testCPF, "")
+	expectStatus(t, w, http.StatusOK)
+}
+
+func TestAddDriverConflict(t *testing.T) {
+	router := newTestRouter(store.NewMemoryStore())
+
+	expectStatus(t, serve(router, "POST", "/drivers", testDriverJSON(testCPF, "F", "B")), http.StatusCreated)
+
+	w := serve(router, "POST", "/drivers", testDriverJSON(testCPF, "M", "C"))
+	expectStatus(t, w, http.StatusConflict)
+
+	var problem models.Problem
+	decodeBody(t, w, &problem)
+	if problem.Code != "conflict" {
+		t.Errorf("got code %q, want conflict", problem.Code)
+	}
+}
+
+func TestAddDriverInvalid(t *testing.T) {
+	router := newTestRouter(store.NewMemoryStore())
+
+	w := serve(router, "POST", "/drivers", `{"cpf":"52998224700","gender":"X"}`)
+	expectStatus(t, w, http.StatusBadRequest)
+
+	if contentType := w.Header().Get("Content-Type"); contentType != "application/problem+json" {
+		t.Errorf("got Content-Type %q, want application/problem+json", contentType)
+	}
+
+	var problem models.Problem
+	decodeBody(t, w, &problem)
+	if problem.Code != "validation_failed" || problem.Status != http.StatusBadRequest || problem.Instance != "/drivers" {
+		t.Errorf("got code %q, status %d and instance %q, want validation_failed, 400 and /drivers", problem.Code, problem.Status, problem.Instance)
+	}
+	// every Violation is reported, not only the first one
+	want := []string{"cpf:cpf", "gender:enum", "name:required", "birth_date:required", "has_vehicle:required", "cnh_type:required"}
+	if fields := violationFields(&models.ValidationError{Violations: problem.Violations}); !reflect.DeepEqual(fields, want) {
+		t.Errorf("got violations %v, want %v", fields, want)
+	}
+
+	w = serve(router, "POST", "/drivers", `{"cpf":`)
+	expectStatus(t, w, http.StatusBadRequest)
+	decodeBody(t, w, &problem)
+	if problem.Code != "malformed_json" {
+		t.Errorf("malformed JSON: got code %q, want malformed_json", problem.Code)
+	}
+}
+
+func TestGetAllDriversFilters(t *testing.T) {
+	router := newTestRouter(store.NewMemoryStore())
+	expectStatus(t, serve(router, "POST", "/drivers", testDriverJSON(testCPF, "F", "B")), http.StatusCreated)
+	expectStatus(t, serve(router, "POST", "/drivers", testDriverJSON(otherTestCPF, "M", "E")), http.StatusCreated)
+
+	tests := []struct {
+		query string
+		cpfs  []string
+	}{
+		{"", []string{otherTestCPF, testCPF}},
+		{"?gender=f", []string{testCPF}},
+		{"?cnh_type=E", []string{otherTestCPF}},
+		{"?gender=M&cnh_type=B", []string{}},
+	}
+	for _, test := range tests {
+		w := serve(router, "GET", "/drivers"+test.query, "")
+		expectStatus(t, w, http.StatusOK)
+
+		var drivers []*models.Driver
+		decodeBody(t, w, &drivers)
+		if len(drivers) != len(test.cpfs) {
+			t.Errorf("%s: got %d drivers, want %d", test.query, len(drivers), len(test.cpfs))
+			continue
+		}
+		for i, driver := range drivers {
+			if string(*driver.CPF) != test.cpfs[i] {
+				t.Errorf("%s: got driver %s, want %s", test.query, *driver.CPF, test.cpfs[i])
+			}
+		}
+	}
+
+	expectStatus(t, serve(router, "GET", "/drivers?gender=X", ""), http.StatusBadRequest)
+}
+
+func TestDriverETag(t *testing.T) {
+	forEachTestStore(t, func(t *testing.T, db store.Store) {
+		router := newTestRouter(db)
+		url := "/drivers/" + testCPF
+
+		w := serve(router, "POST", "/drivers", testDriverJSON(testCPF, "F", "B"))
+		expectStatus(t, w, http.StatusCreated)
+		created := w.Header().Get("ETag")
+
+		// the ETag of GET is the one POST returned, and it round-trips
+		w = serve(router, "GET", url, "")
+		expectStatus(t, w, http.StatusOK)
+		etag := w.Header().Get("ETag")
+		if len(etag) == 0 || etag != created {
+			t.Fatalf("got ETag %q on GET, want %q from POST", etag, created)
+		}
+		expectStatus(t, serveWithHeader(router, "GET", url, "If-None-Match", etag), http.StatusNotModified)
+		if w = serve(router, "GET", url+"?fields=name", ""); w.Header().Get("ETag") != "W/"+etag {
+			t.Errorf("got ETag %q on a partial representation, want W/%s", w.Header().Get("ETag"), etag)
+		}
+
+		w = serveAs(router, nil, "PATCH", url, `{"cnh_type":"C"}`, map[string]string{"If-Match": etag})
+		expectStatus(t, w, http.StatusOK)
+		current := w.Header().Get("ETag")
+		if len(current) == 0 || current == etag {
+			t.Fatalf("got ETag %q after an update, want a new one", current)
+		}
+
+		// the client's version is outdated
+		w = serveAs(router, nil, "PATCH", url, `{"cnh_type":"D"}`, map[string]string{"If-Match": etag})
+		expectStatus(t, w, http.StatusPreconditionFailed)
+		var problem models.Problem
+		decodeBody(t, w, &problem)
+		if problem.Code != "precondition_failed" {
+			t.Errorf("got code %q, want precondition_failed", problem.Code)
+		}
+		// weak entity tags and garbage never match
+		for _, ifMatch := range []string{"W/" + current, `"garbage"`} {
+			w = serveAs(router, nil, "PATCH", url, `{"cnh_type":"D"}`, map[string]string{"If-Match": ifMatch})
+			expectStatus(t, w, http.StatusPreconditionFailed)
+		}
+
+		// any of the entity tags may be current
+		w = serveAs(router, nil, "PATCH", url, `{"cnh_type":"D"}`, map[string]string{"If-Match": etag + ", " + current})
+		expectStatus(t, w, http.StatusOK)
+		w = serveAs(router, nil, "PATCH", url, `{"cnh_type":"E"}`, map[string]string{"If-Match": "*"})
+		expectStatus(t, w, http.StatusOK)
+
+		var driver models.Driver
+		decodeBody(t, serve(router, "GET", url, ""), &driver)
+		if *driver.CNHType != "E" {
+			t.Errorf("got cnh_type %s, want E", *driver.CNHType)
+		}
+
+		// If-Match can't match a Driver that doesn't exist
+		missing := "/drivers/" + otherTestCPF
+		expectStatus(t, serveAs(router, nil, "PATCH", missing, `{"cnh_type":"E"}`, nil), http.StatusNotFound)
+		for _, ifMatch := range []string{"*", current} {
+			w = serveAs(router, nil, "PATCH", missing, `{"cnh_type":"E"}`, map[string]string{"If-Match": ifMatch})
+			expectStatus(t, w, http.StatusPreconditionFailed)
+		}
+	})
+}
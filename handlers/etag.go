@@ -0,0 +1,104 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rafaft/truck-pad/models"
+)
+
+// driverETag is the entity tag of a Driver, derived from it's UpdateTime
+// and age (which changes without updates). Partial representations (with
+// "fields") have a weak entity tag, which can't be used on If-Match.
+func driverETag(driver *models.Driver, weak bool) string {
+	etag := fmt.Sprintf(`"%s.%d"`, strconv.FormatInt(driver.UpdateTime.UnixNano(), 36), driver.Age)
+	if weak {
+		etag = "W/" + etag
+	}
+
+	return etag
+}
+
+// tripETag is the entity tag of a Trip, derived from it's correctable
+// values, since Trips have no update time. The values are hashed, so the
+// entity tag doesn't change with the time's offset.
+func tripETag(trip *models.Trip) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s|%t|%d|%d|%v,%v|%v,%v",
+		trip.ID,
+		*trip.HasLoad,
+		*trip.VehicleType,
+		trip.Time.UnixNano(),
+		trip.Origin.Latitude,
+		trip.Origin.Longitude,
+		trip.Destination.Latitude,
+		trip.Destination.Longitude,
+	)))
+
+	return fmt.Sprintf(`"%x"`, sum[:12])
+}
+
+// matchTrip reports whether the request's If-Match header matches the
+// Trip's entity tag, using the strong comparison (RFC 7232). A request
+// without If-Match, or with "*", matches any existing Trip.
+func matchTrip(r *http.Request, trip *models.Trip) bool {
+	ifMatch := r.Header.Get("If-Match")
+	if len(ifMatch) == 0 {
+		return true
+	}
+
+	etag := tripETag(trip)
+	for _, candidate := range splitETags(ifMatch) {
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseETag returns the update time of a Driver's strong entity tag
+func parseETag(etag string) (time.Time, bool) {
+	if !strings.HasPrefix(etag, `"`) || !strings.HasSuffix(etag, `"`) || len(etag) < 3 {
+		return time.Time{}, false
+	}
+
+	parts := strings.Split(etag[1:len(etag)-1], ".")
+	if len(parts) != 2 {
+		return time.Time{}, false
+	}
+
+	nanos, err := strconv.ParseInt(parts[0], 36, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return time.Unix(0, nanos).UTC(), true
+}
+
+// splitETags splits the entity tags of a If-Match or If-None-Match header
+func splitETags(header string) []string {
+	etags := make([]string, 0)
+	for _, etag := range strings.Split(header, ",") {
+		if etag = strings.TrimSpace(etag); len(etag) > 0 {
+			etags = append(etags, etag)
+		}
+	}
+
+	return etags
+}
+
+// noneMatch reports whether the request's If-None-Match header matches
+// etag, using the weak comparison (RFC 7232)
+func noneMatch(r *http.Request, etag string) bool {
+	for _, candidate := range splitETags(r.Header.Get("If-None-Match")) {
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,352 @@
+package handlers
+
+import (
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rafaft/truck-pad/models"
+	"github.com/rafaft/truck-pad/store"
+)
+
+// export formats of Trip lists, by the "format" query parameter
+const (
+	formatCSV     = "csv"
+	formatGeoJSON = "geojson"
+	formatKML     = "kml"
+)
+
+// tripMediaTypes are the media types of each format of Trip lists, the
+// first one is the default
+var tripMediaTypes = []mediaType{
+	{formatJSON, "application/json"},
+	{formatNDJSON, "application/x-ndjson"},
+	{formatCSV, "text/csv"},
+	{formatGeoJSON, "application/geo+json"},
+	{formatKML, "application/vnd.google-earth.kml+xml"},
+}
+
+// tripCSVColumns are the columns of a Trip on CSV, named as on batch
+// uploads, so exported Trips can be uploaded again
+var tripCSVColumns = []string{
+	"id", "driver_id", "has_load", "vehicle_type", "time",
+	"origin.latitude", "origin.longitude", "destination.latitude", "destination.longitude",
+}
+
+// writeTripList writes the Trips of filter on the given format. A page of
+// Trips is read at once, since it's size is limited and the Link header to
+// the next page must be written before them. Otherwise, Trips are written
+// as they're read.
+func writeTripList(w http.ResponseWriter, r *http.Request, trips store.TripStore, query *queryParser,
+	filter store.TripFilter, format string) {
+	w.Header().Add("Vary", "Accept")
+
+	var each func(fn func(item interface{}) error) error
+	if filter.PageSize > 0 {
+		result, nextPageToken, err := trips.GetTrips(r.Context(), filter)
+		if err != nil {
+			if err == store.ErrInvalidPageToken {
+				writeError(w, r, http.StatusBadRequest, fmt.Errorf("invalid value for 'page_token'"))
+			} else {
+				fmt.Println(err)
+				writeError(w, r, http.StatusInternalServerError, fmt.Errorf("internal server error"))
+			}
+			return
+		}
+
+		query.renderTimes(result)
+		setNextPageLink(w, r, nextPageToken)
+
+		each = func(fn func(item interface{}) error) error {
+			for _, trip := range result {
+				if err := fn(trip); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	} else {
+		each = func(fn func(item interface{}) error) error {
+			return trips.EachTrip(r.Context(), filter, func(trip *models.Trip) error {
+				query.renderTime(trip)
+				return fn(trip)
+			})
+		}
+	}
+
+	contentType, enc := newTripEncoder(w, format, filter.Fields)
+	if err := streamList(w, contentType, enc, each); err != nil {
+		fmt.Println(err)
+		writeError(w, r, http.StatusInternalServerError, fmt.Errorf("internal server error"))
+	}
+}
+
+// newTripEncoder returns the content type and the encoder of a Trip list
+// on format
+func newTripEncoder(w io.Writer, format string, fields []string) (string, listEncoder) {
+	switch format {
+	case formatCSV:
+		return "text/csv; charset=utf-8", newTripCSVEncoder(w, fields)
+	case formatGeoJSON:
+		return "application/geo+json", &geoJSONEncoder{jsonArrayEncoder{w: w}}
+	case formatKML:
+		return "application/vnd.google-earth.kml+xml", &kmlEncoder{w: w, encoder: xml.NewEncoder(w)}
+	case formatNDJSON:
+		return "application/x-ndjson", newListEncoder(w, format)
+	default:
+		return "application/json", newListEncoder(w, format)
+	}
+}
+
+// tripCSVEncoder writes a header and a record per Trip. Only the columns
+// of the requested fields are written.
+type tripCSVEncoder struct {
+	writer  *csv.Writer
+	columns []string
+}
+
+func newTripCSVEncoder(w io.Writer, fields []string) *tripCSVEncoder {
+	columns := make([]string, 0, len(tripCSVColumns))
+	for _, column := range tripCSVColumns {
+		field := strings.SplitN(column, ".", 2)[0]
+		if len(fields) == 0 || containsString(fields, field) {
+			columns = append(columns, column)
+		}
+	}
+
+	return &tripCSVEncoder{csv.NewWriter(w), columns}
+}
+
+func (e *tripCSVEncoder) begin() error {
+	return e.writer.Write(e.columns)
+}
+
+func (e *tripCSVEncoder) encode(item interface{}) error {
+	trip := item.(*models.Trip)
+
+	record := make([]string, len(e.columns))
+	for i, column := range e.columns {
+		record[i] = tripCSVValue(trip, column)
+	}
+
+	return e.writer.Write(record)
+}
+
+func (e *tripCSVEncoder) flush() error {
+	e.writer.Flush()
+	return e.writer.Error()
+}
+
+func (e *tripCSVEncoder) end() error {
+	e.writer.Flush()
+	return e.writer.Error()
+}
+
+// tripCSVValue is the value of a column of tripCSVColumns, or an empty
+// string if the Trip doesn't have it
+func tripCSVValue(trip *models.Trip, column string) string {
+	switch column {
+	case "id":
+		return trip.ID
+	case "driver_id":
+		if trip.DriverID != nil {
+			return string(*trip.DriverID)
+		}
+	case "has_load":
+		if trip.HasLoad != nil {
+			return strconv.FormatBool(*trip.HasLoad)
+		}
+	case "vehicle_type":
+		if trip.VehicleType != nil {
+			return strconv.Itoa(int(*trip.VehicleType))
+		}
+	case "time":
+		if trip.Time != nil {
+			return trip.Time.Format(time.RFC3339Nano)
+		}
+	case "origin.latitude":
+		if trip.Origin != nil {
+			return formatCoordinate(trip.Origin.Latitude)
+		}
+	case "origin.longitude":
+		if trip.Origin != nil {
+			return formatCoordinate(trip.Origin.Longitude)
+		}
+	case "destination.latitude":
+		if trip.Destination != nil {
+			return formatCoordinate(trip.Destination.Latitude)
+		}
+	case "destination.longitude":
+		if trip.Destination != nil {
+			return formatCoordinate(trip.Destination.Longitude)
+		}
+	}
+
+	return ""
+}
+
+func formatCoordinate(c float64) string {
+	return strconv.FormatFloat(c, 'f', -1, 64)
+}
+
+// geoJSONFeature is a Trip as a GeoJSON (RFC 7946) Feature: a LineString
+// from origin to destination
+type geoJSONFeature struct {
+	Type       string                 `json:"type"`
+	ID         string                 `json:"id,omitempty"`
+	Geometry   *geoJSONGeometry       `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+type geoJSONGeometry struct {
+	Type        string       `json:"type"`
+	Coordinates [][2]float64 `json:"coordinates"`
+}
+
+// geoJSONEncoder writes a FeatureCollection. Trips without origin or
+// destination (e.g.: left out by "fields") have no geometry.
+type geoJSONEncoder struct {
+	features jsonArrayEncoder
+}
+
+func (e *geoJSONEncoder) begin() error {
+	if _, err := e.features.w.Write([]byte(`{"type":"FeatureCollection","features":`)); err != nil {
+		return err
+	}
+
+	return e.features.begin()
+}
+
+func (e *geoJSONEncoder) encode(item interface{}) error {
+	trip := item.(*models.Trip)
+
+	feature := geoJSONFeature{
+		Type:       "Feature",
+		ID:         trip.ID,
+		Properties: make(map[string]interface{}),
+	}
+	if trip.Origin != nil && trip.Destination != nil {
+		// GeoJSON positions are longitude first
+		feature.Geometry = &geoJSONGeometry{
+			Type: "LineString",
+			Coordinates: [][2]float64{
+				{trip.Origin.Longitude, trip.Origin.Latitude},
+				{trip.Destination.Longitude, trip.Destination.Latitude},
+			},
+		}
+	}
+	if trip.DriverID != nil {
+		feature.Properties["driver_id"] = trip.DriverID
+	}
+	if trip.HasLoad != nil {
+		feature.Properties["has_load"] = trip.HasLoad
+	}
+	if trip.VehicleType != nil {
+		feature.Properties["vehicle_type"] = trip.VehicleType
+	}
+	if trip.Time != nil {
+		feature.Properties["time"] = trip.Time
+	}
+
+	return e.features.encode(&feature)
+}
+
+func (e *geoJSONEncoder) flush() error {
+	return nil
+}
+
+func (e *geoJSONEncoder) end() error {
+	if err := e.features.end(); err != nil {
+		return err
+	}
+
+	_, err := e.features.w.Write([]byte("}"))
+	return err
+}
+
+// kmlPlacemark is a Trip as a KML Placemark: a LineString from origin to
+// destination, with the other fields as ExtendedData
+type kmlPlacemark struct {
+	XMLName    xml.Name       `xml:"Placemark"`
+	Name       string         `xml:"name,omitempty"`
+	When       string         `xml:"TimeStamp>when,omitempty"`
+	Data       []kmlData      `xml:"ExtendedData>Data"`
+	LineString *kmlLineString `xml:"LineString,omitempty"`
+}
+
+type kmlData struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value"`
+}
+
+type kmlLineString struct {
+	Coordinates string `xml:"coordinates"`
+}
+
+// kmlEncoder writes a KML Document, with a Placemark per Trip
+type kmlEncoder struct {
+	w       io.Writer
+	encoder *xml.Encoder
+}
+
+var (
+	kmlElement = xml.StartElement{
+		Name: xml.Name{Local: "kml"},
+		Attr: []xml.Attr{{Name: xml.Name{Local: "xmlns"}, Value: "http://www.opengis.net/kml/2.2"}},
+	}
+	kmlDocumentElement = xml.StartElement{Name: xml.Name{Local: "Document"}}
+)
+
+func (e *kmlEncoder) begin() error {
+	if _, err := e.w.Write([]byte(xml.Header)); err != nil {
+		return err
+	}
+	if err := e.encoder.EncodeToken(kmlElement); err != nil {
+		return err
+	}
+
+	return e.encoder.EncodeToken(kmlDocumentElement)
+}
+
+func (e *kmlEncoder) encode(item interface{}) error {
+	trip := item.(*models.Trip)
+
+	placemark := kmlPlacemark{Name: trip.ID}
+	if trip.Time != nil {
+		placemark.When = trip.Time.Format(time.RFC3339Nano)
+	}
+	for _, column := range []string{"driver_id", "has_load", "vehicle_type"} {
+		if value := tripCSVValue(trip, column); len(value) > 0 {
+			placemark.Data = append(placemark.Data, kmlData{column, value})
+		}
+	}
+	if trip.Origin != nil && trip.Destination != nil {
+		// KML coordinates are "longitude,latitude"
+		placemark.LineString = &kmlLineString{fmt.Sprintf("%s,%s %s,%s",
+			formatCoordinate(trip.Origin.Longitude), formatCoordinate(trip.Origin.Latitude),
+			formatCoordinate(trip.Destination.Longitude), formatCoordinate(trip.Destination.Latitude),
+		)}
+	}
+
+	return e.encoder.Encode(&placemark)
+}
+
+func (e *kmlEncoder) flush() error {
+	return e.encoder.Flush()
+}
+
+func (e *kmlEncoder) end() error {
+	if err := e.encoder.EncodeToken(kmlDocumentElement.End()); err != nil {
+		return err
+	}
+	if err := e.encoder.EncodeToken(kmlElement.End()); err != nil {
+		return err
+	}
+
+	return e.encoder.Flush()
+}
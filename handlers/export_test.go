@@ -0,0 +1,209 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/genproto/googleapis/type/latlng"
+
+	"github.com/rafaft/truck-pad/models"
+	"github.com/rafaft/truck-pad/store"
+)
+
+// escapedTripID needs escaping on every format: CSV's separator, quotes
+// and line breaks, and JSON's and XML's special characters
+const escapedTripID = "a,\"b\"\r\nc <d>&'e' </script>"
+
+func newExportTestTrip() *models.Trip {
+	driverID := models.DriverID(testCPF)
+	hasLoad := true
+	vehicleType := models.SimpleTrailer
+	tripTime := time.Date(2020, 2, 14, 12, 0, 0, 500, time.FixedZone("", -3*60*60))
+
+	return &models.Trip{
+		ID:          escapedTripID,
+		DriverID:    &driverID,
+		HasLoad:     &hasLoad,
+		VehicleType: &vehicleType,
+		Time:        &tripTime,
+		Origin:      &latlng.LatLng{Latitude: -23.55, Longitude: -46.63},
+		Destination: &latlng.LatLng{Latitude: -22.9, Longitude: -43.2},
+	}
+}
+
+// encodeTrips encodes trips on format, as writeTripList does
+func encodeTrips(t *testing.T, format string, fields []string, trips ...*models.Trip) []byte {
+	t.Helper()
+
+	var b bytes.Buffer
+	_, enc := newTripEncoder(&b, format, fields)
+	err := enc.begin()
+	for _, trip := range trips {
+		if err == nil {
+			err = enc.encode(trip)
+		}
+	}
+	if err == nil {
+		err = enc.end()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return b.Bytes()
+}
+
+func TestTripCSVExport(t *testing.T) {
+	trip := newExportTestTrip()
+
+	records, err := csv.NewReader(bytes.NewReader(encodeTrips(t, formatCSV, nil, trip))).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{
+		tripCSVColumns,
+		{escapedTripID, testCPF, "true", "4", "2020-02-14T12:00:00.0000005-03:00", "-23.55", "-46.63", "-22.9", "-43.2"},
+	}
+	// csv.Reader turns "\r\n" into "\n" on quoted fields
+	want[1][0] = strings.Replace(want[1][0], "\r\n", "\n", 1)
+	if !reflect.DeepEqual(records, want) {
+		t.Errorf("got %q, want %q", records, want)
+	}
+
+	// only the columns of the requested fields
+	records, err = csv.NewReader(bytes.NewReader(encodeTrips(t, formatCSV, []string{"has_load", "origin"}, trip))).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = [][]string{{"has_load", "origin.latitude", "origin.longitude"}, {"true", "-23.55", "-46.63"}}
+	if !reflect.DeepEqual(records, want) {
+		t.Errorf("fields=has_load,origin: got %q, want %q", records, want)
+	}
+}
+
+func TestTripGeoJSONExport(t *testing.T) {
+	trip := newExportTestTrip()
+	noGeometry := &models.Trip{ID: "no-geometry", HasLoad: trip.HasLoad}
+
+	b := encodeTrips(t, formatGeoJSON, nil, trip, noGeometry)
+	if bytes.Contains(b, []byte("</script>")) {
+		t.Errorf("got unescaped HTML on %s", b)
+	}
+
+	var collection struct {
+		Type     string            `json:"type"`
+		Features []*geoJSONFeature `json:"features"`
+	}
+	if err := json.Unmarshal(b, &collection); err != nil {
+		t.Fatalf("%v on %s", err, b)
+	}
+	if collection.Type != "FeatureCollection" || len(collection.Features) != 2 {
+		t.Fatalf("got a %s with %d features, want a FeatureCollection with 2", collection.Type, len(collection.Features))
+	}
+
+	feature := collection.Features[0]
+	if feature.ID != escapedTripID {
+		t.Errorf("got id %q, want %q", feature.ID, escapedTripID)
+	}
+	// positions are longitude first
+	geometry := &geoJSONGeometry{Type: "LineString", Coordinates: [][2]float64{{-46.63, -23.55}, {-43.2, -22.9}}}
+	if !reflect.DeepEqual(feature.Geometry, geometry) {
+		t.Errorf("got geometry %+v, want %+v", feature.Geometry, geometry)
+	}
+	properties := map[string]interface{}{
+		"driver_id":    testCPF,
+		"has_load":     true,
+		"vehicle_type": 4.0,
+		"time":         "2020-02-14T12:00:00.0000005-03:00",
+	}
+	if !reflect.DeepEqual(feature.Properties, properties) {
+		t.Errorf("got properties %v, want %v", feature.Properties, properties)
+	}
+
+	if feature = collection.Features[1]; feature.Geometry != nil || len(feature.Properties) != 1 {
+		t.Errorf("got geometry %+v and properties %v, want only has_load", feature.Geometry, feature.Properties)
+	}
+}
+
+func TestTripKMLExport(t *testing.T) {
+	trip := newExportTestTrip()
+
+	b := encodeTrips(t, formatKML, nil, trip)
+	if !bytes.HasPrefix(b, []byte(xml.Header)) || bytes.Contains(b, []byte("<d>")) {
+		t.Errorf("got %s, want a XML document with escaped names", b)
+	}
+
+	var kml struct {
+		XMLName    xml.Name        `xml:"http://www.opengis.net/kml/2.2 kml"`
+		Placemarks []*kmlPlacemark `xml:"Document>Placemark"`
+	}
+	if err := xml.Unmarshal(b, &kml); err != nil {
+		t.Fatalf("%v on %s", err, b)
+	}
+	if len(kml.Placemarks) != 1 {
+		t.Fatalf("got %d placemarks, want 1", len(kml.Placemarks))
+	}
+
+	placemark := kml.Placemarks[0]
+	// "\r" is escaped too, XML would normalize "\r\n" into "\n" otherwise
+	if placemark.Name != escapedTripID {
+		t.Errorf("got name %q, want %q", placemark.Name, escapedTripID)
+	}
+	if placemark.When != "2020-02-14T12:00:00.0000005-03:00" {
+		t.Errorf("got when %q", placemark.When)
+	}
+	data := []kmlData{{"driver_id", testCPF}, {"has_load", "true"}, {"vehicle_type", "4"}}
+	if !reflect.DeepEqual(placemark.Data, data) {
+		t.Errorf("got data %v, want %v", placemark.Data, data)
+	}
+	// coordinates are "longitude,latitude"
+	if placemark.LineString == nil || placemark.LineString.Coordinates != "-46.63,-23.55 -43.2,-22.9" {
+		t.Errorf("got line string %+v", placemark.LineString)
+	}
+}
+
+func TestGetAllTripsFormats(t *testing.T) {
+	router := newTestRouter(store.NewMemoryStore())
+	addTestTrip(t, router, testCPF, "2020-02-14T15:00:00Z", true)
+	addTestTrip(t, router, testCPF, "2020-02-14T16:00:00Z", false)
+
+	tests := []struct {
+		target      string
+		accept      string
+		contentType string
+		// what's written once per Trip, the CSV header is a line too
+		separator string
+		n         int
+	}{
+		{"/trips?has_load=true&format=csv", "", "text/csv; charset=utf-8", "\n", 2},
+		{"/trips?has_load=true", "text/csv", "text/csv; charset=utf-8", "\n", 2},
+		{"/trips?has_load=true&format=geojson", "", "application/geo+json", `"Feature"`, 1},
+		{"/trips?has_load=true", "application/geo+json", "application/geo+json", `"Feature"`, 1},
+		{"/trips?has_load=true&format=kml", "", "application/vnd.google-earth.kml+xml", "<Placemark>", 1},
+		// the format parameter wins over Accept
+		{"/trips?has_load=true&format=kml", "text/csv", "application/vnd.google-earth.kml+xml", "<Placemark>", 1},
+		{"/trips?page_size=10&format=csv", "", "text/csv; charset=utf-8", "\n", 3},
+	}
+	for _, test := range tests {
+		w := serveWithHeader(router, "GET", test.target, "Accept", test.accept)
+		expectStatus(t, w, http.StatusOK)
+		if contentType := w.Header().Get("Content-Type"); contentType != test.contentType {
+			t.Errorf("%s (Accept: %s): got Content-Type %q, want %q", test.target, test.accept, contentType, test.contentType)
+		}
+		// the filters apply
+		if n := strings.Count(w.Body.String(), test.separator); n != test.n {
+			t.Errorf("%s (Accept: %s): got %d %q, want %d on %s", test.target, test.accept, n, test.separator, test.n, w.Body.String())
+		}
+	}
+
+	w := serveWithHeader(router, "GET", "/trips", "Accept", "image/png")
+	expectStatus(t, w, http.StatusNotAcceptable)
+	expectStatus(t, serve(router, "GET", "/trips?format=xlsx", ""), http.StatusBadRequest)
+}
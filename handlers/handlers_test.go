@@ -0,0 +1,96 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	"github.com/rafaft/truck-pad/store"
+)
+
+// the patterns of main.go's routes
+const (
+	testULIDPattern   = `[0-9A-HJKMNP-TV-Z]{26}`
+	testTripIDPattern = `\d{14}|` + testULIDPattern
+)
+
+// newTestRouter routes the main routes of Drivers and Trips to db, without
+// authentication
+func newTestRouter(db store.Store) *mux.Router {
+	router := mux.NewRouter()
+
+	router.HandleFunc("/drivers", GetAllDrivers(db)).Methods("GET")
+	router.HandleFunc("/drivers", AddDriver(db)).Methods("POST")
+	router.HandleFunc(`/drivers/{cpf:\d{11}}`, GetDriver(db)).Methods("GET")
+	router.HandleFunc(`/drivers/{cpf:\d{11}}`, UpdateDriver(db)).Methods("PATCH")
+	router.HandleFunc(`/drivers/{cpf:\d{11}}/history`, GetDriverHistory(db)).Methods("GET")
+	router.HandleFunc(`/drivers/{cpf:\d{11}}/trips`, GetTripsByDriver(db)).Methods("GET")
+	router.HandleFunc(`/drivers/{cpf:\d{11}}/trips`, AddTripByDriver(db)).Methods("POST")
+	router.HandleFunc(`/drivers/{cpf:\d{11}}/trips/{id:`+testTripIDPattern+`}`, GetTripByID(db)).Methods("GET")
+	router.HandleFunc(`/drivers/{cpf:\d{11}}/trips/latest`, GetLatestTrip(db)).Methods("GET")
+	router.HandleFunc(`/drivers/{cpf:\d{11}}/trips/{id:`+testTripIDPattern+`}`, UpdateTrip(db)).Methods("PATCH")
+	router.HandleFunc(`/drivers/{cpf:\d{11}}/trips/{id:`+testTripIDPattern+`}`, DeleteTrip(db)).Methods("DELETE")
+	router.HandleFunc(`/drivers/{cpf:\d{11}}/trips/{id:`+testTripIDPattern+`}/corrections`, GetTripCorrections(db)).Methods("GET")
+
+	router.HandleFunc("/trips", GetAllTrips(db)).Methods("GET")
+	router.HandleFunc("/trips", AddTrip(db)).Methods("POST")
+	router.HandleFunc(`/trips/{id:`+testULIDPattern+`}`, GetTrip(db)).Methods("GET")
+
+	return router
+}
+
+// forEachTestStore runs test against a new MemoryStore and SQLStore
+func forEachTestStore(t *testing.T, test func(t *testing.T, db store.Store)) {
+	t.Run("memory", func(t *testing.T) {
+		test(t, store.NewMemoryStore())
+	})
+	t.Run("sqlite", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "truck-pad")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		db, err := store.NewSQLiteStore(filepath.Join(dir, "truck-pad.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		test(t, db)
+	})
+}
+
+// serve sends a request to handler and returns the response
+func serve(handler http.Handler, method, target, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	return w
+}
+
+// decodeBody decodes a JSON response into v
+func decodeBody(t *testing.T, w *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+
+	if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+		t.Fatalf("invalid JSON response %q: %v", w.Body.String(), err)
+	}
+}
+
+// expectStatus fails the test if the response doesn't have status
+func expectStatus(t *testing.T, w *httptest.ResponseRecorder, status int) {
+	t.Helper()
+
+	if w.Code != status {
+		t.Fatalf("got status %d, want %d: %s", w.Code, status, w.Body.String())
+	}
+}
@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"github.com/rafaft/truck-pad/models"
+	"github.com/rafaft/truck-pad/store"
+)
+
+// GetDriverHistory returns the versions of a Driver, oldest first, each
+// valid from it's valid_from until the next one's
+func GetDriverHistory(drivers store.DriverStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		query := newQueryParser(r)
+		if err := query.Err(); err != nil {
+			writeError(w, r, http.StatusBadRequest, err)
+			return
+		}
+		query.setPreferenceApplied(w)
+
+		history, ok := getDriverHistory(w, r, drivers)
+		if !ok {
+			return
+		}
+
+		b, err := json.Marshal(history)
+		if err != nil {
+			fmt.Println(err)
+			writeError(w, r, http.StatusInternalServerError, fmt.Errorf("internal server error"))
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write(b)
+	}
+}
+
+// getDriverHistory reads the history of the request's CPF, with each
+// version's valid_to. A Driver not written since versions were kept has
+// it's current values as the only version. If the Driver doesn't exist
+// or can't be read, the error is written and ok is false.
+func getDriverHistory(w http.ResponseWriter, r *http.Request, drivers store.DriverStore) (history []*models.DriverVersion, ok bool) {
+	cpf := mux.Vars(r)["cpf"]
+	history, err := drivers.GetDriverHistory(r.Context(), cpf)
+	if err == nil && len(history) == 0 {
+		var result []*models.Driver
+		result, _, err = drivers.GetDrivers(r.Context(), store.DriverFilter{CPF: cpf})
+		if len(result) > 0 {
+			history = append(history, models.NewDriverVersion(result[0]))
+		}
+	}
+	if err != nil {
+		fmt.Println(err)
+		writeError(w, r, http.StatusInternalServerError, fmt.Errorf("internal server error"))
+		return nil, false
+	}
+	if len(history) == 0 {
+		writeError(w, r, http.StatusNotFound, fmt.Errorf("cpf=%s not found", cpf))
+		return nil, false
+	}
+
+	models.SetValidTo(history)
+	return history, true
+}
@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/rafaft/truck-pad/models"
+	"github.com/rafaft/truck-pad/store"
+)
+
+func TestDriverAsOf(t *testing.T) {
+	forEachTestStore(t, func(t *testing.T, db store.Store) {
+		router := newTestRouter(db)
+		driverURL := "/drivers/" + testCPF
+
+		expectStatus(t, serve(router, "POST", "/drivers", testDriverJSON(testCPF, "F", "B")), http.StatusCreated)
+		expectStatus(t, serve(router, "PATCH", driverURL, `{"cnh_type":"C"}`), http.StatusOK)
+		expectStatus(t, serve(router, "PATCH", driverURL, `{"has_vehicle":false,"cnh_type":"E"}`), http.StatusOK)
+
+		w := serve(router, "GET", driverURL+"/history", "")
+		expectStatus(t, w, http.StatusOK)
+		var history []*models.DriverVersion
+		decodeBody(t, w, &history)
+		if len(history) != 3 {
+			t.Fatalf("got %d versions, want 3", len(history))
+		}
+		for i, version := range history[:2] {
+			if version.ValidTo == nil || !version.ValidTo.Equal(history[i+1].ValidFrom) {
+				t.Errorf("version %d: got valid_to %v, want %s", i, version.ValidTo, history[i+1].ValidFrom)
+			}
+		}
+		if history[2].ValidTo != nil {
+			t.Errorf("got valid_to %v on the current version", history[2].ValidTo)
+		}
+
+		tests := []struct {
+			asOf       string
+			cnhType    string
+			hasVehicle bool
+		}{
+			{history[0].ValidFrom.Format(time.RFC3339Nano), "B", true},
+			{history[1].ValidFrom.Add(-time.Nanosecond).Format(time.RFC3339Nano), "B", true},
+			{history[1].ValidFrom.Format(time.RFC3339Nano), "C", true},
+			// on any offset
+			{history[2].ValidFrom.In(time.FixedZone("", -3*60*60)).Format(time.RFC3339Nano), "E", false},
+			{"now", "E", false},
+		}
+		for _, test := range tests {
+			w := serve(router, "GET", driverURL+"?as_of="+url.QueryEscape(test.asOf), "")
+			expectStatus(t, w, http.StatusOK)
+			// past versions don't change, they have no ETag
+			if etag := w.Header().Get("ETag"); len(etag) > 0 {
+				t.Errorf("as_of=%s: got ETag %s", test.asOf, etag)
+			}
+
+			var driver models.Driver
+			decodeBody(t, w, &driver)
+			if *driver.CNHType != models.CNHType(test.cnhType) || *driver.HasVehicle != test.hasVehicle {
+				t.Errorf("as_of=%s: got cnh_type %s and has_vehicle %t, want %s and %t",
+					test.asOf, *driver.CNHType, *driver.HasVehicle, test.cnhType, test.hasVehicle)
+			}
+		}
+
+		// the age is the Driver's age at the time
+		w = serve(router, "GET", driverURL+"?as_of="+url.QueryEscape(history[0].ValidFrom.Format(time.RFC3339Nano))+"&fields=age,cnh_type", "")
+		expectStatus(t, w, http.StatusOK)
+		// Driver doesn't decode "age", since it's calculated
+		var fields map[string]interface{}
+		decodeBody(t, w, &fields)
+		age := calculateAge(time.Date(1980, 5, 1, 0, 0, 0, 0, time.UTC), history[0].ValidFrom)
+		if want := map[string]interface{}{"age": float64(age), "cnh_type": "B"}; !reflect.DeepEqual(fields, want) {
+			t.Errorf("got %v, want %v", fields, want)
+		}
+
+		// the Driver didn't exist yet
+		before := history[0].ValidFrom.Add(-time.Nanosecond).Format(time.RFC3339Nano)
+		expectStatus(t, serve(router, "GET", driverURL+"?as_of="+url.QueryEscape(before), ""), http.StatusNotFound)
+		expectStatus(t, serve(router, "GET", "/drivers/"+otherTestCPF+"?as_of=now", ""), http.StatusNotFound)
+		expectStatus(t, serve(router, "GET", "/drivers/"+otherTestCPF+"/history", ""), http.StatusNotFound)
+		expectStatus(t, serve(router, "GET", driverURL+"?as_of=last_year", ""), http.StatusBadRequest)
+	})
+}
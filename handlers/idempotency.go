@@ -0,0 +1,184 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/rafaft/truck-pad/models"
+	"github.com/rafaft/truck-pad/store"
+)
+
+// idempotencyWindow is for how long the response of a request with an
+// Idempotency-Key is replayed to retries
+const idempotencyWindow = 24 * time.Hour
+
+// idempotencyLease is for how long a key is reserved while it's request
+// runs. It's only extended to the idempotencyWindow once there's a
+// response, so a request that never finishes (the instance crashed) only
+// holds it's key for the lease.
+const idempotencyLease = time.Minute
+
+const maxIdempotencyKeyLength = 255
+
+// response headers replayed to retries
+var idempotentHeaders = []string{"Content-Type", "Location", "ETag"}
+
+// Idempotent makes next safe to retry: the first response to a request
+// with an "Idempotency-Key" header is stored and replayed to retries with
+// the same key. Server errors are not stored, so they can be retried.
+// A retry while the first request is running gets a 409, and reusing a key
+// for a different request (method, path or body) gets a 422.
+//
+// The response is stored even if the client is gone, as that's when it
+// retries, so the store is called without the request's context.
+func Idempotent(keys store.IdempotencyStore, next func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if len(key) == 0 {
+			next(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			writeError(w, r, http.StatusBadRequest, fmt.Errorf(
+				"'Idempotency-Key' must have up to %d characters", maxIdempotencyKeyLength),
+			)
+			return
+		}
+		// keys are per client, so a client can't get another's response
+		if principal := principalFrom(r); principal != nil {
+			key = principal.ID + "/" + key
+		}
+
+		// the body is read here, so it's given back to next
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			writeBodyError(w, r, err)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		req := &store.IdempotentRequest{
+			Key:         key,
+			DriverID:    requestDriverID(r, body),
+			Fingerprint: fmt.Sprintf("%x", sha256.Sum256([]byte(r.Method+" "+r.URL.Path+"\n"+string(body)))),
+			ExpiresAt:   time.Now().Add(idempotencyLease),
+		}
+
+		existing, err := keys.BeginIdempotentRequest(r.Context(), req)
+		if err != nil {
+			fmt.Println(err)
+			writeError(w, r, http.StatusInternalServerError, fmt.Errorf("internal server error"))
+			return
+		}
+		if existing != nil {
+			replayIdempotentRequest(w, r, req, existing)
+			return
+		}
+
+		// if next panics, the key is released for a retry
+		completed := false
+		defer func() {
+			if !completed {
+				if err := keys.ReleaseIdempotentRequest(context.Background(), key); err != nil {
+					fmt.Println(err)
+				}
+			}
+		}()
+
+		recorder := &responseRecorder{ResponseWriter: w, statusCode: http.StatusOK}
+		next(recorder, r)
+
+		if recorder.statusCode >= http.StatusInternalServerError {
+			return
+		}
+		req.StatusCode = recorder.statusCode
+		req.Header = make(map[string]string)
+		for _, name := range idempotentHeaders {
+			if value := recorder.Header().Get(name); len(value) > 0 {
+				req.Header[name] = value
+			}
+		}
+		req.Body = recorder.body.Bytes()
+		req.ExpiresAt = time.Now().Add(idempotencyWindow)
+		if err = keys.CompleteIdempotentRequest(context.Background(), req); err != nil {
+			// the response was already sent, a retry will run it again
+			// once the lease expires
+			fmt.Println(err)
+		}
+		completed = err == nil
+	}
+}
+
+// requestDriverID returns the CPF of the Driver a request is about, from
+// it's path or body, so the stored response is erased with the Driver
+func requestDriverID(r *http.Request, body []byte) string {
+	if cpf, ok := mux.Vars(r)["cpf"]; ok {
+		return cpf
+	}
+
+	var trip struct {
+		DriverID string `json:"driver_id"`
+	}
+	json.Unmarshal(body, &trip)
+	cpf, _ := models.NormalizeCPF(trip.DriverID)
+
+	return cpf
+}
+
+// replayIdempotentRequest writes the stored response of a request with the
+// same Idempotency-Key
+func replayIdempotentRequest(w http.ResponseWriter, r *http.Request, req, existing *store.IdempotentRequest) {
+	if existing.Fingerprint != req.Fingerprint {
+		writeError(w, r, http.StatusUnprocessableEntity, fmt.Errorf(
+			"'Idempotency-Key' was already used for a different request"),
+		)
+		return
+	}
+	if !existing.Completed {
+		w.Header().Set("Retry-After", "1")
+		writeError(w, r, http.StatusConflict, fmt.Errorf(
+			"a request with the same 'Idempotency-Key' is still being processed"),
+		)
+		return
+	}
+
+	for name, value := range existing.Header {
+		w.Header().Set(name, value)
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(existing.StatusCode)
+	w.Write(existing.Body)
+}
+
+// responseRecorder writes a response while keeping it's status code and
+// body
+type responseRecorder struct {
+	http.ResponseWriter
+	statusCode int
+	body       bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(statusCode int) {
+	r.statusCode = statusCode
+	r.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+// Flush passes flushes of streamed responses through
+func (r *responseRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
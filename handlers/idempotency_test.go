@@ -0,0 +1,145 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rafaft/truck-pad/models"
+	"github.com/rafaft/truck-pad/store"
+)
+
+// serveIdempotent sends a request with an Idempotency-Key to handler
+func serveIdempotent(handler http.Handler, key, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/trips", strings.NewReader(body))
+	r.Header.Set("Idempotency-Key", key)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	return w
+}
+
+func TestIdempotentReplay(t *testing.T) {
+	forEachTestStore(t, func(t *testing.T, db store.Store) {
+		handler := http.HandlerFunc(Idempotent(db, AddTrip(db)))
+		body := testTripJSON(testCPF, "2020-02-14T15:00:00Z", true)
+
+		first := serveIdempotent(handler, "key-1", body)
+		expectStatus(t, first, http.StatusCreated)
+		retry := serveIdempotent(handler, "key-1", body)
+		expectStatus(t, retry, http.StatusCreated)
+
+		if retry.Header().Get("Idempotent-Replayed") != "true" {
+			t.Errorf("got no Idempotent-Replayed header on the retry")
+		}
+		if retry.Header().Get("Location") != first.Header().Get("Location") || retry.Body.String() != first.Body.String() {
+			t.Errorf("got %s %s, want the first response %s %s",
+				retry.Header().Get("Location"), retry.Body, first.Header().Get("Location"), first.Body)
+		}
+
+		// without the key, it's a duplicate
+		expectStatus(t, serve(handler, "POST", "/trips", body), http.StatusConflict)
+
+		// completed requests are kept for the idempotency window
+		existing, err := db.BeginIdempotentRequest(context.Background(), &store.IdempotentRequest{Key: "key-1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if existing == nil || !existing.Completed || existing.ExpiresAt.Before(time.Now().Add(idempotencyWindow-time.Minute)) {
+			t.Errorf("got %+v, want a completed request kept for %s", existing, idempotencyWindow)
+		}
+	})
+}
+
+func TestIdempotentFingerprintMismatch(t *testing.T) {
+	forEachTestStore(t, func(t *testing.T, db store.Store) {
+		handler := http.HandlerFunc(Idempotent(db, AddTrip(db)))
+
+		expectStatus(t, serveIdempotent(handler, "key-1", testTripJSON(testCPF, "2020-02-14T15:00:00Z", true)), http.StatusCreated)
+
+		w := serveIdempotent(handler, "key-1", testTripJSON(testCPF, "2020-02-14T16:00:00Z", true))
+		expectStatus(t, w, http.StatusUnprocessableEntity)
+
+		var problem models.Problem
+		decodeBody(t, w, &problem)
+		if !strings.Contains(problem.Detail, "different request") {
+			t.Errorf("got detail %q", problem.Detail)
+		}
+	})
+}
+
+func TestIdempotentConcurrentRequest(t *testing.T) {
+	forEachTestStore(t, func(t *testing.T, db store.Store) {
+		started := make(chan struct{})
+		finish := make(chan struct{})
+		handler := http.HandlerFunc(Idempotent(db, func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			<-finish
+			w.WriteHeader(http.StatusCreated)
+		}))
+
+		done := make(chan *httptest.ResponseRecorder)
+		go func() { done <- serveIdempotent(handler, "key-1", "{}") }()
+		<-started
+
+		w := serveIdempotent(handler, "key-1", "{}")
+		expectStatus(t, w, http.StatusConflict)
+		if w.Header().Get("Retry-After") == "" {
+			t.Errorf("got no Retry-After header")
+		}
+
+		close(finish)
+		expectStatus(t, <-done, http.StatusCreated)
+
+		w = serveIdempotent(handler, "key-1", "{}")
+		expectStatus(t, w, http.StatusCreated)
+		if w.Header().Get("Idempotent-Replayed") != "true" {
+			t.Errorf("got no Idempotent-Replayed header once the first request finished")
+		}
+	})
+}
+
+func TestIdempotentAbandonedRequest(t *testing.T) {
+	forEachTestStore(t, func(t *testing.T, db store.Store) {
+		handler := http.HandlerFunc(Idempotent(db, AddTrip(db)))
+		body := testTripJSON(testCPF, "2020-02-14T15:00:00Z", true)
+
+		// a request that never finished, whose lease expired
+		_, err := db.BeginIdempotentRequest(context.Background(), &store.IdempotentRequest{
+			Key:       "key-1",
+			ExpiresAt: time.Now().Add(-time.Second),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectStatus(t, serveIdempotent(handler, "key-1", body), http.StatusCreated)
+
+		// server errors and panics release the key
+		calls := 0
+		failing := http.HandlerFunc(Idempotent(db, func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			switch calls {
+			case 1:
+				writeError(w, r, http.StatusInternalServerError, fmt.Errorf("internal server error"))
+			case 2:
+				panic("test panic")
+			default:
+				w.WriteHeader(http.StatusCreated)
+			}
+		}))
+		expectStatus(t, serveIdempotent(failing, "key-2", "{}"), http.StatusInternalServerError)
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("got no panic")
+				}
+			}()
+			serveIdempotent(failing, "key-2", "{}")
+		}()
+		expectStatus(t, serveIdempotent(failing, "key-2", "{}"), http.StatusCreated)
+	})
+}
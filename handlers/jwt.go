@@ -0,0 +1,304 @@
+package handlers
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/rafaft/truck-pad/models"
+)
+
+// BearerTokens validates the JWTs on the "Authorization: Bearer" header.
+// Nil disables bearer tokens.
+var BearerTokens *JWTValidator
+
+// clockSkew is how much the clocks of the token's issuer and the API may
+// differ, when checking "exp" and "nbf"
+const clockSkew = time.Minute
+
+// errInvalidToken is returned for every token that fails validation, the
+// reason isn't told to the client
+var errInvalidToken = errors.New("invalid bearer token")
+
+// JWTValidator validates JWTs signed with HS256, with a shared secret, or
+// RS256 and ES256, with the public keys of a local JWKS file, and maps
+// their claims to a Principal
+type JWTValidator struct {
+	secret []byte
+	// public keys by their "kid"
+	keys map[string]crypto.PublicKey
+	// Issuer and Audience are checked against the "iss" and "aud" claims,
+	// when not empty
+	Issuer   string
+	Audience string
+	// RoleClaim is the claim with the role, a string or a list of strings
+	// (the first known role is taken). CPFClaim is the claim with the CPF
+	// of driver tokens.
+	RoleClaim string
+	CPFClaim  string
+}
+
+// NewJWTValidator returns a validator of tokens signed with secret
+// (HS256) or the keys of the JWKS file at jwksPath (RS256 and ES256).
+// Either can be empty, but not both.
+func NewJWTValidator(secret, jwksPath string) (*JWTValidator, error) {
+	if len(secret) == 0 && len(jwksPath) == 0 {
+		return nil, fmt.Errorf("a secret or a JWKS file is required")
+	}
+
+	v := &JWTValidator{
+		secret:    []byte(secret),
+		keys:      make(map[string]crypto.PublicKey),
+		RoleClaim: "role",
+		CPFClaim:  "cpf",
+	}
+	if len(jwksPath) > 0 {
+		b, err := ioutil.ReadFile(jwksPath)
+		if err != nil {
+			return nil, err
+		}
+		if v.keys, err = parseJWKS(b); err != nil {
+			return nil, fmt.Errorf("%s: %v", jwksPath, err)
+		}
+	}
+
+	return v, nil
+}
+
+// jwk is a JSON Web Key (RFC 7517), only the fields of RSA and P-256 keys
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+	// EC
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// parseJWKS returns the RSA and P-256 signature keys of a JWKS, by their
+// "kid". Other keys are ignored.
+func parseJWKS(b []byte) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &set); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for i, key := range set.Keys {
+		if len(key.Use) > 0 && key.Use != "sig" {
+			continue
+		}
+
+		var publicKey crypto.PublicKey
+		switch {
+		case key.Kty == "RSA":
+			n, errN := decodeBigInt(key.N)
+			e, errE := decodeBigInt(key.E)
+			if errN != nil || errE != nil || !e.IsInt64() {
+				return nil, fmt.Errorf("key %d: invalid RSA key", i)
+			}
+			publicKey = &rsa.PublicKey{N: n, E: int(e.Int64())}
+		case key.Kty == "EC" && key.Crv == "P-256":
+			x, errX := decodeBigInt(key.X)
+			y, errY := decodeBigInt(key.Y)
+			if errX != nil || errY != nil || !elliptic.P256().IsOnCurve(x, y) {
+				return nil, fmt.Errorf("key %d: invalid EC key", i)
+			}
+			publicKey = &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+		default:
+			continue
+		}
+		keys[key.Kid] = publicKey
+	}
+
+	return keys, nil
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) == 0 {
+		return nil, fmt.Errorf("invalid value")
+	}
+
+	return new(big.Int).SetBytes(b), nil
+}
+
+// Principal validates token and returns it's client, identified by the
+// token's subject. Driver tokens must have a valid CPF.
+func (v *JWTValidator) Principal(token string, now time.Time) (*Principal, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errInvalidToken
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, errInvalidToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errInvalidToken
+	}
+	if !v.verify(header.Alg, header.Kid, parts[0]+"."+parts[1], signature) {
+		return nil, errInvalidToken
+	}
+
+	var claims map[string]interface{}
+	if err = decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, errInvalidToken
+	}
+	if err = v.validateClaims(claims, now); err != nil {
+		return nil, err
+	}
+
+	// the subject identifies the client, e.g.: as the author of corrections
+	sub, _ := claims["sub"].(string)
+	if len(sub) == 0 {
+		return nil, fmt.Errorf("bearer token has no 'sub' claim")
+	}
+	principal := &Principal{ID: "jwt:" + sub, Name: sub}
+	for _, role := range claimStrings(claims[v.RoleClaim]) {
+		if role := models.Role(role); role == models.RoleTerminal || role == models.RoleDispatcher ||
+			role == models.RoleAdmin || role == models.RoleDriver {
+			principal.Role = role
+			break
+		}
+	}
+	if len(principal.Role) == 0 {
+		return nil, fmt.Errorf("bearer token has no known '%s' claim", v.RoleClaim)
+	}
+
+	if principal.Role == models.RoleDriver {
+		cpf, _ := claims[v.CPFClaim].(string)
+		if principal.CPF, _ = models.NormalizeCPF(cpf); len(principal.CPF) == 0 {
+			return nil, fmt.Errorf("driver bearer token has no valid '%s' claim", v.CPFClaim)
+		}
+	}
+
+	return principal, nil
+}
+
+// verify checks the signature of a token. The key must be of the alg's
+// type, so a public key can't be taken as an HS256 secret.
+func (v *JWTValidator) verify(alg, kid, signed string, signature []byte) bool {
+	hash := sha256.Sum256([]byte(signed))
+
+	switch alg {
+	case "HS256":
+		if len(v.secret) == 0 {
+			return false
+		}
+		mac := hmac.New(sha256.New, v.secret)
+		mac.Write([]byte(signed))
+		return hmac.Equal(signature, mac.Sum(nil))
+	case "RS256":
+		key, ok := v.key(kid, func(k crypto.PublicKey) bool { _, ok := k.(*rsa.PublicKey); return ok })
+		if !ok {
+			return false
+		}
+		return rsa.VerifyPKCS1v15(key.(*rsa.PublicKey), crypto.SHA256, hash[:], signature) == nil
+	case "ES256":
+		key, ok := v.key(kid, func(k crypto.PublicKey) bool { _, ok := k.(*ecdsa.PublicKey); return ok })
+		if !ok || len(signature) != 64 {
+			return false
+		}
+		// the signature is r and s, 32 bytes each (RFC 7518)
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		return ecdsa.Verify(key.(*ecdsa.PublicKey), hash[:], r, s)
+	}
+
+	// including "none"
+	return false
+}
+
+// key returns the key of kid, or the only key of the type when the token
+// has no "kid"
+func (v *JWTValidator) key(kid string, ofType func(k crypto.PublicKey) bool) (crypto.PublicKey, bool) {
+	if len(kid) > 0 {
+		key, ok := v.keys[kid]
+		return key, ok && ofType(key)
+	}
+
+	var found crypto.PublicKey
+	for _, key := range v.keys {
+		if ofType(key) {
+			if found != nil {
+				return nil, false
+			}
+			found = key
+		}
+	}
+
+	return found, found != nil
+}
+
+// validateClaims checks the token's time window, issuer and audience.
+// "exp" is required.
+func (v *JWTValidator) validateClaims(claims map[string]interface{}, now time.Time) error {
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return fmt.Errorf("bearer token has no 'exp' claim")
+	}
+	if now.Add(-clockSkew).After(time.Unix(int64(exp), 0)) {
+		return fmt.Errorf("bearer token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(clockSkew).Before(time.Unix(int64(nbf), 0)) {
+		return errInvalidToken
+	}
+	if len(v.Issuer) > 0 && claims["iss"] != v.Issuer {
+		return errInvalidToken
+	}
+	if len(v.Audience) > 0 && !containsString(claimStrings(claims["aud"]), v.Audience) {
+		return errInvalidToken
+	}
+
+	return nil
+}
+
+// claimStrings returns a claim that can be a string or a list of strings
+func claimStrings(claim interface{}) []string {
+	switch claim := claim.(type) {
+	case string:
+		return []string{claim}
+	case []interface{}:
+		values := make([]string, 0, len(claim))
+		for _, value := range claim {
+			if s, ok := value.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+
+	return nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(b, v)
+}
@@ -0,0 +1,302 @@
+package handlers
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/rafaft/truck-pad/models"
+	"github.com/rafaft/truck-pad/store"
+)
+
+const testJWTSecret = "test-secret"
+
+// testJWTKeys are the private keys of the test JWKS
+type testJWTKeys struct {
+	rsa *rsa.PrivateKey
+	ec  *ecdsa.PrivateKey
+}
+
+func newTestJWTKeys(t *testing.T) *testJWTKeys {
+	t.Helper()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testJWTKeys{rsa: rsaKey, ec: ecKey}
+}
+
+// newTestJWTValidator returns a validator of testJWTSecret, when hs256,
+// and of a JWKS with the public keys of keys, as "rsa" and "ec"
+func newTestJWTValidator(t *testing.T, keys *testJWTKeys, hs256 bool) *JWTValidator {
+	t.Helper()
+
+	encode := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+	jwks, err := json.Marshal(map[string][]jwk{"keys": {
+		{Kty: "RSA", Kid: "rsa", Use: "sig", N: encode(keys.rsa.N.Bytes()), E: encode(big.NewInt(int64(keys.rsa.E)).Bytes())},
+		{Kty: "EC", Kid: "ec", Crv: "P-256", X: encode(keys.ec.X.Bytes()), Y: encode(keys.ec.Y.Bytes())},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "jwks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "jwks.json")
+	if err = ioutil.WriteFile(path, jwks, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	secret := ""
+	if hs256 {
+		secret = testJWTSecret
+	}
+	v, err := NewJWTValidator(secret, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.Issuer = "https://auth.truck-pad.test"
+	v.Audience = "truck-pad"
+
+	return v
+}
+
+// signTestJWT returns a token with claims, signed by sign
+func signTestJWT(t *testing.T, header, claims map[string]interface{}, sign func(signed string) []byte) string {
+	t.Helper()
+
+	h, err := json.Marshal(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sign(signed))
+}
+
+func hs256(secret []byte) func(signed string) []byte {
+	return func(signed string) []byte {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(signed))
+		return mac.Sum(nil)
+	}
+}
+
+func rs256(key *rsa.PrivateKey) func(signed string) []byte {
+	return func(signed string) []byte {
+		hash := sha256.Sum256([]byte(signed))
+		signature, _ := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+		return signature
+	}
+}
+
+func es256(key *ecdsa.PrivateKey) func(signed string) []byte {
+	return func(signed string) []byte {
+		hash := sha256.Sum256([]byte(signed))
+		r, s, _ := ecdsa.Sign(rand.Reader, key, hash[:])
+		// r and s, 32 bytes each
+		signature := make([]byte, 64)
+		rb, sb := r.Bytes(), s.Bytes()
+		copy(signature[32-len(rb):32], rb)
+		copy(signature[64-len(sb):], sb)
+		return signature
+	}
+}
+
+func unsigned(signed string) []byte {
+	return nil
+}
+
+// testClaims returns valid claims for role, changed by changes (nil
+// values are removed)
+func testClaims(now time.Time, role string, changes map[string]interface{}) map[string]interface{} {
+	claims := map[string]interface{}{
+		"sub":  "client-1",
+		"iss":  "https://auth.truck-pad.test",
+		"aud":  []string{"truck-pad", "other"},
+		"exp":  now.Add(time.Hour).Unix(),
+		"iat":  now.Unix(),
+		"nbf":  now.Unix(),
+		"role": role,
+		"cpf":  testCPF,
+	}
+	for name, value := range changes {
+		if value == nil {
+			delete(claims, name)
+		} else {
+			claims[name] = value
+		}
+	}
+
+	return claims
+}
+
+func TestJWTValidator(t *testing.T) {
+	keys := newTestJWTKeys(t)
+	now := time.Now()
+
+	publicKey, err := x509.MarshalPKIXPublicKey(&keys.rsa.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hsHeader := map[string]interface{}{"alg": "HS256", "typ": "JWT"}
+	rsHeader := map[string]interface{}{"alg": "RS256", "kid": "rsa"}
+	esHeader := map[string]interface{}{"alg": "ES256", "kid": "ec"}
+
+	tests := []struct {
+		name   string
+		hs256  bool
+		header map[string]interface{}
+		claims map[string]interface{}
+		sign   func(signed string) []byte
+		role   models.Role
+		valid  bool
+	}{
+		{"HS256", true, hsHeader, nil, hs256([]byte(testJWTSecret)), models.RoleDispatcher, true},
+		{"RS256", true, rsHeader, nil, rs256(keys.rsa), models.RoleDispatcher, true},
+		{"ES256", true, esHeader, nil, es256(keys.ec), models.RoleDispatcher, true},
+		{"RS256 without kid", false, map[string]interface{}{"alg": "RS256"}, nil, rs256(keys.rsa), models.RoleDispatcher, true},
+		{"driver", true, hsHeader, nil, hs256([]byte(testJWTSecret)), models.RoleDriver, true},
+		{"role list", true, hsHeader, map[string]interface{}{"role": []string{"unknown", "terminal"}}, hs256([]byte(testJWTSecret)), "", true},
+
+		{"alg none", true, map[string]interface{}{"alg": "none"}, nil, unsigned, models.RoleAdmin, false},
+		{"alg None", true, map[string]interface{}{"alg": "None"}, nil, unsigned, models.RoleAdmin, false},
+		{"wrong secret", true, hsHeader, nil, hs256([]byte("other-secret")), models.RoleDispatcher, false},
+		{"HS256 without a secret", false, hsHeader, nil, hs256([]byte(testJWTSecret)), models.RoleDispatcher, false},
+		// the RSA public key taken as an HS256 secret
+		{"HS256 with the RSA key", false, map[string]interface{}{"alg": "HS256", "kid": "rsa"}, nil, hs256(publicKey), models.RoleAdmin, false},
+		{"HS256 with the RSA modulus", false, hsHeader, nil, hs256(keys.rsa.N.Bytes()), models.RoleAdmin, false},
+		// the algorithm doesn't match the key of kid
+		{"RS256 with the EC key", true, map[string]interface{}{"alg": "RS256", "kid": "ec"}, nil, rs256(keys.rsa), models.RoleDispatcher, false},
+		{"ES256 with the RSA key", true, map[string]interface{}{"alg": "ES256", "kid": "rsa"}, nil, es256(keys.ec), models.RoleDispatcher, false},
+		{"RS256 signed as ES256", true, rsHeader, nil, es256(keys.ec), models.RoleDispatcher, false},
+		{"unknown kid", true, map[string]interface{}{"alg": "RS256", "kid": "other"}, nil, rs256(keys.rsa), models.RoleDispatcher, false},
+
+		{"expired", true, hsHeader, map[string]interface{}{"exp": now.Add(-2 * time.Minute).Unix()}, hs256([]byte(testJWTSecret)), models.RoleDispatcher, false},
+		{"expired within the skew", true, hsHeader, map[string]interface{}{"exp": now.Add(-30 * time.Second).Unix()}, hs256([]byte(testJWTSecret)), models.RoleDispatcher, true},
+		{"without exp", true, hsHeader, map[string]interface{}{"exp": nil}, hs256([]byte(testJWTSecret)), models.RoleDispatcher, false},
+		{"not before", true, hsHeader, map[string]interface{}{"nbf": now.Add(10 * time.Minute).Unix()}, hs256([]byte(testJWTSecret)), models.RoleDispatcher, false},
+		{"not before within the skew", true, hsHeader, map[string]interface{}{"nbf": now.Add(30 * time.Second).Unix()}, hs256([]byte(testJWTSecret)), models.RoleDispatcher, true},
+		{"wrong iss", true, hsHeader, map[string]interface{}{"iss": "https://evil.test"}, hs256([]byte(testJWTSecret)), models.RoleDispatcher, false},
+		{"without iss", true, hsHeader, map[string]interface{}{"iss": nil}, hs256([]byte(testJWTSecret)), models.RoleDispatcher, false},
+		{"wrong aud", true, hsHeader, map[string]interface{}{"aud": "other"}, hs256([]byte(testJWTSecret)), models.RoleDispatcher, false},
+		{"without aud", true, hsHeader, map[string]interface{}{"aud": nil}, hs256([]byte(testJWTSecret)), models.RoleDispatcher, false},
+
+		{"unknown role", true, hsHeader, map[string]interface{}{"role": "root"}, hs256([]byte(testJWTSecret)), "", false},
+		{"missing sub", true, hsHeader, map[string]interface{}{"sub": nil}, hs256([]byte(testJWTSecret)), models.RoleDispatcher, false},
+		{"empty sub", true, hsHeader, map[string]interface{}{"sub": ""}, hs256([]byte(testJWTSecret)), models.RoleDispatcher, false},
+		{"driver without cpf", true, hsHeader, map[string]interface{}{"cpf": nil}, hs256([]byte(testJWTSecret)), models.RoleDriver, false},
+		{"driver with an invalid cpf", true, hsHeader, map[string]interface{}{"cpf": "52998224700"}, hs256([]byte(testJWTSecret)), models.RoleDriver, false},
+	}
+	for _, test := range tests {
+		v := newTestJWTValidator(t, keys, test.hs256)
+		claims := testClaims(now, string(test.role), test.claims)
+		principal, err := v.Principal(signTestJWT(t, test.header, claims, test.sign), now)
+
+		if !test.valid {
+			if err == nil {
+				t.Errorf("%s: got principal %+v, want an error", test.name, principal)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if principal.ID != "jwt:client-1" {
+			t.Errorf("%s: got principal %s", test.name, principal.ID)
+		}
+		if len(test.role) > 0 && principal.Role != test.role {
+			t.Errorf("%s: got role %s, want %s", test.name, principal.Role, test.role)
+		}
+		if principal.Role == models.RoleDriver && principal.CPF != testCPF {
+			t.Errorf("%s: got cpf %s, want %s", test.name, principal.CPF, testCPF)
+		}
+	}
+}
+
+func TestJWTValidatorMalformed(t *testing.T) {
+	v := newTestJWTValidator(t, newTestJWTKeys(t), true)
+	valid := signTestJWT(t, map[string]interface{}{"alg": "HS256"}, testClaims(time.Now(), "admin", nil), hs256([]byte(testJWTSecret)))
+
+	for _, token := range []string{"", "a.b", "a.b.c.d", "!.!.!", valid + "x", valid[1:]} {
+		if _, err := v.Principal(token, time.Now()); err == nil {
+			t.Errorf("%q: got a principal, want an error", token)
+		}
+	}
+}
+
+func TestAuthorizeDriverCPF(t *testing.T) {
+	defer func(v *JWTValidator) { BearerTokens = v }(BearerTokens)
+	BearerTokens = newTestJWTValidator(t, newTestJWTKeys(t), true)
+
+	router := mux.NewRouter()
+	router.Use(Authenticate(store.NewMemoryStore()))
+	drivers := []models.Role{models.RoleDriver, models.RoleDispatcher}
+	router.HandleFunc("/drivers/{cpf}", Authorize(drivers, okHandler)).Methods("GET")
+	router.HandleFunc("/drivers/{cpf}/trips", Authorize(drivers, okHandler)).Methods("GET")
+	router.HandleFunc("/trips", Authorize(drivers, okHandler)).Methods("GET")
+	router.HandleFunc("/drivers", Authorize(testReaders, okHandler)).Methods("GET")
+
+	now := time.Now()
+	token := func(role string) string {
+		return "Bearer " + signTestJWT(t, map[string]interface{}{"alg": "HS256"}, testClaims(now, role, nil), hs256([]byte(testJWTSecret)))
+	}
+
+	tests := []struct {
+		role   string
+		path   string
+		status int
+	}{
+		{"driver", "/drivers/" + testCPF, http.StatusOK},
+		{"driver", "/drivers/" + testCPF + "/trips", http.StatusOK},
+		{"driver", "/drivers/" + otherTestCPF, http.StatusForbidden},
+		{"driver", "/drivers/" + otherTestCPF + "/trips", http.StatusForbidden},
+		// the CPF isn't normalized on the path
+		{"driver", "/drivers/529.982.247-25", http.StatusForbidden},
+		// routes without a Driver aren't scoped to one
+		{"driver", "/trips", http.StatusForbidden},
+		{"driver", "/drivers", http.StatusForbidden},
+		{"dispatcher", "/drivers/" + otherTestCPF, http.StatusOK},
+		{"dispatcher", "/trips", http.StatusOK},
+		{"admin", "/drivers/" + otherTestCPF + "/trips", http.StatusOK},
+	}
+	for _, test := range tests {
+		w := serveWithHeader(router, "GET", test.path, "Authorization", token(test.role))
+		if w.Code != test.status {
+			t.Errorf("%s %s: got %d, want %d", test.role, test.path, w.Code, test.status)
+		}
+	}
+
+	w := serveWithHeader(router, "GET", "/drivers/"+testCPF, "Authorization", "Bearer invalid")
+	expectStatus(t, w, http.StatusUnauthorized)
+}
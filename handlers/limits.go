@@ -0,0 +1,316 @@
+package handlers
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// TrustProxy makes the client's IP the one told by the proxy in front of
+// the API, instead of the connection's: App Engine's "X-AppEngine-User-IP"
+// header, or else the last address of the "X-Forwarded-For" header, the
+// one the proxy appended. The addresses before it are sent by the client,
+// who could change them to get a new rate limit on each request.
+var TrustProxy = false
+
+// RouteLimits are the limits of a class of routes. Each client has a
+// token bucket of Burst requests, refilled at Rate requests per second,
+// and request bodies are limited to MaxBody bytes (0 for routes without a
+// body).
+type RouteLimits struct {
+	Rate    float64
+	Burst   int
+	MaxBody int64
+}
+
+// DefaultRouteLimits are the limits of each class of routes: "read" for
+// GETs, "write" for requests with a single resource and "batch" for
+// uploads of many of them. "auth" limits the requests that fail
+// authentication of each IP, whatever the route (see LimitAuthFailures).
+var DefaultRouteLimits = map[string]RouteLimits{
+	"read":  {Rate: 20, Burst: 40},
+	"write": {Rate: 5, Burst: 20, MaxBody: 1 << 20},
+	"batch": {Rate: 10.0 / 60, Burst: 10, MaxBody: 8 << 20},
+	"auth":  {Rate: 10.0 / 60, Burst: 20},
+}
+
+// ParseRateLimits overrides the rates of limits with a comma separated
+// list of "<class>=<requests>/<s|m|h>[:<burst>]", e.g.: "batch=10/h:2".
+// The burst defaults to the number of requests.
+func ParseRateLimits(s string, limits map[string]RouteLimits) error {
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if len(entry) == 0 {
+			continue
+		}
+
+		invalid := fmt.Errorf("invalid rate limit '%s', must be <class>=<requests>/<s|m|h>[:<burst>]", entry)
+		nameRate := strings.SplitN(entry, "=", 2)
+		if len(nameRate) != 2 {
+			return invalid
+		}
+		limit, exist := limits[nameRate[0]]
+		if !exist {
+			return fmt.Errorf("unknown class of routes '%s'", nameRate[0])
+		}
+
+		rateBurst := strings.SplitN(nameRate[1], ":", 2)
+		countUnit := strings.SplitN(rateBurst[0], "/", 2)
+		if len(countUnit) != 2 {
+			return invalid
+		}
+		count, err := strconv.Atoi(countUnit[0])
+		if err != nil || count <= 0 {
+			return invalid
+		}
+		per := map[string]time.Duration{"s": time.Second, "m": time.Minute, "h": time.Hour}[countUnit[1]]
+		if per == 0 {
+			return invalid
+		}
+
+		limit.Rate = float64(count) / per.Seconds()
+		limit.Burst = count
+		if len(rateBurst) == 2 {
+			if limit.Burst, err = strconv.Atoi(rateBurst[1]); err != nil || limit.Burst <= 0 {
+				return invalid
+			}
+		}
+		limits[nameRate[0]] = limit
+	}
+
+	return nil
+}
+
+// bucketIdleSweep is how often buckets that are full again are dropped,
+// since they're the same as new ones
+const bucketIdleSweep = time.Minute
+
+// RateLimiter keeps a token bucket per client and class of routes. It's
+// in memory, so limits are per instance.
+type RateLimiter struct {
+	limits    map[string]RouteLimits
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func NewRateLimiter(limits map[string]RouteLimits) *RateLimiter {
+	return &RateLimiter{
+		limits:    limits,
+		buckets:   make(map[string]*tokenBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// tokenBucket has up to burst tokens, refilled at rate per second. Each
+// request takes one.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	rate   float64
+	burst  float64
+}
+
+// refill adds the tokens since the last request
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// take takes a token, or returns how long until there's one
+func (b *tokenBucket) take(now time.Time) (bool, time.Duration) {
+	b.refill(now)
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+
+	return false, time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// Limit applies the limits of class to next: clients that ran out of
+// requests get a 429 with a "Retry-After" header, and bodies larger than
+// the class' MaxBody get a 413 (see writeBodyError). Clients are told
+// apart by their API key or token, or their IP when not authenticated.
+func (l *RateLimiter) Limit(class string, next func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	limits, exist := l.limits[class]
+	if !exist {
+		panic(fmt.Sprintf("unknown class of routes '%s'", class))
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		ok, retryAfter := l.take(class+" "+clientKey(r), limits, time.Now())
+		if !ok {
+			writeTooManyRequests(w, r, retryAfter)
+			return
+		}
+
+		if limits.MaxBody > 0 {
+			r.Body = &limitedBody{ReadCloser: http.MaxBytesReader(w, r.Body, limits.MaxBody), max: limits.MaxBody}
+		}
+
+		next(w, r)
+	}
+}
+
+// LimitAuthFailures limits the requests of each IP that fail
+// authentication (401), with the "auth" limits. It goes before
+// Authenticate, so an IP out of requests can't even try another API key
+// or token, and every attempt costs a request, which is given back when it
+// doesn't fail.
+func (l *RateLimiter) LimitAuthFailures() mux.MiddlewareFunc {
+	limits, exist := l.limits["auth"]
+	if !exist {
+		panic("unknown class of routes 'auth'")
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := "auth " + clientIP(r)
+			ok, retryAfter := l.take(key, limits, time.Now())
+			if !ok {
+				writeTooManyRequests(w, r, retryAfter)
+				return
+			}
+
+			recorder := &statusRecorder{ResponseWriter: w, statusCode: http.StatusOK}
+			next.ServeHTTP(recorder, r)
+			if recorder.statusCode != http.StatusUnauthorized {
+				l.giveBack(key)
+			}
+		})
+	}
+}
+
+func (l *RateLimiter) take(key string, limits RouteLimits, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) > bucketIdleSweep {
+		for k, bucket := range l.buckets {
+			if bucket.refill(now); bucket.tokens >= bucket.burst {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	bucket, exist := l.buckets[key]
+	if !exist {
+		bucket = &tokenBucket{
+			tokens: float64(limits.Burst),
+			last:   now,
+			rate:   limits.Rate,
+			burst:  float64(limits.Burst),
+		}
+		l.buckets[key] = bucket
+	}
+
+	return bucket.take(now)
+}
+
+// giveBack returns a request taken from the bucket of key
+func (l *RateLimiter) giveBack(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if bucket, exist := l.buckets[key]; exist {
+		bucket.tokens = math.Min(bucket.burst, bucket.tokens+1)
+	}
+}
+
+// writeTooManyRequests writes a 429, telling the client when to retry
+func writeTooManyRequests(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	writeError(w, r, http.StatusTooManyRequests, fmt.Errorf("too many requests, retry in %d seconds", seconds))
+}
+
+// clientKey identifies the client of a request, for rate limiting
+func clientKey(r *http.Request) string {
+	if principal := principalFrom(r); principal != nil {
+		return principal.ID
+	}
+
+	return clientIP(r)
+}
+
+// clientIP identifies the IP of a request's client, for rate limiting
+func clientIP(r *http.Request) string {
+	if TrustProxy {
+		if ip := strings.TrimSpace(r.Header.Get("X-AppEngine-User-IP")); len(ip) > 0 {
+			return "ip:" + ip
+		}
+		if forwarded := r.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+			hops := strings.Split(forwarded[len(forwarded)-1], ",")
+			if ip := strings.TrimSpace(hops[len(hops)-1]); len(ip) > 0 {
+				return "ip:" + ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	return "ip:" + host
+}
+
+// statusRecorder writes a response while keeping it's status code
+type statusRecorder struct {
+	http.ResponseWriter
+	statusCode int
+}
+
+func (r *statusRecorder) WriteHeader(statusCode int) {
+	r.statusCode = statusCode
+	r.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Flush passes flushes of streamed responses through
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// limitedBody is a request body limited by http.MaxBytesReader, which
+// tells whether it was larger than the limit
+type limitedBody struct {
+	io.ReadCloser
+	max      int64
+	read     int64
+	exceeded bool
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	// MaxBytesReader fails once the limit is read
+	if err != nil && err != io.EOF && b.read >= b.max {
+		b.exceeded = true
+	}
+
+	return n, err
+}
+
+// writeBodyError writes the error of reading a request's body: a 413 if
+// the body is larger than it's route's limit, otherwise a 400
+func writeBodyError(w http.ResponseWriter, r *http.Request, err error) {
+	if body, ok := r.Body.(*limitedBody); ok && body.exceeded {
+		writeError(w, r, http.StatusRequestEntityTooLarge, fmt.Errorf(
+			"the request body is larger than %d bytes", body.max,
+		))
+		return
+	}
+
+	writeError(w, r, http.StatusBadRequest, err)
+}
@@ -0,0 +1,194 @@
+package handlers
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/rafaft/truck-pad/models"
+	"github.com/rafaft/truck-pad/store"
+)
+
+func TestClientIP(t *testing.T) {
+	defer func(trust bool) { TrustProxy = trust }(TrustProxy)
+
+	tests := []struct {
+		trustProxy bool
+		headers    map[string][]string
+		ip         string
+	}{
+		{false, nil, "ip:192.0.2.1"},
+		{false, map[string][]string{"X-Forwarded-For": {"198.51.100.7"}}, "ip:192.0.2.1"},
+		{true, nil, "ip:192.0.2.1"},
+		{true, map[string][]string{"X-Forwarded-For": {"198.51.100.7"}}, "ip:198.51.100.7"},
+		// the proxy appends the client's address to what the client sent
+		{true, map[string][]string{"X-Forwarded-For": {"10.0.0.1, 198.51.100.7"}}, "ip:198.51.100.7"},
+		{true, map[string][]string{"X-Forwarded-For": {"10.0.0.1", "198.51.100.7"}}, "ip:198.51.100.7"},
+		{true, map[string][]string{"X-Forwarded-For": {"10.0.0.1, 198.51.100.7"}, "X-Appengine-User-Ip": {"203.0.113.9"}}, "ip:203.0.113.9"},
+	}
+	for _, test := range tests {
+		TrustProxy = test.trustProxy
+		r := httptest.NewRequest("GET", "/trips", nil)
+		for name, values := range test.headers {
+			r.Header[name] = values
+		}
+		if ip := clientIP(r); ip != test.ip {
+			t.Errorf("trust=%t %v: got %s, want %s", test.trustProxy, test.headers, ip, test.ip)
+		}
+	}
+}
+
+func TestLimitSpoofedForwardedFor(t *testing.T) {
+	defer func(trust bool) { TrustProxy = trust }(TrustProxy)
+	TrustProxy = true
+
+	limiter := NewRateLimiter(map[string]RouteLimits{"read": {Rate: 1.0 / 60, Burst: 2}})
+	handler := http.HandlerFunc(limiter.Limit("read", okHandler))
+
+	// a new first address on each request is still the same client
+	statuses := []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests}
+	for i, spoofed := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		w := serveWithHeader(handler, "GET", "/trips", "X-Forwarded-For", spoofed+", 198.51.100.7")
+		expectStatus(t, w, statuses[i])
+	}
+
+	// while another client has it's own bucket
+	expectStatus(t, serveWithHeader(handler, "GET", "/trips", "X-Forwarded-For", "198.51.100.8"), http.StatusOK)
+}
+
+func TestLimitAuthFailuresSpoofedForwardedFor(t *testing.T) {
+	defer func(trust bool) { TrustProxy = trust }(TrustProxy)
+	TrustProxy = true
+
+	limiter := NewRateLimiter(map[string]RouteLimits{"auth": {Rate: 1.0 / 60, Burst: 2}})
+	router := mux.NewRouter()
+	router.Use(limiter.LimitAuthFailures(), Authenticate(store.NewMemoryStore()))
+	router.HandleFunc("/trips", Authorize(testReaders, okHandler))
+
+	// guessing keys from a new first address each time
+	statuses := []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusTooManyRequests}
+	for i, spoofed := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		r := httptest.NewRequest("GET", "/trips", nil)
+		r.Header.Set("X-API-Key", "tpk_guess")
+		r.Header.Set("X-Forwarded-For", spoofed+", 198.51.100.7")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		expectStatus(t, w, statuses[i])
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Date(2020, 2, 14, 15, 0, 0, 0, time.UTC)
+	bucket := &tokenBucket{tokens: 2, last: now, rate: 0.5, burst: 2}
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := bucket.take(now); !ok {
+			t.Fatalf("request %d: got no token, want one of the burst", i)
+		}
+	}
+	ok, retryAfter := bucket.take(now)
+	if ok || retryAfter != 2*time.Second {
+		t.Errorf("got %t, retry after %s, want false, retry after 2s", ok, retryAfter)
+	}
+
+	// a token every 2s, up to the burst
+	if ok, _ = bucket.take(now.Add(time.Second)); ok {
+		t.Errorf("got a token after 1s, want none")
+	}
+	if ok, _ = bucket.take(now.Add(2 * time.Second)); !ok {
+		t.Errorf("got no token after 2s, want one")
+	}
+	bucket.refill(now.Add(time.Hour))
+	if bucket.tokens != 2 {
+		t.Errorf("got %f tokens after an hour, want the burst of 2", bucket.tokens)
+	}
+}
+
+func TestLimitTooManyRequests(t *testing.T) {
+	limiter := NewRateLimiter(map[string]RouteLimits{"write": {Rate: 1.0 / 30, Burst: 1}})
+	handler := http.HandlerFunc(limiter.Limit("write", okHandler))
+
+	expectStatus(t, serve(handler, "POST", "/trips", ""), http.StatusOK)
+
+	w := serve(handler, "POST", "/trips", "")
+	expectStatus(t, w, http.StatusTooManyRequests)
+	if retryAfter, err := strconv.Atoi(w.Header().Get("Retry-After")); err != nil || retryAfter < 29 || retryAfter > 30 {
+		t.Errorf("got Retry-After %q, want 30 seconds", w.Header().Get("Retry-After"))
+	}
+
+	var problem models.Problem
+	decodeBody(t, w, &problem)
+	if problem.Status != http.StatusTooManyRequests {
+		t.Errorf("got problem status %d, want 429", problem.Status)
+	}
+
+	// clients are told apart by their API key
+	r := httptest.NewRequest("POST", "/trips", nil)
+	r = r.WithContext(context.WithValue(r.Context(), principalKey{}, &Principal{ID: "other", Role: models.RoleTerminal}))
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	expectStatus(t, w, http.StatusOK)
+}
+
+func TestLimitBody(t *testing.T) {
+	limiter := NewRateLimiter(map[string]RouteLimits{"write": {Rate: 100, Burst: 100, MaxBody: 16}})
+	handler := http.HandlerFunc(limiter.Limit("write", func(w http.ResponseWriter, r *http.Request) {
+		if _, err := ioutil.ReadAll(r.Body); err != nil {
+			writeBodyError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	expectStatus(t, serve(handler, "POST", "/trips", strings.Repeat("a", 16)), http.StatusOK)
+
+	w := serve(handler, "POST", "/trips", strings.Repeat("a", 17))
+	expectStatus(t, w, http.StatusRequestEntityTooLarge)
+
+	var problem models.Problem
+	decodeBody(t, w, &problem)
+	if !strings.Contains(problem.Detail, "16 bytes") {
+		t.Errorf("got detail %q, want the limit", problem.Detail)
+	}
+}
+
+func TestParseRateLimits(t *testing.T) {
+	tests := []struct {
+		s     string
+		write RouteLimits
+		err   bool
+	}{
+		{"", RouteLimits{Rate: 5, Burst: 20, MaxBody: 1 << 20}, false},
+		{"write=2/s", RouteLimits{Rate: 2, Burst: 2, MaxBody: 1 << 20}, false},
+		{"read=1/s, write=120/m:10", RouteLimits{Rate: 2, Burst: 10, MaxBody: 1 << 20}, false},
+		{"write=36/h", RouteLimits{Rate: 0.01, Burst: 36, MaxBody: 1 << 20}, false},
+		{"other=1/s", RouteLimits{}, true},
+		{"write=1/d", RouteLimits{}, true},
+		{"write=0/s", RouteLimits{}, true},
+		{"write=1/s:0", RouteLimits{}, true},
+		{"write", RouteLimits{}, true},
+	}
+	for _, test := range tests {
+		limits := map[string]RouteLimits{
+			"read":  DefaultRouteLimits["read"],
+			"write": DefaultRouteLimits["write"],
+		}
+		err := ParseRateLimits(test.s, limits)
+		if test.err {
+			if err == nil {
+				t.Errorf("%q: got %+v, want an error", test.s, limits["write"])
+			}
+			continue
+		}
+		if err != nil || limits["write"] != test.write {
+			t.Errorf("%q: got %+v, %v, want %+v", test.s, limits["write"], err, test.write)
+		}
+	}
+}
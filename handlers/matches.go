@@ -0,0 +1,271 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rafaft/truck-pad/geo"
+	"github.com/rafaft/truck-pad/models"
+	"github.com/rafaft/truck-pad/store"
+)
+
+// weights of each part of a Match's score
+const (
+	distanceWeight = 0.5
+	returnWeight   = 0.3
+	idleWeight     = 0.2
+)
+
+// idle time after which a Driver gets the whole idle part of the score
+const maxIdleHours = 48.0
+
+// maxMatchCandidates is the number of Trips (the most recent ones) that
+// are considered for a freight, since each costs two more store queries
+const maxMatchCandidates = 100
+
+// GetMatches finds Drivers for a freight: Drivers whose latest Trip (as in
+// GetLatestTrip) arrived without load, within the time window, near the
+// freight's origin, with a vehicle of the required type and a CNH that
+// allows driving it. They're ranked by distance to the freight's origin,
+// how close their latest Trip's origin is to the freight's destination
+// (it's a return load for them) and how long they've been idle.
+func GetMatches(drivers store.DriverStore, trips store.TripStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		query := newQueryParser(r, []string{
+			"origin", "destination", "vehicle_type", "radius_km", "from", "to", "limit",
+		}, timeZoneParams)
+
+		// the time window defaults to the last 7 days
+		now := query.now
+		from := now.AddDate(0, 0, -7)
+		if t := query.parseTime("from"); t != nil {
+			from = *t
+		}
+		to := now
+		if t := query.parseTime("to"); t != nil {
+			to = *t
+		}
+
+		// there's nothing to match without the freight, so it's required
+		// even on lenient requests
+		origin, ok := parseCoordinates(r.Form.Get("origin"), 2)
+		if !ok {
+			query.reject("origin", models.RuleFormat, "'origin' must be the freight's origin as <lat>,<lng>")
+		}
+		destination, ok := parseCoordinates(r.Form.Get("destination"), 2)
+		if !ok {
+			query.reject("destination", models.RuleFormat, "'destination' must be the freight's destination as <lat>,<lng>")
+		}
+
+		vehicleTypes := make([]models.VehicleType, 0)
+		if strVehicleTypes := r.Form.Get("vehicle_type"); len(strVehicleTypes) > 0 {
+			for _, strVehicleType := range strings.Split(strVehicleTypes, ",") {
+				var vehicleType models.VehicleType
+				if err := json.Unmarshal([]byte(strVehicleType), &vehicleType); err != nil {
+					query.invalid("vehicle_type", models.RuleEnum, fmt.Sprintf(
+						"invalid vehicle_type=%s, must be 1, 2, 3, 4 or 5", strVehicleType),
+					)
+					continue
+				}
+				vehicleTypes = append(vehicleTypes, vehicleType)
+			}
+		}
+
+		radiusKm := 100.0
+		if strRadius := r.Form.Get("radius_km"); len(strRadius) > 0 {
+			radius, err := strconv.ParseFloat(strRadius, 64)
+			if err == nil && radius > 0 {
+				radiusKm = radius
+			} else {
+				query.invalid("radius_km", models.RuleRange, "'radius_km' must be a positive number")
+			}
+		}
+
+		limit := 10
+		if strLimit := r.Form.Get("limit"); len(strLimit) > 0 {
+			n, err := strconv.Atoi(strLimit)
+			if err == nil && n > 0 {
+				limit = n
+			} else {
+				query.invalid("limit", models.RuleRange, "'limit' must be a positive integer")
+			}
+		}
+
+		if err := query.Err(); err != nil {
+			writeError(w, r, http.StatusBadRequest, err)
+			return
+		}
+		query.setPreferenceApplied(w)
+
+		// candidates are Trips without load that arrived near the freight's
+		// origin, but only the latest Trip of each Driver matters (the
+		// first one, since they're the most recent first)
+		hasLoad := false
+		candidates, _, err := trips.GetTrips(r.Context(), store.TripFilter{
+			HasLoad:     &hasLoad,
+			From:        &from,
+			To:          &to,
+			Destination: geo.NewCircle(origin[0], origin[1], radiusKm),
+			Limit:       maxMatchCandidates,
+		})
+		if err != nil {
+			fmt.Println(err)
+			writeError(w, r, http.StatusInternalServerError, fmt.Errorf("internal server error"))
+			return
+		}
+
+		freightDistanceKm := geo.DistanceKm(origin[0], origin[1], destination[0], destination[1])
+		seen := make(map[models.DriverID]bool)
+		matches := make([]*models.Match, 0)
+		for _, candidate := range candidates {
+			if seen[*candidate.DriverID] {
+				continue
+			}
+			seen[*candidate.DriverID] = true
+
+			match, err := createMatch(r, drivers, trips, candidate, vehicleTypes)
+			if err != nil {
+				fmt.Println(err)
+				writeError(w, r, http.StatusInternalServerError, fmt.Errorf("internal server error"))
+				return
+			}
+			if match == nil {
+				continue
+			}
+
+			trip := match.LatestTrip
+			match.DistanceKm = geo.DistanceKm(trip.Destination.Latitude, trip.Destination.Longitude, origin[0], origin[1])
+			match.ReturnDistanceKm = geo.DistanceKm(destination[0], destination[1], trip.Origin.Latitude, trip.Origin.Longitude)
+			match.IdleHours = math.Max(now.Sub(*trip.Time).Hours(), 0)
+			match.Score = scoreMatch(match, radiusKm, freightDistanceKm)
+			matches = append(matches, match)
+		}
+
+		sort.SliceStable(matches, func(i, j int) bool {
+			return matches[i].Score > matches[j].Score
+		})
+		if len(matches) > limit {
+			matches = matches[:limit]
+		}
+
+		for _, match := range matches {
+			query.renderTimes([]*models.Trip{match.LatestTrip})
+		}
+
+		b, err := json.Marshal(matches)
+		if err != nil {
+			fmt.Println(err)
+			writeError(w, r, http.StatusInternalServerError, fmt.Errorf("internal server error"))
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write(b)
+	}
+}
+
+// createMatch returns a Match if candidate is still it's Driver's latest
+// Trip and the Driver may take the freight, otherwise nil
+func createMatch(r *http.Request, drivers store.DriverStore, trips store.TripStore,
+	candidate *models.Trip, vehicleTypes []models.VehicleType) (*models.Match, error) {
+	latest, _, err := trips.GetTrips(r.Context(), store.TripFilter{
+		DriverID: string(*candidate.DriverID),
+		Limit:    1,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(latest) == 0 || latest[0].ID != candidate.ID {
+		return nil, nil
+	}
+
+	// Trips of unregistered (or erased) Drivers have no CNH to check
+	result, _, err := drivers.GetDrivers(r.Context(), store.DriverFilter{
+		CPF: string(*candidate.DriverID),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(result) == 0 {
+		return nil, nil
+	}
+	driver := result[0]
+
+	if !canTakeFreight(driver, *candidate.VehicleType, vehicleTypes) {
+		return nil, nil
+	}
+
+	driver.Age = calculateAge(*driver.BirthDate, time.Now())
+
+	return &models.Match{
+		Driver:     driver,
+		LatestTrip: candidate,
+	}, nil
+}
+
+// canTakeFreight reports whether the Driver, who arrived with a vehicle of
+// type arrival, may take a freight that goes on any of vehicleTypes (any
+// vehicle, if empty). A Driver who owns the vehicle will take the freight
+// with it, so it must be one of vehicleTypes, otherwise the Driver may take
+// any of them. Either way, the Driver's CNH must allow driving it.
+func canTakeFreight(driver *models.Driver, arrival models.VehicleType, vehicleTypes []models.VehicleType) bool {
+	required := vehicleTypes
+	if *driver.HasVehicle {
+		if !containsVehicleType(vehicleTypes, arrival) {
+			return false
+		}
+		required = []models.VehicleType{arrival}
+	} else if len(required) == 0 {
+		required = []models.VehicleType{arrival}
+	}
+
+	for _, vehicleType := range required {
+		if driver.CNHType.CanDrive(vehicleType) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// scoreMatch weights how close the Driver is to the freight's origin, how
+// close the freight takes the Driver back to the origin of their latest
+// Trip and for how long the Driver has been idle, from 0 to 1
+func scoreMatch(match *models.Match, radiusKm, freightDistanceKm float64) float64 {
+	distanceScore := math.Max(1-match.DistanceKm/radiusKm, 0)
+
+	returnScore := 1.0
+	if freightDistanceKm > 0 {
+		returnScore = math.Max(1-match.ReturnDistanceKm/freightDistanceKm, 0)
+	} else if match.ReturnDistanceKm > 0 {
+		returnScore = 0
+	}
+
+	idleScore := math.Min(match.IdleHours/maxIdleHours, 1)
+
+	return distanceWeight*distanceScore + returnWeight*returnScore + idleWeight*idleScore
+}
+
+// containsVehicleType reports whether vt is one of vehicleTypes, or
+// vehicleTypes is empty (any vehicle)
+func containsVehicleType(vehicleTypes []models.VehicleType, vt models.VehicleType) bool {
+	if len(vehicleTypes) == 0 {
+		return true
+	}
+
+	for _, vehicleType := range vehicleTypes {
+		if vehicleType == vt {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rafaft/truck-pad/models"
+	"github.com/rafaft/truck-pad/store"
+)
+
+func TestScoreMatch(t *testing.T) {
+	tests := []struct {
+		name              string
+		match             models.Match
+		radiusKm          float64
+		freightDistanceKm float64
+		score             float64
+	}{
+		{"best", models.Match{DistanceKm: 0, ReturnDistanceKm: 0, IdleHours: 48}, 100, 400, 1},
+		{"worst", models.Match{DistanceKm: 100, ReturnDistanceKm: 400, IdleHours: 0}, 100, 400, 0},
+		{"beyond the radius", models.Match{DistanceKm: 150, ReturnDistanceKm: 800, IdleHours: 0}, 100, 400, 0},
+		{"idle up to 48h", models.Match{DistanceKm: 100, ReturnDistanceKm: 400, IdleHours: 96}, 100, 400, 0.2},
+		{"halfway", models.Match{DistanceKm: 50, ReturnDistanceKm: 200, IdleHours: 24}, 100, 400, 0.5},
+		{"freight to the same place", models.Match{DistanceKm: 100, ReturnDistanceKm: 0}, 100, 0, 0.3},
+		{"freight to the same place, away from home", models.Match{DistanceKm: 100, ReturnDistanceKm: 1}, 100, 0, 0},
+	}
+	for _, test := range tests {
+		if score := scoreMatch(&test.match, test.radiusKm, test.freightDistanceKm); math.Abs(score-test.score) > 1e-9 {
+			t.Errorf("%s: got %f, want %f", test.name, score, test.score)
+		}
+	}
+}
+
+func TestCanTakeFreight(t *testing.T) {
+	carretas := []models.VehicleType{models.SimpleTrailer, models.ExtendedTrailer}
+	tests := []struct {
+		hasVehicle   bool
+		cnhType      models.CNHType
+		arrival      models.VehicleType
+		vehicleTypes []models.VehicleType
+		ok           bool
+	}{
+		{true, "E", models.SimpleTrailer, carretas, true},
+		{true, "E", models.Truck, carretas, false},
+		{true, "C", models.SimpleTrailer, carretas, false},
+		{true, "C", models.Truck, nil, true},
+		{true, "B", models.Truck, nil, false},
+		{false, "E", models.Truck34, carretas, true},
+		{false, "D", models.Truck34, carretas, false},
+		{false, "C", models.Truck34, nil, true},
+		{false, "A", models.Truck34, nil, false},
+	}
+	for _, test := range tests {
+		driver := &models.Driver{HasVehicle: &test.hasVehicle, CNHType: &test.cnhType}
+		if ok := canTakeFreight(driver, test.arrival, test.vehicleTypes); ok != test.ok {
+			t.Errorf("has_vehicle=%t cnh=%s arrival=%d %v: got %t, want %t",
+				test.hasVehicle, test.cnhType, test.arrival, test.vehicleTypes, ok, test.ok)
+		}
+	}
+}
+
+func TestGetMatchesCNH(t *testing.T) {
+	db := store.NewMemoryStore()
+	router := newTestRouter(db)
+	matches := http.HandlerFunc(GetMatches(db, db))
+	arrival := time.Now().Add(-2 * time.Hour).UTC().Format(time.RFC3339)
+
+	drivers := []struct {
+		cpf         string
+		hasVehicle  bool
+		cnhType     string
+		vehicleType int
+	}{
+		{testCPF, true, "E", 4},
+		{otherTestCPF, true, "E", 3},   // it's own truck isn't a carreta
+		{"11144477735", false, "E", 1}, // may take a carreta
+		{"12345678909", false, "B", 1}, // may not drive a carreta
+	}
+	for _, driver := range drivers {
+		body := strings.Replace(testDriverJSON(driver.cpf, "F", driver.cnhType),
+			`"has_vehicle":true`, `"has_vehicle":`+strconv.FormatBool(driver.hasVehicle), 1)
+		expectStatus(t, serve(router, "POST", "/drivers", body), http.StatusCreated)
+
+		body = strings.Replace(testTripJSON(driver.cpf, arrival, false),
+			`"vehicle_type":1`, `"vehicle_type":`+strconv.Itoa(driver.vehicleType), 1)
+		expectStatus(t, serve(router, "POST", "/trips", body), http.StatusCreated)
+	}
+
+	// from where the Trips arrived, back to where they left
+	w := serve(matches, "GET", "/matches?origin=-22.9,-43.2&destination=-23.55,-46.63&vehicle_type=4,5", "")
+	expectStatus(t, w, http.StatusOK)
+
+	var result []*models.Match
+	decodeBody(t, w, &result)
+	cpfs := make([]string, 0)
+	for _, match := range result {
+		cpfs = append(cpfs, string(*match.Driver.CPF))
+		if match.Score < 0.8 {
+			t.Errorf("%s: got score %f, want a return load's", *match.Driver.CPF, match.Score)
+		}
+	}
+	sort.Strings(cpfs)
+	if strings.Join(cpfs, ",") != "11144477735,"+testCPF {
+		t.Errorf("got drivers %v, want %s and 11144477735", cpfs, testCPF)
+	}
+}
@@ -0,0 +1,242 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rafaft/truck-pad/models"
+)
+
+// LenientQueries makes every request lenient, as if it had the header
+// "Prefer: handling=lenient" (for clients that can't send it)
+var LenientQueries = false
+
+// query parameters accepted by each route
+var (
+	driverFilterParams = []string{"gender", "has_vehicle", "cnh_type"}
+	tripFilterParams   = []string{
+		"id", "has_load", "vehicle_type", "from", "to", "order", "limit",
+		"origin_near", "origin_radius_km", "origin_bbox",
+		"destination_near", "destination_radius_km", "destination_bbox",
+	}
+	paginationParams = []string{"page_size", "page_token"}
+	fieldsParams     = []string{"fields"}
+	// "tz" is the time zone of dates on "from" and "to", and of the
+	// Trips' time on the response
+	timeZoneParams = []string{"tz"}
+)
+
+// relative time expressions, e.g.: "last_7d" (7 days ago)
+var relativeTimeRegex = regexp.MustCompile(`^last_(\d+)(m|h|d|w)$`)
+
+// local date-time layouts, interpreted on the "tz" time zone
+var localTimeLayouts = []string{
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	ISO8601,
+}
+
+// fields that can be requested with the "fields" query parameter
+var (
+	driverFields = []string{"cpf", "name", "birth_date", "age", "gender", "has_vehicle", "cnh_type"}
+	tripFields   = []string{"id", "driver_id", "has_load", "vehicle_type", "time", "origin", "destination"}
+)
+
+// queryParser collects the Violations of a request's query parameters.
+// Strict requests (the default) are rejected with all of them, while
+// lenient requests (RFC 7240 "Prefer: handling=lenient") ignore unknown
+// parameters and invalid values, as the API did before.
+type queryParser struct {
+	r        *http.Request
+	lenient  bool
+	errs     models.ValidationError
+	location *time.Location
+	// whether Trips' time is rendered on location
+	renderLocation bool
+	now            time.Time
+}
+
+// newQueryParser parses the request's query parameters and checks that
+// all of them are in one of the allowed lists
+func newQueryParser(r *http.Request, allowed ...[]string) *queryParser {
+	r.ParseForm()
+
+	p := &queryParser{
+		r:        r,
+		lenient:  LenientQueries || isLenient(r),
+		location: time.UTC,
+		now:      time.Now(),
+	}
+
+	params := make([]string, 0)
+	for param := range r.URL.Query() {
+		params = append(params, param)
+	}
+	sort.Strings(params)
+
+	for _, param := range params {
+		known := false
+		for _, params := range allowed {
+			known = known || containsString(params, param)
+		}
+		if !known {
+			p.invalid(param, models.RuleUnknown, fmt.Sprintf("unknown query parameter '%s'", param))
+		}
+	}
+
+	if tz := r.Form.Get("tz"); len(tz) > 0 {
+		location, err := time.LoadLocation(tz)
+		if err == nil {
+			p.location = location
+			p.renderLocation = true
+		} else {
+			p.invalid("tz", models.RuleFormat, "'tz' must be an IANA time zone (e.g.: America/Sao_Paulo)")
+		}
+	}
+
+	return p
+}
+
+// invalid adds a Violation of param, unless the request is lenient
+func (p *queryParser) invalid(param, rule, message string) {
+	if !p.lenient {
+		p.errs.Add(param, rule, message)
+	}
+}
+
+// reject adds a Violation of param even on lenient requests, for
+// parameters that can't be ignored
+func (p *queryParser) reject(param, rule, message string) {
+	p.errs.Add(param, rule, message)
+}
+
+// parseFields returns the non empty names of the "fields" query parameter,
+// which must be in known
+func (p *queryParser) parseFields(known []string) []string {
+	rawFields := p.r.Form.Get("fields")
+	if len(rawFields) == 0 {
+		return nil
+	}
+
+	fields := make([]string, 0)
+	for _, field := range strings.Split(rawFields, ",") {
+		if len(field) == 0 {
+			continue
+		}
+		if !containsString(known, field) {
+			p.invalid("fields", models.RuleEnum, fmt.Sprintf(
+				"unknown field '%s', must be one of: %s", field, strings.Join(known, ", ")),
+			)
+		}
+		fields = append(fields, field)
+	}
+
+	return fields
+}
+
+// parseTime parses a time query parameter, which can be:
+// a RFC3339 timestamp, a local date-time or date on the "tz" time zone,
+// "now", "today" (midnight) or "last_<n><m|h|d|w>" (n minutes, hours,
+// days or weeks ago). Returns nil if param is missing or invalid.
+func (p *queryParser) parseTime(param string) *time.Time {
+	value := p.r.Form.Get(param)
+	if len(value) == 0 {
+		return nil
+	}
+
+	now := p.now.In(p.location)
+	var t time.Time
+	var err error
+	switch {
+	case value == "now":
+		t = now
+	case value == "today":
+		t = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, p.location)
+	case relativeTimeRegex.MatchString(value):
+		match := relativeTimeRegex.FindStringSubmatch(value)
+		n, _ := strconv.Atoi(match[1])
+		switch match[2] {
+		case "m":
+			t = now.Add(-time.Duration(n) * time.Minute)
+		case "h":
+			t = now.Add(-time.Duration(n) * time.Hour)
+		case "d":
+			t = now.AddDate(0, 0, -n)
+		case "w":
+			t = now.AddDate(0, 0, -7*n)
+		}
+	default:
+		t, err = time.Parse(time.RFC3339Nano, value)
+		for _, layout := range localTimeLayouts {
+			if err == nil {
+				break
+			}
+			t, err = time.ParseInLocation(layout, value, p.location)
+		}
+	}
+
+	if err != nil {
+		p.invalid(param, models.RuleFormat, fmt.Sprintf(
+			"'%s' must be a RFC3339 timestamp, a date as YYYY-MM-DD or relative, as last_7d", param),
+		)
+		return nil
+	}
+
+	return &t
+}
+
+// renderTimes sets the Trips' time on the "tz" time zone, if it was given
+func (p *queryParser) renderTimes(trips []*models.Trip) {
+	for _, trip := range trips {
+		p.renderTime(trip)
+	}
+}
+
+// renderTime sets the Trip's time on the "tz" time zone, if it was given
+func (p *queryParser) renderTime(trip *models.Trip) {
+	if p.renderLocation && trip.Time != nil {
+		t := trip.Time.In(p.location)
+		trip.Time = &t
+	}
+}
+
+// Err returns a ValidationError with all Violations found, if any
+func (p *queryParser) Err() error {
+	return p.errs.Err()
+}
+
+// setPreferenceApplied tells a lenient client that it's preference was
+// honored (RFC 7240)
+func (p *queryParser) setPreferenceApplied(w http.ResponseWriter) {
+	if isLenient(p.r) {
+		w.Header().Set("Preference-Applied", "handling=lenient")
+	}
+}
+
+// isLenient reports whether the request prefers lenient handling
+func isLenient(r *http.Request) bool {
+	for _, prefer := range r.Header.Values("Prefer") {
+		for _, preference := range strings.Split(prefer, ",") {
+			if strings.EqualFold(strings.TrimSpace(preference), "handling=lenient") {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func containsString(values []string, s string) bool {
+	for _, value := range values {
+		if value == s {
+			return true
+		}
+	}
+
+	return false
+}
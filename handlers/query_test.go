@@ -0,0 +1,261 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rafaft/truck-pad/models"
+	"github.com/rafaft/truck-pad/store"
+)
+
+// violationFields returns the fields of err's Violations
+func violationFields(err error) []string {
+	fields := make([]string, 0)
+	if err, ok := err.(*models.ValidationError); ok {
+		for _, violation := range err.Violations {
+			fields = append(fields, violation.Field+":"+violation.Rule)
+		}
+	}
+
+	return fields
+}
+
+func TestQueryParser(t *testing.T) {
+	tests := []struct {
+		query  string
+		prefer string
+		fields []string
+	}{
+		{"?has_load=true&order=asc", "", []string{}},
+		// every violation is reported, unknown parameters sorted by name
+		{"?b=1&a=1&has_load=maybe&order=up", "", []string{"a:unknown", "b:unknown", "has_load:type", "order:enum"}},
+		{"?tz=Mars/Olympus", "", []string{"tz:format"}},
+		{"?fields=id,speed", "", []string{"fields:enum"}},
+		{"?driver_id=4837216200&vehicle_type=9", "", []string{"driver_id:cpf", "vehicle_type:enum"}},
+		// lenient requests ignore them
+		{"?b=1&a=1&has_load=maybe&order=up", "handling=lenient", []string{}},
+		{"?tz=Mars/Olympus", "respond-async, Handling=Lenient", []string{}},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/trips"+test.query, nil)
+		if len(test.prefer) > 0 {
+			r.Header.Set("Prefer", test.prefer)
+		}
+
+		p := newQueryParser(r, tripFilterParams, []string{"driver_id"}, fieldsParams, timeZoneParams)
+		createTripsFilter(p)
+		if fields := violationFields(p.Err()); !reflect.DeepEqual(fields, test.fields) {
+			t.Errorf("%s (Prefer: %s): got %v, want %v", test.query, test.prefer, fields, test.fields)
+		}
+	}
+}
+
+func TestQueryParserReject(t *testing.T) {
+	for _, prefer := range []string{"", "handling=lenient"} {
+		r := httptest.NewRequest("GET", "/matches?origin=x&unknown=1", nil)
+		r.Header.Set("Prefer", prefer)
+
+		p := newQueryParser(r, []string{"origin"})
+		p.reject("origin", models.RuleFormat, "'origin' must be 'lat,lng'")
+
+		want := []string{"unknown:unknown", "origin:format"}
+		if len(prefer) > 0 {
+			want = want[1:]
+		}
+		if fields := violationFields(p.Err()); !reflect.DeepEqual(fields, want) {
+			t.Errorf("Prefer: %s: got %v, want %v", prefer, fields, want)
+		}
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	now := time.Date(2020, 2, 14, 12, 30, 0, 0, time.UTC)
+	tests := []struct {
+		value string
+		tz    string
+		want  string
+	}{
+		{"2020-02-14T08:00:00-03:00", "", "2020-02-14T11:00:00Z"},
+		{"2020-02-14T08:00:00.5Z", "", "2020-02-14T08:00:00.5Z"},
+		// the offset of a RFC3339 timestamp wins over "tz"
+		{"2020-02-14T08:00:00Z", "America/Sao_Paulo", "2020-02-14T08:00:00Z"},
+		// dates and local date-times are on "tz", UTC by default
+		{"2020-02-14", "", "2020-02-14T00:00:00Z"},
+		{"2020-02-14", "America/Sao_Paulo", "2020-02-14T03:00:00Z"},
+		{"2020-02-14T08:00", "America/Sao_Paulo", "2020-02-14T11:00:00Z"},
+		{"2020-02-14T08:00:30", "America/Sao_Paulo", "2020-02-14T11:00:30Z"},
+		{"now", "", "2020-02-14T12:30:00Z"},
+		{"today", "", "2020-02-14T00:00:00Z"},
+		{"today", "America/Sao_Paulo", "2020-02-14T03:00:00Z"},
+		// midnight in Tokyo (UTC+9) is still the 13th in UTC
+		{"today", "Asia/Tokyo", "2020-02-13T15:00:00Z"},
+		{"last_90m", "", "2020-02-14T11:00:00Z"},
+		{"last_2h", "", "2020-02-14T10:30:00Z"},
+		{"last_7d", "", "2020-02-07T12:30:00Z"},
+		{"last_2w", "America/Sao_Paulo", "2020-01-31T12:30:00Z"},
+		// invalid values
+		{"14/02/2020", "", ""},
+		{"2020-02-30", "", ""},
+		{"last_7y", "", ""},
+		{"yesterday", "", ""},
+	}
+	for _, test := range tests {
+		query := url.Values{"from": {test.value}}
+		if len(test.tz) > 0 {
+			query.Set("tz", test.tz)
+		}
+		r := httptest.NewRequest("GET", "/trips?"+query.Encode(), nil)
+
+		p := newQueryParser(r, tripFilterParams, timeZoneParams)
+		if p.Err() != nil {
+			t.Fatalf("%s: got %v", test.tz, p.Err())
+		}
+		p.now = now
+
+		got := p.parseTime("from")
+		switch {
+		case len(test.want) == 0:
+			if got != nil || !reflect.DeepEqual(violationFields(p.Err()), []string{"from:format"}) {
+				t.Errorf("%s (tz %q): got %v, %v, want a format violation", test.value, test.tz, got, p.Err())
+			}
+		case got == nil:
+			t.Errorf("%s (tz %q): got %v, want %s", test.value, test.tz, p.Err(), test.want)
+		case got.UTC().Format(time.RFC3339Nano) != test.want:
+			t.Errorf("%s (tz %q): got %s, want %s", test.value, test.tz, got.UTC().Format(time.RFC3339Nano), test.want)
+		}
+	}
+}
+
+func TestTripsTimeZone(t *testing.T) {
+	router := newTestRouter(store.NewMemoryStore())
+	// 13th 23:00, 07:00, 09:00 and 19:00 in São Paulo (UTC-3)
+	for _, tripTime := range []string{"2020-02-14T02:00:00Z", "2020-02-14T10:00:00Z", "2020-02-14T12:00:00Z", "2020-02-14T22:00:00Z"} {
+		addTestTrip(t, router, testCPF, tripTime, true)
+	}
+
+	tests := []struct {
+		query string
+		times []string
+	}{
+		{"from=2020-02-14", []string{"2020-02-14T02:00:00Z", "2020-02-14T10:00:00Z", "2020-02-14T12:00:00Z", "2020-02-14T22:00:00Z"}},
+		{"from=2020-02-14&tz=America/Sao_Paulo", []string{"2020-02-14T07:00:00-03:00", "2020-02-14T09:00:00-03:00", "2020-02-14T19:00:00-03:00"}},
+		// "to" is exclusive
+		{"from=2020-02-14T08:00&to=2020-02-14T18:00&tz=America/Sao_Paulo", []string{"2020-02-14T09:00:00-03:00"}},
+		{"from=2020-02-14T10:00:00Z&to=2020-02-14T12:00:00Z", []string{"2020-02-14T10:00:00Z"}},
+		{"to=2020-02-14&tz=America/Sao_Paulo", []string{"2020-02-13T23:00:00-03:00"}},
+	}
+	for _, test := range tests {
+		w := serve(router, "GET", "/trips?order=asc&"+test.query, "")
+		expectStatus(t, w, http.StatusOK)
+
+		var trips []*models.Trip
+		decodeBody(t, w, &trips)
+		times := make([]string, len(trips))
+		for i, trip := range trips {
+			times[i] = trip.Time.Format(time.RFC3339)
+		}
+		if !reflect.DeepEqual(times, test.times) {
+			t.Errorf("%s: got %v, want %v", test.query, times, test.times)
+		}
+	}
+
+	w := serve(router, "GET", "/trips?from=2020-02-14T08:00&tz=Mars/Olympus", "")
+	expectStatus(t, w, http.StatusBadRequest)
+}
+
+func TestLenientQueries(t *testing.T) {
+	router := newTestRouter(store.NewMemoryStore())
+	trip := addTestTrip(t, router, testCPF, "2020-02-14T15:00:00Z", true)
+
+	get := func(target, prefer string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", target, nil)
+		if len(prefer) > 0 {
+			r.Header.Set("Prefer", prefer)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	w := get("/trips?has_load=maybe&unknown=1", "")
+	expectStatus(t, w, http.StatusBadRequest)
+	var problem models.Problem
+	decodeBody(t, w, &problem)
+	if fields := violationFields(&models.ValidationError{Violations: problem.Violations}); !reflect.DeepEqual(fields, []string{"unknown:unknown", "has_load:type"}) {
+		t.Errorf("got violations %v", fields)
+	}
+	if len(w.Header().Get("Preference-Applied")) > 0 {
+		t.Errorf("got Preference-Applied on a strict request")
+	}
+
+	w = get("/trips?has_load=maybe&unknown=1", "handling=lenient")
+	expectStatus(t, w, http.StatusOK)
+	if w.Header().Get("Preference-Applied") != "handling=lenient" {
+		t.Errorf("got Preference-Applied %q, want handling=lenient", w.Header().Get("Preference-Applied"))
+	}
+
+	// "limit" can't be ignored along pagination on strict requests
+	expectStatus(t, get("/trips?limit=1&page_size=1", ""), http.StatusBadRequest)
+	expectStatus(t, get("/trips?limit=1&page_size=1", "handling=lenient"), http.StatusOK)
+
+	// LenientQueries is lenient without the client asking for it
+	defer func(lenient bool) { LenientQueries = lenient }(LenientQueries)
+	LenientQueries = true
+	w = get("/trips?has_load=maybe", "")
+	expectStatus(t, w, http.StatusOK)
+	if len(w.Header().Get("Preference-Applied")) > 0 {
+		t.Errorf("got Preference-Applied without Prefer")
+	}
+	LenientQueries = false
+
+	// punctuated CPFs are normalized
+	for _, driverID := range []string{"529.982.247-25", testCPF} {
+		w = get("/trips?driver_id="+driverID, "")
+		expectStatus(t, w, http.StatusOK)
+		var trips []*models.Trip
+		decodeBody(t, w, &trips)
+		if len(trips) != 1 || trips[0].ID != trip.ID {
+			t.Errorf("driver_id=%s: got %d trips, want trip %s", driverID, len(trips), trip.ID)
+		}
+	}
+}
+
+func TestPaginationParams(t *testing.T) {
+	router := newTestRouter(store.NewMemoryStore())
+	for i := 0; i < 3; i++ {
+		addTestTrip(t, router, testCPF, fmt.Sprintf("2020-02-14T1%d:00:00Z", i), true)
+	}
+
+	for _, pageSize := range []string{"0", "-1", "1001", "ten"} {
+		w := serve(router, "GET", "/trips?page_size="+pageSize, "")
+		expectStatus(t, w, http.StatusBadRequest)
+		var problem models.Problem
+		decodeBody(t, w, &problem)
+		if fields := violationFields(&models.ValidationError{Violations: problem.Violations}); !reflect.DeepEqual(fields, []string{"page_size:range"}) {
+			t.Errorf("page_size=%s: got violations %v", pageSize, fields)
+		}
+	}
+	expectStatus(t, serve(router, "GET", "/trips?page_token=invalid", ""), http.StatusBadRequest)
+
+	// the Link header leads through every page
+	target, pages := "/trips?page_size=2", 0
+	for len(target) > 0 {
+		w := serve(router, "GET", target, "")
+		expectStatus(t, w, http.StatusOK)
+		pages++
+		target = ""
+		if link := w.Header().Get("Link"); len(link) > 0 {
+			target = link[1:strings.Index(link, ">")]
+		}
+	}
+	if pages != 2 {
+		t.Errorf("got %d pages, want 2", pages)
+	}
+	expectStatus(t, serve(router, "GET", "/trips?page_size=1000", ""), http.StatusOK)
+}
@@ -0,0 +1,277 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/rafaft/truck-pad/models"
+)
+
+// formats of lists, by the "format" query parameter
+const (
+	formatJSON   = "json"
+	formatNDJSON = "ndjson"
+)
+
+// formatParams are the query parameters of routes with content negotiation
+var formatParams = []string{"format"}
+
+// mediaType is the media type of a format of a list
+type mediaType struct {
+	format    string
+	mediaType string
+}
+
+// driverMediaTypes are the media types of each format of Driver lists, the
+// first one is the default
+var driverMediaTypes = []mediaType{
+	{formatJSON, "application/json"},
+	{formatNDJSON, "application/x-ndjson"},
+}
+
+// streamFlushItems is how many items of a list are written between
+// flushes, so clients get them as they're read
+const streamFlushItems = 100
+
+// listEncoder writes the items of a list, one at a time. flush writes
+// whatever the encoder buffered.
+type listEncoder interface {
+	begin() error
+	encode(item interface{}) error
+	flush() error
+	end() error
+}
+
+// newListEncoder returns the JSON or NDJSON encoder of format
+func newListEncoder(w io.Writer, format string) listEncoder {
+	if format == formatNDJSON {
+		return &ndjsonEncoder{w}
+	}
+
+	return &jsonArrayEncoder{w: w}
+}
+
+// jsonArrayEncoder writes a JSON array
+type jsonArrayEncoder struct {
+	w     io.Writer
+	items int
+}
+
+func (e *jsonArrayEncoder) begin() error {
+	_, err := e.w.Write([]byte("["))
+	return err
+}
+
+func (e *jsonArrayEncoder) encode(item interface{}) error {
+	b, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	if e.items > 0 {
+		b = append([]byte(","), b...)
+	}
+	e.items++
+
+	_, err = e.w.Write(b)
+	return err
+}
+
+func (e *jsonArrayEncoder) flush() error {
+	return nil
+}
+
+func (e *jsonArrayEncoder) end() error {
+	_, err := e.w.Write([]byte("]"))
+	return err
+}
+
+// ndjsonEncoder writes a JSON object per line
+type ndjsonEncoder struct {
+	w io.Writer
+}
+
+func (e *ndjsonEncoder) begin() error {
+	return nil
+}
+
+func (e *ndjsonEncoder) encode(item interface{}) error {
+	b, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+
+	_, err = e.w.Write(append(b, '\n'))
+	return err
+}
+
+func (e *ndjsonEncoder) flush() error {
+	return nil
+}
+
+func (e *ndjsonEncoder) end() error {
+	return nil
+}
+
+// streamList writes the items of each to the response as they come,
+// instead of holding the whole list in memory. The status and the
+// beginning of the list are only written with the first item (or at the
+// end, if there are none), so an error before that is returned, to be
+// written as usual. Once the response has begun, an error can only cut it
+// short: the connection is aborted, so the client can tell the list is
+// incomplete, rather than getting a truncated list that seems complete.
+// The response is flushed every streamFlushItems items.
+func streamList(w http.ResponseWriter, contentType string, enc listEncoder,
+	each func(fn func(item interface{}) error) error) error {
+	flusher, _ := w.(http.Flusher)
+	items := 0
+	started := false
+	start := func() error {
+		if started {
+			return nil
+		}
+		started = true
+
+		w.Header().Set("Content-Type", contentType)
+		w.WriteHeader(http.StatusOK)
+		return enc.begin()
+	}
+
+	err := each(func(item interface{}) error {
+		if err := start(); err != nil {
+			return err
+		}
+		if err := enc.encode(item); err != nil {
+			return err
+		}
+
+		if items++; items%streamFlushItems == 0 && flusher != nil {
+			if err := enc.flush(); err != nil {
+				return err
+			}
+			flusher.Flush()
+		}
+		return nil
+	})
+	if err == nil {
+		if err = start(); err == nil {
+			err = enc.end()
+		}
+	}
+	if err == nil {
+		return nil
+	}
+	if !started {
+		return err
+	}
+
+	fmt.Println(err)
+	panic(http.ErrAbortHandler)
+}
+
+// negotiateFormat returns the format of a list, from the "format" query
+// parameter or, when it's not given, the Accept header. It returns an
+// empty string if none of the Accept header's media types is on
+// mediaTypes.
+func negotiateFormat(p *queryParser, mediaTypes []mediaType) string {
+	if format := p.r.Form.Get("format"); len(format) > 0 {
+		formats := make([]string, len(mediaTypes))
+		for i, t := range mediaTypes {
+			if t.format == format {
+				return format
+			}
+			formats[i] = "'" + t.format + "'"
+		}
+
+		p.invalid("format", models.RuleEnum, fmt.Sprintf("'format' must be %s or %s",
+			strings.Join(formats[:len(formats)-1], ", "), formats[len(formats)-1]))
+		return mediaTypes[0].format
+	}
+
+	accept := p.r.Header.Get("Accept")
+	if len(strings.TrimSpace(accept)) == 0 {
+		return mediaTypes[0].format
+	}
+
+	type acceptedType struct {
+		mediaType string
+		q         float64
+	}
+	accepted := make([]acceptedType, 0)
+	for _, value := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(value)
+		if err != nil {
+			continue
+		}
+
+		q := 1.0
+		if strQ, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(strQ, 64); err != nil {
+				continue
+			}
+		}
+		accepted = append(accepted, acceptedType{mediaType, q})
+	}
+
+	// each media type gets the q of the most specific range that matches
+	// it (RFC 7231), so "application/json;q=0, */*" excludes JSON. The
+	// most preferred one wins, and ties go to the range that comes first
+	// on the header (or the first media type, for the same range).
+	format, bestQ, bestIndex := "", 0.0, len(accepted)
+	for _, t := range mediaTypes {
+		q, index, specificity := 0.0, len(accepted), -1
+		for i, a := range accepted {
+			if s := mediaRangeSpecificity(a.mediaType, t.mediaType); s > specificity {
+				q, index, specificity = a.q, i, s
+			}
+		}
+		if q > bestQ || (q == bestQ && q > 0 && index < bestIndex) {
+			format, bestQ, bestIndex = t.format, q, index
+		}
+	}
+
+	return format
+}
+
+// formatMediaType returns the media type of format
+func formatMediaType(mediaTypes []mediaType, format string) string {
+	for _, t := range mediaTypes {
+		if t.format == format {
+			return t.mediaType
+		}
+	}
+
+	return mediaTypes[0].mediaType
+}
+
+// notAcceptableError lists the media types of a list
+func notAcceptableError(mediaTypes []mediaType) error {
+	types := make([]string, len(mediaTypes))
+	for i, t := range mediaTypes {
+		types[i] = t.mediaType
+	}
+
+	return fmt.Errorf("'Accept' must be %s or %s",
+		strings.Join(types[:len(types)-1], ", "), types[len(types)-1])
+}
+
+// mediaRangeSpecificity returns how specific the media range pattern is
+// when it matches mediaType: 2 for the same media type, 1 for "type/*" and
+// 0 for "*/*", or -1 if it doesn't match
+func mediaRangeSpecificity(pattern, mediaType string) int {
+	switch {
+	case pattern == mediaType:
+		return 2
+	case strings.HasSuffix(pattern, "/*") && pattern != "*/*" &&
+		strings.HasPrefix(mediaType, strings.TrimSuffix(pattern, "*")):
+		return 1
+	case pattern == "*/*":
+		return 0
+	}
+
+	return -1
+}
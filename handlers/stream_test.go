@@ -0,0 +1,172 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/rafaft/truck-pad/models"
+	"github.com/rafaft/truck-pad/store"
+)
+
+// flushRecorder counts the flushes of a response, and how much of the
+// body was written on the last one
+type flushRecorder struct {
+	*httptest.ResponseRecorder
+	flushes int
+	flushed int
+}
+
+func (r *flushRecorder) Flush() {
+	r.flushes++
+	r.flushed = r.Body.Len()
+}
+
+// streamItems streams n Trips as CSV through w
+func streamItems(w http.ResponseWriter, n int, err error) error {
+	contentType, enc := newTripEncoder(w, formatCSV, []string{"id"})
+	return streamList(w, contentType, enc, func(fn func(item interface{}) error) error {
+		for i := 0; i < n; i++ {
+			if err := fn(&models.Trip{ID: fmt.Sprintf("trip-%d", i)}); err != nil {
+				return err
+			}
+		}
+		return err
+	})
+}
+
+func TestStreamListFlushes(t *testing.T) {
+	limiter := NewRateLimiter(map[string]RouteLimits{"read": {Rate: 100, Burst: 100}})
+	wrappers := map[string]func(http.ResponseWriter) http.ResponseWriter{
+		"plain":       func(w http.ResponseWriter) http.ResponseWriter { return w },
+		"rate limit":  func(w http.ResponseWriter) http.ResponseWriter { return &statusRecorder{ResponseWriter: w} },
+		"idempotency": func(w http.ResponseWriter) http.ResponseWriter { return &responseRecorder{ResponseWriter: w} },
+	}
+	for name, wrap := range wrappers {
+		w := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+		if err := streamItems(wrap(w), 250, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		if w.flushes != 2 {
+			t.Errorf("%s: got %d flushes, want 2", name, w.flushes)
+		}
+		// the CSV writer's buffer is flushed along, up to the 200th Trip
+		if want := len(strings.Join(strings.SplitAfter(w.Body.String(), "\n")[:201], "")); w.flushed != want {
+			t.Errorf("%s: got %d bytes on the last flush, want %d", name, w.flushed, want)
+		}
+		if lines := strings.Count(w.Body.String(), "\n"); lines != 251 {
+			t.Errorf("%s: got %d lines, want 251", name, lines)
+		}
+	}
+
+	// through the middlewares
+	w := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	handler := limiter.Limit("read", func(w http.ResponseWriter, r *http.Request) {
+		streamItems(w, 100, nil)
+	})
+	handler(w, httptest.NewRequest("GET", "/trips?format=csv", nil))
+	if w.flushes != 1 {
+		t.Errorf("got %d flushes through the limiter, want 1", w.flushes)
+	}
+}
+
+func TestStreamListAbort(t *testing.T) {
+	// an error before the first item is written as usual
+	w := httptest.NewRecorder()
+	if err := streamItems(w, 0, fmt.Errorf("database down")); err == nil {
+		t.Fatal("got no error before the response began")
+	}
+	if w.Body.Len() > 0 || len(w.Header().Get("Content-Type")) > 0 {
+		t.Errorf("got %q written before the error", w.Body.String())
+	}
+
+	// after it, the connection is aborted
+	w = httptest.NewRecorder()
+	defer func() {
+		if recovered := recover(); recovered != http.ErrAbortHandler {
+			t.Fatalf("got %v, want http.ErrAbortHandler", recovered)
+		}
+		if w.Code != http.StatusOK || !strings.HasPrefix(w.Body.String(), "id\n") {
+			t.Errorf("got %d %q, want the beginning of the list", w.Code, w.Body.String())
+		}
+	}()
+	streamItems(w, 150, fmt.Errorf("database down"))
+	t.Fatal("got a complete list")
+}
+
+func TestStreamListAbortFromStore(t *testing.T) {
+	db := store.NewMemoryStore()
+	router := newTestRouter(db)
+	for i := 0; i < 3; i++ {
+		addTestTrip(t, router, testCPF, fmt.Sprintf("2020-02-14T1%d:00:00Z", i), true)
+	}
+
+	// the request is canceled after the first Trip
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r := httptest.NewRequest("GET", "/trips?format=ndjson", nil).WithContext(ctx)
+	w := &cancelingRecorder{ResponseRecorder: httptest.NewRecorder(), cancel: cancel}
+
+	aborted := func() (aborted bool) {
+		defer func() { aborted = recover() == http.ErrAbortHandler }()
+		router.ServeHTTP(w, r)
+		return false
+	}()
+	if !aborted {
+		t.Errorf("got a complete response %q, want it aborted", w.Body.String())
+	}
+}
+
+// cancelingRecorder cancels the request once the response is written to
+type cancelingRecorder struct {
+	*httptest.ResponseRecorder
+	cancel func()
+}
+
+func (r *cancelingRecorder) Write(b []byte) (int, error) {
+	r.cancel()
+	return r.ResponseRecorder.Write(b)
+}
+
+func TestNegotiateFormat(t *testing.T) {
+	tests := []struct {
+		accept string
+		format string
+	}{
+		{"", formatJSON},
+		{"application/json", formatJSON},
+		{"application/x-ndjson", formatNDJSON},
+		{"*/*", formatJSON},
+		{"text/*", formatCSV},
+		{"application/xml", ""},
+		{"application/x-ndjson;q=0.5, application/json", formatJSON},
+		{"application/json;q=0.5, text/csv;q=0.9", formatCSV},
+		{"application/x-ndjson, application/json", formatNDJSON},
+		{"application/json;q=0, */*", formatNDJSON},
+		{"application/json;q=0, application/*;q=0.5, text/csv;q=0.1", formatNDJSON},
+		{"application/json;q=0", ""},
+		{"*/*;q=0", ""},
+		{"text/csv;q=invalid, application/x-ndjson", formatNDJSON},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/trips", nil)
+		if len(test.accept) > 0 {
+			r.Header.Set("Accept", test.accept)
+		}
+		query := newQueryParser(r, formatParams)
+		if format := negotiateFormat(query, tripMediaTypes); format != test.format {
+			t.Errorf("Accept: %s: got %q, want %q", test.accept, format, test.format)
+		}
+	}
+
+	// the query parameter wins over the header
+	r := httptest.NewRequest("GET", "/trips?format=kml", nil)
+	r.Header.Set("Accept", "application/json")
+	if format := negotiateFormat(newQueryParser(r, formatParams), tripMediaTypes); format != formatKML {
+		t.Errorf("got %q, want kml", format)
+	}
+}
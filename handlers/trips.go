@@ -6,86 +6,104 @@ import (
 	"io/ioutil"
 	"net/http"
 
-	"cloud.google.com/go/firestore"
+	"github.com/gorilla/mux"
+
 	"github.com/rafaft/truck-pad/models"
-	"google.golang.org/api/iterator"
+	"github.com/rafaft/truck-pad/store"
 )
 
-func AddTrip(client *firestore.Client) func(w http.ResponseWriter, r *http.Request) {
+func AddTrip(trips store.TripStore) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 
 		body, err := ioutil.ReadAll(r.Body)
 		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write(createErrorJSON(err))
+			writeBodyError(w, r, err)
 			return
 		}
 
 		trip, err := models.NewTrip(body)
 		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write(createErrorJSON(err))
+			writeError(w, r, http.StatusBadRequest, err)
 			return
 		}
 
-		ctx := r.Context()
-		collection := client.Collection("drivers").Doc(string(*trip.DriverID)).Collection("trips")
-		_, err = collection.Where("id", "==", trip.ID).Documents(ctx).Next()
-		if err != iterator.Done {
-			w.WriteHeader(http.StatusConflict)
-			w.Write(createErrorJSON(fmt.Errorf(
-				"there is already a trip with the same timestamp under driver=%s", *trip.DriverID),
-			))
+		err = trips.AddTrip(r.Context(), trip)
+		if err != nil {
+			if err == store.ErrConflict {
+				writeError(w, r, http.StatusConflict, fmt.Errorf(
+					"there is already a trip with the same timestamp under driver=%s", *trip.DriverID,
+				))
+			} else {
+				fmt.Println(err)
+				writeError(w, r, http.StatusInternalServerError, fmt.Errorf("internal server error"))
+			}
 			return
 		}
 
-		_, _, err = collection.Add(ctx, &trip)
-		if err != nil {
-			fmt.Println(err)
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write(createErrorJSON(fmt.Errorf("internal server error")))
+		writeResource(w, r, http.StatusCreated, tripLocation(trip), trip)
+	}
+}
+
+func GetAllTrips(trips store.TripStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		query := newQueryParser(r, []string{"driver_id"}, tripFilterParams, paginationParams, fieldsParams, timeZoneParams, formatParams)
+		filter := createTripsFilter(query)
+		filter.PageSize, filter.PageToken = parsePagination(query)
+		format := negotiateFormat(query, tripMediaTypes)
+		if err := query.Err(); err != nil {
+			writeError(w, r, http.StatusBadRequest, err)
 			return
 		}
+		if len(format) == 0 {
+			writeError(w, r, http.StatusNotAcceptable, notAcceptableError(tripMediaTypes))
+			return
+		}
+		query.setPreferenceApplied(w)
 
-		w.WriteHeader(http.StatusCreated)
+		writeTripList(w, r, trips, query, filter, format)
 	}
 }
 
-func GetAllTrips(client *firestore.Client) func(w http.ResponseWriter, r *http.Request) {
+func GetTrip(trips store.TripStore) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 
-		r.ParseForm()
+		query := newQueryParser(r, fieldsParams, timeZoneParams)
+
+		// only "fields" is allowed
+		fields := r.Form.Get("fields")
+		r.Form = make(map[string][]string)
+		r.Form.Set("fields", fields)
+		r.Form.Set("id", mux.Vars(r)["id"])
+		r.Form.Set("limit", "1")
+
+		filter := createTripsFilter(query)
+		if err := query.Err(); err != nil {
+			writeError(w, r, http.StatusBadRequest, err)
+			return
+		}
+		query.setPreferenceApplied(w)
 
-		q := createTripsQuery(client, r)
-		docs, err := q.Documents(r.Context()).GetAll()
+		result, _, err := trips.GetTrips(r.Context(), filter)
 		if err != nil {
 			fmt.Println(err)
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write(createErrorJSON(fmt.Errorf("internal server error")))
+			writeError(w, r, http.StatusInternalServerError, fmt.Errorf("internal server error"))
 			return
 		}
-
-		result := make([]*models.Trip, len(docs))
-		for i, docSnapShot := range docs {
-			var trip models.Trip
-			err = docSnapShot.DataTo(&trip)
-			if err != nil {
-				fmt.Println(err)
-				w.WriteHeader(http.StatusInternalServerError)
-				w.Write(createErrorJSON(fmt.Errorf("internal server error")))
-				return
-			}
-
-			result[i] = &trip
+		if len(result) == 0 {
+			writeError(w, r, http.StatusNotFound, fmt.Errorf("trip id=%s not found", mux.Vars(r)["id"]))
+			return
 		}
 
-		b, err := json.Marshal(result)
+		query.renderTimes(result)
+
+		b, err := json.Marshal(result[0])
 		if err != nil {
 			fmt.Println(err)
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write(createErrorJSON(fmt.Errorf("internal server error")))
+			writeError(w, r, http.StatusInternalServerError, fmt.Errorf("internal server error"))
 			return
 		}
 
@@ -1,153 +1,153 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 
-	"cloud.google.com/go/firestore"
 	"github.com/gorilla/mux"
+
 	"github.com/rafaft/truck-pad/models"
-	"google.golang.org/api/iterator"
+	"github.com/rafaft/truck-pad/store"
 )
 
-func AddTripByDriver(client *firestore.Client) func(w http.ResponseWriter, r *http.Request) {
+// AddTripByDriver adds a Trip of the Driver on the path, whose CPF's check
+// digits aren't validated, as Drivers registered before they were may
+// have invalid CPFs
+func AddTripByDriver(trips store.TripStore) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 
 		content, err := ioutil.ReadAll(r.Body)
 		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write(createErrorJSON(err))
+			writeBodyError(w, r, err)
 			return
 		}
 
 		var trip models.Trip
 		err = json.Unmarshal(content, &trip)
-		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write(createErrorJSON(err))
-			return
+		// the body's driver_id is ignored, so it's violations too
+		if validationErr, ok := err.(*models.ValidationError); ok {
+			err = validationErr.Without("driver_id")
 		}
-
 		cpf := models.DriverID(mux.Vars(r)["cpf"])
 		trip.DriverID = &cpf
-		if err = trip.ValidateTrip(); err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write(createErrorJSON(err))
+		if err = models.MergeErrors(err, trip.ValidateTrip()); err != nil {
+			writeError(w, r, http.StatusBadRequest, err)
 			return
 		}
-		trip.SetID()
-
-		ctx := r.Context()
-		collection := client.Collection("drivers").Doc(string(*trip.DriverID)).Collection("trips")
-		_, err = collection.Where("id", "==", trip.ID).Documents(ctx).Next()
-		if err != iterator.Done {
-			w.WriteHeader(http.StatusConflict)
-			w.Write(createErrorJSON(fmt.Errorf(
-				"there is already a trip with the same timestamp under driver=%s", *trip.DriverID),
-			))
+		if err = trip.SetID(); err != nil {
+			writeError(w, r, http.StatusBadRequest, err)
+			return
+		}
+		if err = trip.SetGeohashes(); err != nil {
+			writeError(w, r, http.StatusBadRequest, err)
 			return
 		}
 
-		_, _, err = collection.Add(ctx, &trip)
+		err = trips.AddTrip(r.Context(), &trip)
 		if err != nil {
-			fmt.Println(err)
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write(createErrorJSON(fmt.Errorf("internal server error")))
+			if err == store.ErrConflict {
+				writeError(w, r, http.StatusConflict, fmt.Errorf(
+					"there is already a trip with the same timestamp under driver=%s", *trip.DriverID,
+				))
+			} else {
+				fmt.Println(err)
+				writeError(w, r, http.StatusInternalServerError, fmt.Errorf("internal server error"))
+			}
 			return
 		}
 
-		w.WriteHeader(http.StatusCreated)
+		writeResource(w, r, http.StatusCreated, tripLocation(&trip), &trip)
 	}
 }
 
-func GetTripsByDriver(client *firestore.Client) func(w http.ResponseWriter, r *http.Request) {
+func GetTripsByDriver(trips store.TripStore) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 
-		r.ParseForm()
+		query := newQueryParser(r, tripFilterParams, paginationParams, fieldsParams, timeZoneParams, formatParams)
 
 		cpf := mux.Vars(r)["cpf"]
 		r.Form.Set("driver_id", cpf)
 
-		q := createTripsQuery(client, r)
-		docs, err := q.Documents(r.Context()).GetAll()
-		if err != nil {
-			fmt.Println(err)
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write(createErrorJSON(fmt.Errorf("internal server error")))
+		filter := createTripsFilter(query)
+		filter.PageSize, filter.PageToken = parsePagination(query)
+		format := negotiateFormat(query, tripMediaTypes)
+		if err := query.Err(); err != nil {
+			writeError(w, r, http.StatusBadRequest, err)
 			return
 		}
-
-		result := make([]*models.Trip, len(docs))
-		for i, docSnapShot := range docs {
-			var trip models.Trip
-			err = docSnapShot.DataTo(&trip)
-			if err != nil {
-				fmt.Println(err)
-				w.WriteHeader(http.StatusInternalServerError)
-				w.Write(createErrorJSON(fmt.Errorf("internal server error")))
-				return
-			}
-
-			result[i] = &trip
-		}
-
-		b, err := json.Marshal(result)
-		if err != nil {
-			fmt.Println(err)
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write(createErrorJSON(fmt.Errorf("internal server error")))
+		if len(format) == 0 {
+			writeError(w, r, http.StatusNotAcceptable, notAcceptableError(tripMediaTypes))
 			return
 		}
+		query.setPreferenceApplied(w)
 
-		w.WriteHeader(http.StatusOK)
-		w.Write(b)
+		writeTripList(w, r, trips, query, filter, format)
 	}
 }
 
-// Trip IDs are only unique whithin a Driver's trips...
-func GetTripByID(client *firestore.Client) func(w http.ResponseWriter, r *http.Request) {
+// GetTripByID also accepts legacy Trip IDs, which are the Trip's timestamp
+// on the offset it was sent with and only unique within a Driver's trips
+// (see findTrips)
+func GetTripByID(trips store.TripStore) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 
-		r.ParseForm()
+		query := newQueryParser(r, fieldsParams, timeZoneParams)
 
+		r.Form.Del("id")
 		r.Form.Del("has_load")
 		r.Form.Del("vehicle_type")
 		r.Form.Del("from")
 		r.Form.Del("to")
+		deleteAreaParams(r)
 
 		cpf := mux.Vars(r)["cpf"]
 		id := mux.Vars(r)["id"]
 
 		r.Form.Set("driver_id", cpf)
-		r.Form.Set("id", id)
+		r.Form.Set("limit", "1")
 
-		q := createTripsQuery(client, r)
-		doc, err := q.Documents(r.Context()).Next()
-		if err == iterator.Done {
-			w.WriteHeader(http.StatusNotFound)
-			w.Write(createErrorJSON(fmt.Errorf("driver or trip id not found")))
+		filter := createTripsFilter(query)
+		if err := query.Err(); err != nil {
+			writeError(w, r, http.StatusBadRequest, err)
 			return
 		}
+		query.setPreferenceApplied(w)
 
-		var trip models.Trip
-		err = doc.DataTo(&trip)
+		result, err := findTrips(r.Context(), trips, filter, id)
 		if err != nil {
 			fmt.Println(err)
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write(createErrorJSON(fmt.Errorf("internal server error")))
+			writeError(w, r, http.StatusInternalServerError, fmt.Errorf("internal server error"))
 			return
 		}
+		if len(result) == 0 {
+			writeError(w, r, http.StatusNotFound, fmt.Errorf("driver or trip id not found"))
+			return
+		}
+
+		// partial representations (with "fields") lack the values of
+		// the entity tag
+		if len(r.Form.Get("fields")) == 0 {
+			etag := tripETag(result[0])
+			w.Header().Set("ETag", etag)
+			if noneMatch(r, etag) {
+				w.Header().Del("Content-Type")
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
 
-		b, err := json.Marshal(&trip)
+		query.renderTimes(result)
+
+		b, err := json.Marshal(result[0])
 		if err != nil {
 			fmt.Println(err)
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write(createErrorJSON(fmt.Errorf("internal server error")))
+			writeError(w, r, http.StatusInternalServerError, fmt.Errorf("internal server error"))
 			return
 		}
 
@@ -156,45 +156,68 @@ func GetTripByID(client *firestore.Client) func(w http.ResponseWriter, r *http.R
 	}
 }
 
-func GetLatestTrip(client *firestore.Client) func(w http.ResponseWriter, r *http.Request) {
+// findTrips returns the Trips of filter with id, which may be a legacy
+// ID: the ID of a Trip created before IDs were ULIDs, or the LegacyID of a
+// newer one, so integrations that build it from the Trip's time find both.
+// Trips created on the same second have the same LegacyID, the first one
+// is returned first.
+func findTrips(ctx context.Context, trips store.TripStore, filter store.TripFilter, id string) ([]*models.Trip, error) {
+	filter.ID = id
+	result, _, err := trips.GetTrips(ctx, filter)
+	if err != nil || len(result) > 0 || !models.IsLegacyTripID(id) {
+		return result, err
+	}
+
+	filter.ID = ""
+	filter.LegacyID = id
+	filter.Ascending = true
+	result, _, err = trips.GetTrips(ctx, filter)
+
+	return result, err
+}
+
+func GetLatestTrip(trips store.TripStore) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 
-		r.ParseForm()
+		query := newQueryParser(r, fieldsParams, timeZoneParams)
 
 		r.Form.Del("id")
 		r.Form.Del("has_load")
 		r.Form.Del("vehicle_type")
 		r.Form.Del("from")
 		r.Form.Del("to")
+		deleteAreaParams(r)
 
 		cpf := mux.Vars(r)["cpf"]
 		r.Form.Set("driver_id", cpf)
 		r.Form.Set("order", "desc")
 		r.Form.Set("limit", "1")
 
-		q := createTripsQuery(client, r)
-		doc, err := q.Documents(r.Context()).Next()
-		if err == iterator.Done {
-			w.WriteHeader(http.StatusNotFound)
-			w.Write(createErrorJSON(fmt.Errorf("no trip found for driver=%s", cpf)))
+		filter := createTripsFilter(query)
+		if err := query.Err(); err != nil {
+			writeError(w, r, http.StatusBadRequest, err)
 			return
 		}
+		query.setPreferenceApplied(w)
 
-		var trip models.Trip
-		err = doc.DataTo(&trip)
+		result, _, err := trips.GetTrips(r.Context(), filter)
 		if err != nil {
 			fmt.Println(err)
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write(createErrorJSON(fmt.Errorf("internal server error")))
+			writeError(w, r, http.StatusInternalServerError, fmt.Errorf("internal server error"))
 			return
 		}
+		if len(result) == 0 {
+			writeError(w, r, http.StatusNotFound, fmt.Errorf("no trip found for driver=%s", cpf))
+			return
+		}
+
+		query.renderTimes(result)
 
-		b, err := json.Marshal(&trip)
+		b, err := json.Marshal(result[0])
 		if err != nil {
 			fmt.Println(err)
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write(createErrorJSON(fmt.Errorf("internal server error")))
+			writeError(w, r, http.StatusInternalServerError, fmt.Errorf("internal server error"))
 			return
 		}
 
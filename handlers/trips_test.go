@@ -0,0 +1,221 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/genproto/googleapis/type/latlng"
+
+	"github.com/rafaft/truck-pad/models"
+	"github.com/rafaft/truck-pad/store"
+)
+
+func testTripJSON(cpf, tripTime string, hasLoad bool) string {
+	load := "false"
+	if hasLoad {
+		load = "true"
+	}
+
+	return `{"driver_id":"` + cpf + `","has_load":` + load + `,"vehicle_type":1,"time":"` + tripTime + `",` +
+		`"origin":{"latitude":-23.55,"longitude":-46.63},"destination":{"latitude":-22.9,"longitude":-43.2}}`
+}
+
+// addTestTrip adds a Trip through POST /trips and returns it
+func addTestTrip(t *testing.T, router http.Handler, cpf, tripTime string, hasLoad bool) *models.Trip {
+	t.Helper()
+
+	w := serve(router, "POST", "/trips", testTripJSON(cpf, tripTime, hasLoad))
+	expectStatus(t, w, http.StatusCreated)
+
+	var trip models.Trip
+	decodeBody(t, w, &trip)
+	return &trip
+}
+
+func TestAddTrip(t *testing.T) {
+	router := newTestRouter(store.NewMemoryStore())
+
+	trip := addTestTrip(t, router, testCPF, "2020-02-14T15:00:00Z", true)
+	if len(trip.ID) != 26 {
+		t.Fatalf("got id %q, want a ULID", trip.ID)
+	}
+	if location := tripLocation(trip); location != "/drivers/"+testCPF+"/trips/"+trip.ID {
+		t.Errorf("got location %q", location)
+	}
+
+	w := serve(router, "POST", "/drivers/"+otherTestCPF+"/trips", testTripJSON(testCPF, "2020-02-14T15:00:00Z", true))
+	expectStatus(t, w, http.StatusCreated)
+
+	var byDriver models.Trip
+	decodeBody(t, w, &byDriver)
+	if string(*byDriver.DriverID) != otherTestCPF {
+		t.Errorf("got driver_id %s, want the path's %s", *byDriver.DriverID, otherTestCPF)
+	}
+}
+
+func TestAddTripConflict(t *testing.T) {
+	router := newTestRouter(store.NewMemoryStore())
+	addTestTrip(t, router, testCPF, "2020-02-14T15:00:00Z", true)
+
+	// the same time on another offset is the same Trip
+	w := serve(router, "POST", "/trips", testTripJSON(testCPF, "2020-02-14T12:00:00-03:00", false))
+	expectStatus(t, w, http.StatusConflict)
+	w = serve(router, "POST", "/drivers/"+testCPF+"/trips", testTripJSON(testCPF, "2020-02-14T15:00:00Z", false))
+	expectStatus(t, w, http.StatusConflict)
+
+	// but not for another Driver
+	addTestTrip(t, router, otherTestCPF, "2020-02-14T15:00:00Z", true)
+}
+
+func TestGetAllTripsFilters(t *testing.T) {
+	router := newTestRouter(store.NewMemoryStore())
+	first := addTestTrip(t, router, testCPF, "2020-01-01T10:00:00Z", true)
+	second := addTestTrip(t, router, testCPF, "2020-02-01T10:00:00Z", false)
+	third := addTestTrip(t, router, otherTestCPF, "2020-03-01T10:00:00Z", false)
+
+	tests := []struct {
+		query string
+		ids   []string
+	}{
+		{"", []string{third.ID, second.ID, first.ID}},
+		{"?order=asc", []string{first.ID, second.ID, third.ID}},
+		{"?driver_id=" + testCPF, []string{second.ID, first.ID}},
+		{"?has_load=false", []string{third.ID, second.ID}},
+		{"?from=2020-01-15&to=2020-02-15", []string{second.ID}},
+		{"?from=2020-02-01T07:00:00-03:00", []string{third.ID, second.ID}},
+		{"?limit=1", []string{third.ID}},
+	}
+	for _, test := range tests {
+		w := serve(router, "GET", "/trips"+test.query, "")
+		expectStatus(t, w, http.StatusOK)
+
+		var trips []*models.Trip
+		decodeBody(t, w, &trips)
+		if len(trips) != len(test.ids) {
+			t.Errorf("%s: got %d trips, want %d", test.query, len(trips), len(test.ids))
+			continue
+		}
+		for i, trip := range trips {
+			if trip.ID != test.ids[i] {
+				t.Errorf("%s: got trip %d %s, want %s", test.query, i, trip.ID, test.ids[i])
+			}
+		}
+	}
+
+	for _, query := range []string{"?has_load=maybe", "?unknown=1", "?limit=2&page_size=2"} {
+		expectStatus(t, serve(router, "GET", "/trips"+query, ""), http.StatusBadRequest)
+	}
+}
+
+func TestGetTripByULID(t *testing.T) {
+	router := newTestRouter(store.NewMemoryStore())
+	trip := addTestTrip(t, router, testCPF, "2020-02-14T15:00:00Z", true)
+
+	for _, path := range []string{"/trips/" + trip.ID, "/drivers/" + testCPF + "/trips/" + trip.ID} {
+		w := serve(router, "GET", path, "")
+		expectStatus(t, w, http.StatusOK)
+
+		var got models.Trip
+		decodeBody(t, w, &got)
+		if got.ID != trip.ID {
+			t.Errorf("%s: got trip %s", path, got.ID)
+		}
+	}
+
+	// a Trip is only found under it's own Driver
+	expectStatus(t, serve(router, "GET", "/drivers/"+otherTestCPF+"/trips/"+trip.ID, ""), http.StatusNotFound)
+	expectStatus(t, serve(router, "GET", "/trips/01E1199GJ0VM7HF4AQGJRPE0V3", ""), http.StatusNotFound)
+}
+
+func TestGetTripByLegacyID(t *testing.T) {
+	db := store.NewMemoryStore()
+	router := newTestRouter(db)
+
+	// legacy IDs are the Trip's time on the offset it was sent with
+	tripTime := time.Date(2019, 6, 1, 12, 0, 0, 0, time.FixedZone("-03", -3*60*60))
+	driverID := models.DriverID(testCPF)
+	hasLoad := true
+	vehicleType := models.VehicleType(1)
+	legacy := &models.Trip{
+		ID:          tripTime.Format("20060102150405"),
+		DriverID:    &driverID,
+		HasLoad:     &hasLoad,
+		VehicleType: &vehicleType,
+		Time:        &tripTime,
+		Origin:      &latlng.LatLng{Latitude: -23.55, Longitude: -46.63},
+		Destination: &latlng.LatLng{Latitude: -22.9, Longitude: -43.2},
+	}
+	if err := db.AddTrip(context.Background(), legacy); err != nil {
+		t.Fatal(err)
+	}
+
+	w := serve(router, "GET", "/drivers/"+testCPF+"/trips/20190601120000", "")
+	expectStatus(t, w, http.StatusOK)
+
+	var got models.Trip
+	decodeBody(t, w, &got)
+	if got.ID != legacy.ID {
+		t.Errorf("got trip %s, want %s", got.ID, legacy.ID)
+	}
+
+	// the same instant in UTC isn't the Trip's ID
+	expectStatus(t, serve(router, "GET", "/drivers/"+testCPF+"/trips/20190601150000", ""), http.StatusNotFound)
+	expectStatus(t, serve(router, "GET", "/drivers/"+otherTestCPF+"/trips/20190601120000", ""), http.StatusNotFound)
+}
+
+func TestTripsOfInvalidCPF(t *testing.T) {
+	router := newTestRouter(store.NewMemoryStore())
+	// registered before the check digits were validated
+	const invalidCPF = "48372162001"
+
+	// the body's driver_id is ignored, even if invalid
+	w := serve(router, "POST", "/drivers/"+invalidCPF+"/trips", testTripJSON(invalidCPF, "2020-02-14T15:00:00Z", true))
+	expectStatus(t, w, http.StatusCreated)
+	// a models.Trip would validate the driver_id
+	var trip struct {
+		ID string `json:"id"`
+	}
+	decodeBody(t, w, &trip)
+
+	for _, path := range []string{
+		"/drivers/" + invalidCPF + "/trips",
+		"/drivers/" + invalidCPF + "/trips/latest",
+		"/drivers/" + invalidCPF + "/trips/" + trip.ID,
+		"/trips?driver_id=" + invalidCPF,
+		"/trips?driver_id=483.721.620-01",
+	} {
+		w = serve(router, "GET", path, "")
+		expectStatus(t, w, http.StatusOK)
+		if !strings.Contains(w.Body.String(), trip.ID) {
+			t.Errorf("%s: got %s, want trip %s", path, w.Body, trip.ID)
+		}
+	}
+
+	// but new Trips with it on the body are still rejected
+	expectStatus(t, serve(router, "POST", "/trips", testTripJSON(invalidCPF, "2020-02-14T16:00:00Z", true)), http.StatusBadRequest)
+	expectStatus(t, serve(router, "GET", "/trips?driver_id=4837216200", ""), http.StatusBadRequest)
+}
+
+func TestGetTripByTimestampID(t *testing.T) {
+	forEachTestStore(t, func(t *testing.T, db store.Store) {
+		router := newTestRouter(db)
+		// integrations build the legacy ID from the time they sent
+		trip := addTestTrip(t, router, testCPF, "2020-02-14T12:00:00-03:00", true)
+		addTestTrip(t, router, testCPF, "2020-02-14T15:00:01Z", true)
+
+		w := serve(router, "GET", "/drivers/"+testCPF+"/trips/20200214120000", "")
+		expectStatus(t, w, http.StatusOK)
+		var got models.Trip
+		decodeBody(t, w, &got)
+		if got.ID != trip.ID {
+			t.Errorf("got trip %s, want %s", got.ID, trip.ID)
+		}
+
+		// the same instant on another offset isn't it's legacy ID
+		expectStatus(t, serve(router, "GET", "/drivers/"+testCPF+"/trips/20200214150000", ""), http.StatusNotFound)
+		expectStatus(t, serve(router, "GET", "/drivers/"+otherTestCPF+"/trips/20200214120000", ""), http.StatusNotFound)
+	})
+}
@@ -8,127 +8,299 @@ import (
 	"strings"
 	"time"
 
-	"cloud.google.com/go/firestore"
 	"github.com/gorilla/mux"
 
+	"github.com/rafaft/truck-pad/geo"
 	"github.com/rafaft/truck-pad/models"
+	"github.com/rafaft/truck-pad/store"
 )
 
 const ISO8601 = "2006-01-02"
 
-func createDriversQuery(client *firestore.Client, r *http.Request) firestore.Query {
-	q := client.Collection("drivers").Query
+// page size used when only a page token is given, and the maximum page size
+const defaultPageSize = 100
+const maxPageSize = 1000
+
+func createDriversFilter(p *queryParser) store.DriverFilter {
+	var filter store.DriverFilter
+	r := p.r
 
 	// cpf will only exists if it's the getDriver`s route
 	if cpf, exist := mux.Vars(r)["cpf"]; exist {
-		q = q.Where("cpf", "==", cpf) // TODO: query for the document ID
+		filter.CPF = cpf
 	}
 	if gender := r.Form.Get("gender"); len(gender) > 0 {
-		q = q.Where("gender", "==", strings.ToUpper(gender))
+		filter.Gender = strings.ToUpper(gender)
+		if len(gender) != 1 || !strings.Contains("FMO", filter.Gender) {
+			p.invalid("gender", models.RuleEnum, "'gender' must be 'F', 'M' or 'O'")
+		}
 	}
 	if str_has_vehicle := r.Form.Get("has_vehicle"); len(str_has_vehicle) > 0 {
 		has_vehicle, err := strconv.ParseBool(str_has_vehicle)
 		if err == nil {
-			q = q.Where("has_vehicle", "==", has_vehicle)
+			filter.HasVehicle = &has_vehicle
+		} else {
+			p.invalid("has_vehicle", models.RuleType, "'has_vehicle' must be a boolean")
 		}
 	}
 	if cnh_type := r.Form.Get("cnh_type"); len(cnh_type) > 0 {
-		q = q.Where("cnh_type", "==", strings.ToUpper(cnh_type))
+		filter.CNHType = strings.ToUpper(cnh_type)
+		if len(cnh_type) != 1 || !strings.Contains("ABCDE", filter.CNHType) {
+			p.invalid("cnh_type", models.RuleEnum, "'cnh_type' must be 'A', 'B', 'C', 'D' or 'E'")
+		}
 	}
 
 	// get only requested fields
-	if rawFields := r.Form.Get("fields"); len(rawFields) > 0 {
-		splitFields := strings.Split(rawFields, ",")
+	if fields := p.parseFields(driverFields); len(fields) > 0 {
 		// always get birth_date, because it's necessary for calculating
 		// the age, remove it later if necessary
-		fields := []string{
-			"birth_date",
-		}
-		for _, field := range splitFields {
-			if len(field) > 0 {
-				fields = append(fields, field)
-			}
-		}
-
-		q = q.Select(fields...)
+		filter.Fields = append([]string{"birth_date"}, fields...)
 	}
 
-	return q
+	return filter
 }
 
-func createTripsQuery(client *firestore.Client, r *http.Request) firestore.Query {
-	// TODO: Since I query "trips" always by using Collection Group, I
-	// 	should probably organize trips as a top level collection
-	//  https://firebase.googleblog.com/2019/06/understanding-collection-group-queries.html
-	q := client.CollectionGroup("trips").Query
+func createTripsFilter(p *queryParser) store.TripFilter {
+	var filter store.TripFilter
+	r := p.r
 
 	// add filters
+	// the check digits aren't validated, to find the Trips of Drivers
+	// registered before they were
 	if driver_id := r.Form.Get("driver_id"); len(driver_id) > 0 {
-		q = q.Where("driver_id", "==", driver_id)
+		var ok bool
+		if filter.DriverID, ok = models.CPFDigits(driver_id); !ok {
+			p.invalid("driver_id", models.RuleCPF, "invalid value for 'driver_id' (must be a CPF)")
+		}
 	}
 	if id := r.Form.Get("id"); len(id) > 0 {
-		q = q.Where("id", "==", id)
+		filter.ID = id
 	}
 	if str_has_load := r.Form.Get("has_load"); len(str_has_load) > 0 {
 		has_load, err := strconv.ParseBool(str_has_load)
 		if err == nil {
-			q = q.Where("has_load", "==", has_load)
+			filter.HasLoad = &has_load
+		} else {
+			p.invalid("has_load", models.RuleType, "'has_load' must be a boolean")
 		}
 	}
 	if str_vehicle_type := r.Form.Get("vehicle_type"); len(str_vehicle_type) > 0 {
 		vehicle_type, err := strconv.Atoi(str_vehicle_type)
-		if err == nil {
-			q = q.Where("vehicle_type", "==", vehicle_type)
+		if err == nil && vehicle_type >= 1 && vehicle_type <= 5 {
+			filter.VehicleType = &vehicle_type
+		} else {
+			p.invalid("vehicle_type", models.RuleEnum, "'vehicle_type' must be 1, 2, 3, 4 or 5")
 		}
 	}
-	if strFrom := r.Form.Get("from"); len(strFrom) > 0 {
-		from, err := time.Parse(ISO8601, strFrom)
-		if err == nil {
-			q = q.Where("time", ">=", from)
-		}
-	}
-	if strTo := r.Form.Get("to"); len(strTo) > 0 {
-		to, err := time.Parse(ISO8601, strTo)
-		if err == nil {
-			q = q.Where("time", "<", to)
+	filter.From = p.parseTime("from")
+	filter.To = p.parseTime("to")
+	filter.Origin = parseArea(p, "origin")
+	filter.Destination = parseArea(p, "destination")
+	if order := r.Form.Get("order"); len(order) > 0 {
+		switch strings.ToLower(order) {
+		case "asc":
+			filter.Ascending = true
+		case "desc":
+		default:
+			p.invalid("order", models.RuleEnum, "'order' must be 'asc' or 'desc'")
 		}
 	}
-	// TODO: add query by origin and destination on lat and lng values
-	if order := r.Form.Get("order"); strings.ToLower(order) == "asc" {
-		q = q.OrderBy("time", firestore.Asc)
-	} else {
-		q = q.OrderBy("time", firestore.Desc)
-	}
 	if str_limit := r.Form.Get("limit"); len(str_limit) > 0 {
 		limit, err := strconv.Atoi(str_limit)
-		if err == nil {
-			q = q.Limit(limit)
+		if err == nil && limit > 0 {
+			filter.Limit = limit
+		} else {
+			p.invalid("limit", models.RuleRange, "'limit' must be a positive integer")
 		}
 	}
 
 	// get only requested fields
-	if rawFields := r.Form.Get("fields"); len(rawFields) > 0 {
-		splitFields := strings.Split(rawFields, ",")
-		fields := make([]string, 0)
-		for _, field := range splitFields {
-			if len(field) > 0 {
-				fields = append(fields, field)
-			}
+	filter.Fields = p.parseFields(tripFields)
+
+	return filter
+}
+
+// parsePagination reads the "page_size" and "page_token" query parameters.
+// Pagination is optional, pageSize is 0 when neither is given (or
+// "page_size" is invalid on a lenient request without a token).
+func parsePagination(p *queryParser) (pageSize int, pageToken string) {
+	r := p.r
+	pageToken = r.Form.Get("page_token")
+
+	if strPageSize := r.Form.Get("page_size"); len(strPageSize) > 0 {
+		var err error
+		pageSize, err = strconv.Atoi(strPageSize)
+		if err != nil || pageSize < 1 || pageSize > maxPageSize {
+			p.invalid("page_size", models.RuleRange, fmt.Sprintf("'page_size' must be an integer from 1 to %d", maxPageSize))
+			pageSize = 0
 		}
+	}
+	if pageSize == 0 && len(pageToken) > 0 {
+		pageSize = defaultPageSize
+	}
+
+	// lenient requests are paginated, "limit" is ignored by the stores
+	if pageSize > 0 && len(r.Form.Get("limit")) > 0 {
+		p.invalid("limit", models.RuleExclusive, "'limit' cannot be used with 'page_size' or 'page_token'")
+	}
+
+	return pageSize, pageToken
+}
 
-		q = q.Select(fields...)
+// setNextPageLink adds a Link header (RFC 8288) to the next page, which is
+// the same request with "page_token" set
+func setNextPageLink(w http.ResponseWriter, r *http.Request, nextPageToken string) {
+	if len(nextPageToken) == 0 {
+		return
 	}
 
-	return q
+	query := r.URL.Query()
+	query.Set("page_token", nextPageToken)
+	w.Header().Set("Link", fmt.Sprintf(`<%s?%s>; rel="next"`, r.URL.Path, query.Encode()))
 }
 
-func createErrorJSON(e error) []byte {
-	output := models.ErrorJSON{
-		Error: e.Error(),
+// parseArea reads an area from either the "<prefix>_near=lat,lng" and
+// "<prefix>_radius_km" query parameters or "<prefix>_bbox=minLat,minLng,maxLat,maxLng"
+func parseArea(p *queryParser, prefix string) *geo.Area {
+	r := p.r
+
+	if near := r.Form.Get(prefix + "_near"); len(near) > 0 {
+		point, ok := parseCoordinates(near, 2)
+		if !ok {
+			p.invalid(prefix+"_near", models.RuleFormat, fmt.Sprintf("'%s_near' must be <lat>,<lng>", prefix))
+			return nil
+		}
+		radius, err := strconv.ParseFloat(r.Form.Get(prefix+"_radius_km"), 64)
+		if err != nil || radius <= 0 {
+			p.invalid(prefix+"_radius_km", models.RuleRange, fmt.Sprintf("'%s_radius_km' must be a positive number", prefix))
+			return nil
+		}
+
+		return geo.NewCircle(point[0], point[1], radius)
+	}
+
+	if bbox := r.Form.Get(prefix + "_bbox"); len(bbox) > 0 {
+		box, ok := parseCoordinates(bbox, 4)
+		if !ok || box[0] > box[2] {
+			p.invalid(prefix+"_bbox", models.RuleFormat, fmt.Sprintf("'%s_bbox' must be <minLat>,<minLng>,<maxLat>,<maxLng>", prefix))
+			return nil
+		}
+
+		return geo.NewBox(geo.BoundingBox{
+			MinLat: box[0],
+			MinLng: box[1],
+			MaxLat: box[2],
+			MaxLng: box[3],
+		})
 	}
 
-	content, _ := json.Marshal(&output)
-	return content
+	if len(r.Form.Get(prefix+"_radius_km")) > 0 {
+		p.invalid(prefix+"_radius_km", models.RuleRequired, fmt.Sprintf("'%s_radius_km' requires '%s_near'", prefix, prefix))
+	}
+
+	return nil
+}
+
+// deleteAreaParams removes the query parameters read by parseArea
+func deleteAreaParams(r *http.Request) {
+	for _, prefix := range []string{"origin", "destination"} {
+		r.Form.Del(prefix + "_near")
+		r.Form.Del(prefix + "_radius_km")
+		r.Form.Del(prefix + "_bbox")
+	}
+}
+
+// parseCoordinates parses n comma separated (lat,lng) pairs of numbers
+func parseCoordinates(s string, n int) ([]float64, bool) {
+	parts := strings.Split(s, ",")
+	if len(parts) != n {
+		return nil, false
+	}
+
+	values := make([]float64, n)
+	for i, part := range parts {
+		value, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return nil, false
+		}
+
+		// latitudes are on even positions, longitudes on odd positions
+		if (i%2 == 0 && (value < -90 || value > 90)) ||
+			(i%2 == 1 && (value < -180 || value > 180)) {
+			return nil, false
+		}
+		values[i] = value
+	}
+
+	return values, true
+}
+
+// driverLocation is the URL path of a Driver
+func driverLocation(cpf string) string {
+	return "/drivers/" + cpf
+}
+
+// tripLocation is the URL path of a Trip, under it's Driver
+func tripLocation(trip *models.Trip) string {
+	return fmt.Sprintf("/drivers/%s/trips/%s", *trip.DriverID, trip.ID)
+}
+
+// writeResource writes the stored representation of a resource and it's
+// URL path on the Location header
+func writeResource(w http.ResponseWriter, r *http.Request, status int, location string, resource interface{}) {
+	b, err := json.Marshal(resource)
+	if err != nil {
+		fmt.Println(err)
+		writeError(w, r, http.StatusInternalServerError, fmt.Errorf("internal server error"))
+		return
+	}
+
+	w.Header().Set("Location", location)
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+// problemCodes are the stable error codes of each status code
+var problemCodes = map[int]string{
+	http.StatusBadRequest:            "bad_request",
+	http.StatusUnauthorized:          "unauthorized",
+	http.StatusForbidden:             "forbidden",
+	http.StatusNotFound:              "not_found",
+	http.StatusConflict:              "conflict",
+	http.StatusPreconditionFailed:    "precondition_failed",
+	http.StatusRequestEntityTooLarge: "payload_too_large",
+	http.StatusTooManyRequests:       "too_many_requests",
+	http.StatusInternalServerError:   "internal_error",
+}
+
+// writeError writes e as RFC 7807 problem details with the given status.
+// A models.ValidationError has it's Violations listed on the response.
+func writeError(w http.ResponseWriter, r *http.Request, status int, e error) {
+	problem := models.Problem{
+		Type:     "about:blank",
+		Title:    http.StatusText(status),
+		Status:   status,
+		Code:     problemCodes[status],
+		Detail:   e.Error(),
+		Instance: r.URL.Path,
+	}
+	if len(problem.Code) == 0 {
+		problem.Code = strings.ToLower(strings.ReplaceAll(problem.Title, " ", "_"))
+	}
+	switch err := e.(type) {
+	case *models.ValidationError:
+		problem.Code = "validation_failed"
+		problem.Detail = "the request has invalid fields"
+		problem.Violations = err.Violations
+	case *json.SyntaxError:
+		problem.Code = "malformed_json"
+	}
+
+	content, _ := json.Marshal(&problem)
+
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	w.Write(content)
 }
 
 func calculateAge(birthDate, now time.Time) int {
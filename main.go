@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
@@ -10,44 +11,148 @@ import (
 	"github.com/gorilla/mux"
 
 	"github.com/rafaft/truck-pad/handlers"
+	"github.com/rafaft/truck-pad/models"
+	"github.com/rafaft/truck-pad/store"
 )
 
+// Trip IDs are ULIDs, but Trips created before that have a 14 digits
+// timestamp ID, which is only unique per Driver
+const ulidPattern = `[0-9A-HJKMNP-TV-Z]{26}`
+const tripIDPattern = `\d{14}|` + ulidPattern
+
 var ctx context.Context
-var client *firestore.Client
 var router *mux.Router
 
 func init() {
-	var err error
-
-	os.Setenv("GOOGLE_APPLICATION_CREDENTIALS", "firestore-credentials.json")
-
 	ctx = context.Background()
-	client, err = firestore.NewClient(ctx, "truck-pad")
+
+	db, err := newStore(os.Getenv("STORE"))
 	if err != nil {
 		panic(err)
 	}
 
+	// old clients that can't send "Prefer: handling=lenient"
+	handlers.LenientQueries = os.Getenv("QUERY_HANDLING") == "lenient"
+
+	// an admin API key that isn't stored, to create the first keys
+	handlers.AdminAPIKey = os.Getenv("ADMIN_API_KEY")
+
+	// bearer tokens issued by the mobile app
+	if secret, jwksFile := os.Getenv("JWT_HS256_SECRET"), os.Getenv("JWT_JWKS_FILE"); secret != "" || jwksFile != "" {
+		handlers.BearerTokens, err = handlers.NewJWTValidator(secret, jwksFile)
+		if err != nil {
+			panic(err)
+		}
+		handlers.BearerTokens.Issuer = os.Getenv("JWT_ISSUER")
+		handlers.BearerTokens.Audience = os.Getenv("JWT_AUDIENCE")
+		if claim := os.Getenv("JWT_ROLE_CLAIM"); claim != "" {
+			handlers.BearerTokens.RoleClaim = claim
+		}
+		if claim := os.Getenv("JWT_CPF_CLAIM"); claim != "" {
+			handlers.BearerTokens.CPFClaim = claim
+		}
+	}
+
+	// roles allowed on each route, besides admins, who are allowed on all
+	// of them
+	var (
+		readers   = []models.Role{models.RoleDispatcher}
+		terminals = []models.Role{models.RoleTerminal}
+		admins    []models.Role
+		// drivers may only access the routes of their own CPF
+		driverReaders   = []models.Role{models.RoleDispatcher, models.RoleDriver}
+		driverTerminals = []models.Role{models.RoleTerminal, models.RoleDriver}
+	)
+
+	// requests per client and body sizes of each class of routes, a copy
+	// of the defaults for RATE_LIMITS to override
+	routeLimits := make(map[string]handlers.RouteLimits)
+	for class, limits := range handlers.DefaultRouteLimits {
+		routeLimits[class] = limits
+	}
+	if err = handlers.ParseRateLimits(os.Getenv("RATE_LIMITS"), routeLimits); err != nil {
+		panic(err)
+	}
+	handlers.TrustProxy = os.Getenv("TRUST_PROXY") == "true"
+	limiter := handlers.NewRateLimiter(routeLimits)
+
+	// route applies the limits of class to h, and only lets roles call it
+	route := func(class string, roles []models.Role, h func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+		return limiter.Limit(class, handlers.Authorize(roles, h))
+	}
+
 	router = mux.NewRouter()
+	router.Use(limiter.LimitAuthFailures(), handlers.Authenticate(db))
 
 	router.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("Docs..."))
 	})
 
 	// route for drivers
-	router.HandleFunc("/drivers", handlers.GetAllDrivers(client)).Methods("GET")
-	router.HandleFunc("/drivers", handlers.AddDriver(client)).Methods("POST")
-	router.HandleFunc(`/drivers/{cpf:\d{11}}`, handlers.GetDriver(client)).Methods("GET")
-	router.HandleFunc(`/drivers/{cpf:\d{11}}`, handlers.UpdateDriver(client)).Methods("PATCH")
+	router.HandleFunc("/drivers", route("read", readers, handlers.GetAllDrivers(db))).Methods("GET")
+	router.HandleFunc("/drivers", route("write", admins, handlers.AddDriver(db))).Methods("POST")
+	router.HandleFunc("/drivers:import", route("batch", admins, handlers.ImportDrivers(db))).Methods("POST")
+	router.HandleFunc(`/drivers/{cpf:\d{11}}`, route("read", driverReaders, handlers.GetDriver(db))).Methods("GET")
+	router.HandleFunc(`/drivers/{cpf:\d{11}}`, route("write", readers, handlers.UpdateDriver(db))).Methods("PATCH")
+	router.HandleFunc(`/drivers/{cpf:\d{11}}`, route("write", admins, handlers.DeleteDriver(db))).Methods("DELETE")
+	router.HandleFunc(`/drivers/{cpf:\d{11}}/history`, route("read", driverReaders, handlers.GetDriverHistory(db))).Methods("GET")
 
 	// route for trips by driver
-	router.HandleFunc(`/drivers/{cpf:\d{11}}/trips`, handlers.GetTripsByDriver(client)).Methods("GET")
-	router.HandleFunc(`/drivers/{cpf:\d{11}}/trips`, handlers.AddTripByDriver(client)).Methods("POST")
-	router.HandleFunc(`/drivers/{cpf:\d{11}}/trips/{id:\d{14}}`, handlers.GetTripByID(client)).Methods("GET")
-	router.HandleFunc(`/drivers/{cpf:\d{11}}/trips/latest`, handlers.GetLatestTrip(client)).Methods("GET")
+	router.HandleFunc(`/drivers/{cpf:\d{11}}/trips`, route("read", driverReaders, handlers.GetTripsByDriver(db))).Methods("GET")
+	router.HandleFunc(`/drivers/{cpf:\d{11}}/trips`, route("write", driverTerminals, handlers.Idempotent(db, handlers.AddTripByDriver(db)))).Methods("POST")
+	router.HandleFunc(`/drivers/{cpf:\d{11}}/trips/{id:`+tripIDPattern+`}`, route("read", driverReaders, handlers.GetTripByID(db))).Methods("GET")
+	router.HandleFunc(`/drivers/{cpf:\d{11}}/trips/{id:`+tripIDPattern+`}`, route("write", terminals, handlers.UpdateTrip(db))).Methods("PATCH")
+	router.HandleFunc(`/drivers/{cpf:\d{11}}/trips/{id:`+tripIDPattern+`}`, route("write", terminals, handlers.DeleteTrip(db))).Methods("DELETE")
+	router.HandleFunc(`/drivers/{cpf:\d{11}}/trips/{id:`+tripIDPattern+`}/corrections`, route("read", driverReaders, handlers.GetTripCorrections(db))).Methods("GET")
+	router.HandleFunc(`/drivers/{cpf:\d{11}}/trips/latest`, route("read", driverReaders, handlers.GetLatestTrip(db))).Methods("GET")
 
 	// route for trips
-	router.HandleFunc("/trips", handlers.GetAllTrips(client)).Methods("GET")
-	router.HandleFunc("/trips", handlers.AddTrip(client)).Methods("POST")
+	router.HandleFunc("/trips", route("read", readers, handlers.GetAllTrips(db))).Methods("GET")
+	router.HandleFunc("/trips", route("write", terminals, handlers.Idempotent(db, handlers.AddTrip(db)))).Methods("POST")
+	// batches aren't Idempotent, their reports are too large to keep and a
+	// retry reports the Trips already added as duplicates
+	router.HandleFunc("/trips:batch", route("batch", terminals, handlers.AddTripsBatch(db))).Methods("POST")
+	router.HandleFunc(`/trips/{id:`+ulidPattern+`}`, route("read", readers, handlers.GetTrip(db))).Methods("GET")
+
+	// route for return load matching
+	router.HandleFunc("/matches", route("read", readers, handlers.GetMatches(db, db))).Methods("GET")
+
+	// route for API keys
+	router.HandleFunc("/api-keys", route("read", admins, handlers.GetAPIKeys(db))).Methods("GET")
+	router.HandleFunc("/api-keys", route("write", admins, handlers.AddAPIKey(db))).Methods("POST")
+	router.HandleFunc(`/api-keys/{id:`+ulidPattern+`}`, route("write", admins, handlers.DeleteAPIKey(db))).Methods("DELETE")
+}
+
+// newStore creates the persistence layer selected by the STORE
+// environment variable ("firestore", the default, "memory" or "sqlite")
+func newStore(kind string) (store.Store, error) {
+	switch kind {
+	case "memory":
+		return store.NewMemoryStore(), nil
+	case "sqlite":
+		path := os.Getenv("SQLITE_PATH")
+		if path == "" {
+			path = "truck-pad.db"
+		}
+
+		return store.NewSQLiteStore(path)
+	case "", "firestore":
+		os.Setenv("GOOGLE_APPLICATION_CREDENTIALS", "firestore-credentials.json")
+
+		layout, err := store.ParseTripsLayout(os.Getenv("FIRESTORE_TRIPS_LAYOUT"))
+		if err != nil {
+			return nil, err
+		}
+
+		client, err := firestore.NewClient(ctx, "truck-pad")
+		if err != nil {
+			return nil, err
+		}
+
+		return store.NewFirestoreStore(client, layout), nil
+	default:
+		return nil, fmt.Errorf("unknown STORE=%s", kind)
+	}
 }
 
 func main() {
@@ -0,0 +1,107 @@
+package models
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/oklog/ulid"
+)
+
+// Role is what a client is allowed to do
+type Role string
+
+const (
+	// RoleTerminal may only add Trips
+	RoleTerminal Role = "terminal"
+	// RoleDispatcher may read everything and update Drivers
+	RoleDispatcher Role = "dispatcher"
+	// RoleAdmin may do everything, including managing API keys
+	RoleAdmin Role = "admin"
+	// RoleDriver may only access it's own Driver and Trips. It's only
+	// given by bearer tokens, which have the Driver's CPF.
+	RoleDriver Role = "driver"
+)
+
+func (role *Role) UnmarshalJSON(b []byte) error {
+	var sRole string
+	json.Unmarshal(b, &sRole)
+
+	switch Role(sRole) {
+	case RoleTerminal, RoleDispatcher, RoleAdmin:
+		*role = Role(sRole)
+		return nil
+	}
+
+	return &Violation{Rule: RuleEnum, Message: "'role' must be 'terminal', 'dispatcher' or 'admin'"}
+}
+
+// apiKeyPrefix starts every API key, so leaked keys are easy to find
+const apiKeyPrefix = "tpk_"
+
+// APIKey identifies a client. Only the key's hash is stored, the key
+// itself is only known when it's created.
+type APIKey struct {
+	ID   string  `firestore:"id" json:"id"`
+	Name *string `firestore:"name" json:"name,omitempty"`
+	Role *Role   `firestore:"role" json:"role,omitempty"`
+	// Prefix is the beginning of the key, to tell keys apart
+	Prefix     string    `firestore:"prefix" json:"prefix"`
+	Hash       string    `firestore:"hash" json:"-"`
+	CreateTime time.Time `firestore:"create_time" json:"create_time"`
+}
+
+// UnmarshalJSON decodes every field of an APIKey, returning a
+// ValidationError with all the invalid ones
+func (k *APIKey) UnmarshalJSON(b []byte) error {
+	return decodeFields(b, []jsonField{
+		{"name", &k.Name},
+		{"role", &k.Role},
+	})
+}
+
+// ValidateAPIKey returns a ValidationError with all missing fields
+func (k *APIKey) ValidateAPIKey() error {
+	var errs ValidationError
+	if k.Name == nil {
+		errs.required("name")
+	}
+	if k.Role == nil {
+		errs.required("role")
+	}
+
+	return errs.Err()
+}
+
+// NewAPIKey decodes and validates an APIKey, and generates it's key,
+// which is returned apart, since it's not stored
+func NewAPIKey(b []byte) (*APIKey, string, error) {
+	var apiKey APIKey
+	err := MergeErrors(json.Unmarshal(b, &apiKey), apiKey.ValidateAPIKey())
+	if err != nil {
+		return nil, "", err
+	}
+
+	secret := make([]byte, 32)
+	if _, err = rand.Read(secret); err != nil {
+		return nil, "", err
+	}
+	key := apiKeyPrefix + base64.RawURLEncoding.EncodeToString(secret)
+
+	now := time.Now().UTC()
+	apiKey.ID = ulid.MustNew(ulid.Timestamp(now), rand.Reader).String()
+	apiKey.Prefix = key[:len(apiKeyPrefix)+6]
+	apiKey.Hash = HashAPIKey(key)
+	apiKey.CreateTime = now
+
+	return &apiKey, key, nil
+}
+
+// HashAPIKey is the hash an API key is stored and found by. Keys are
+// random, so a plain SHA-256 is enough (they can't be guessed from it).
+func HashAPIKey(key string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(key)))
+}
@@ -0,0 +1,62 @@
+package models
+
+// statuses of a BatchRow
+const (
+	RowCreated   = "created"
+	RowDuplicate = "duplicate"
+	RowInvalid   = "invalid"
+	RowUpdated   = "updated"
+	RowSkipped   = "skipped"
+)
+
+// BatchRow is the result of a row of a batch upload. Row is 1-based, not
+// counting a CSV's header.
+type BatchRow struct {
+	Row        int          `json:"row"`
+	Status     string       `json:"status"`
+	ID         string       `json:"id,omitempty"`
+	Reason     string       `json:"reason,omitempty"`
+	Violations []*Violation `json:"violations,omitempty"`
+}
+
+// BatchReport is the result of a batch upload, row by row, since rows
+// succeed or fail on their own. On a dry run, nothing was written, the
+// report is what would have happened.
+type BatchReport struct {
+	DryRun     bool        `json:"dry_run,omitempty"`
+	Created    int         `json:"created"`
+	Updated    int         `json:"updated,omitempty"`
+	Skipped    int         `json:"skipped,omitempty"`
+	Duplicates int         `json:"duplicates"`
+	Invalid    int         `json:"invalid"`
+	Rows       []*BatchRow `json:"rows"`
+}
+
+// Add adds the result of a row to the report
+func (r *BatchReport) Add(row *BatchRow) {
+	switch row.Status {
+	case RowCreated:
+		r.Created++
+	case RowDuplicate:
+		r.Duplicates++
+	case RowInvalid:
+		r.Invalid++
+	case RowUpdated:
+		r.Updated++
+	case RowSkipped:
+		r.Skipped++
+	}
+
+	r.Rows = append(r.Rows, row)
+}
+
+// Invalidate sets the row as invalid because of err, listing it's
+// Violations if it's a ValidationError
+func (row *BatchRow) Invalidate(err error) {
+	row.Status = RowInvalid
+	row.Reason = err.Error()
+	if validationErr, ok := err.(*ValidationError); ok {
+		row.Reason = "the row has invalid fields"
+		row.Violations = validationErr.Violations
+	}
+}
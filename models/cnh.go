@@ -2,7 +2,6 @@ package models
 
 import (
 	"encoding/json"
-	"fmt"
 	"strings"
 )
 
@@ -15,9 +14,31 @@ func (cnh *CNHType) UnmarshalJSON(b []byte) error {
 	sCNH = strings.ToUpper(sCNH)
 	validCNHTypes := "ABCDE"
 	if len(sCNH) != 1 || !strings.Contains(validCNHTypes, sCNH) {
-		return fmt.Errorf("'cnh_type' must be 'A', 'B', 'C', 'D' or 'E'")
+		return &Violation{Rule: RuleEnum, Message: "'cnh_type' must be 'A', 'B', 'C', 'D' or 'E'"}
 	}
 
 	*cnh = CNHType(sCNH)
 	return nil
 }
+
+// cnhRank orders the CNH types by the vehicles they allow driving: each
+// type allows driving everything the previous types do, except "A"
+// (motorcycles only)
+var cnhRank = map[CNHType]int{
+	"A": 0,
+	"B": 1,
+	"C": 2,
+	"D": 3,
+	"E": 4,
+}
+
+// CanDrive reports whether a Driver with this CNH type may drive vt.
+// Trucks require at least a "C" CNH and articulated vehicles an "E" CNH.
+func (cnh CNHType) CanDrive(vt VehicleType) bool {
+	required := CNHType("C")
+	if vt == SimpleTrailer || vt == ExtendedTrailer {
+		required = "E"
+	}
+
+	return cnh != "A" && cnhRank[cnh] >= cnhRank[required]
+}
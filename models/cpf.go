@@ -2,10 +2,13 @@ package models
 
 import (
 	"encoding/json"
-	"fmt"
 	"regexp"
+	"strings"
 )
 
+// a CPF may come with or without punctuation, e.g.: "483.721.620-00"
+var cpfRegex = regexp.MustCompile(`^\d{3}\.?\d{3}\.?\d{3}-?\d{2}$`)
+
 type CPF string
 
 func (cpf *CPF) UnmarshalJSON(b []byte) error {
@@ -15,14 +18,62 @@ func (cpf *CPF) UnmarshalJSON(b []byte) error {
 		return err
 	}
 
-	matched, err := regexp.MatchString(`^\d{11}$`, sCPF)
-	if err != nil {
-		return err
-	}
-	if !matched {
-		return fmt.Errorf("invalid value for 'CPF'")
+	normalized, ok := NormalizeCPF(sCPF)
+	if !ok {
+		return &Violation{Rule: RuleCPF, Message: "invalid value for 'CPF'"}
 	}
 
-	*cpf = CPF(sCPF)
+	*cpf = CPF(normalized)
 	return nil
 }
+
+// CPFDigits removes the punctuation from a CPF, without validating it's
+// check digits, returning only the eleven digits. Drivers registered
+// before the check digits were validated may have invalid CPFs, so it's
+// used to look them up, while new Drivers and Trips use NormalizeCPF.
+func CPFDigits(s string) (string, bool) {
+	if !cpfRegex.MatchString(s) {
+		return "", false
+	}
+
+	return strings.NewReplacer(".", "", "-", "").Replace(s), true
+}
+
+// NormalizeCPF removes the punctuation from a CPF and validates it's
+// check digits, returning only the eleven digits
+func NormalizeCPF(s string) (string, bool) {
+	digits, ok := CPFDigits(s)
+	if !ok {
+		return "", false
+	}
+
+	// sequences of the same digit pass the check digits validation,
+	// but are not valid CPFs
+	if strings.Count(digits, digits[:1]) == len(digits) {
+		return "", false
+	}
+
+	if cpfCheckDigit(digits[:9]) != digits[9] ||
+		cpfCheckDigit(digits[:10]) != digits[10] {
+		return "", false
+	}
+
+	return digits, true
+}
+
+// cpfCheckDigit calculates the check digit that follows the given digits
+func cpfCheckDigit(digits string) byte {
+	sum := 0
+	weight := len(digits) + 1
+	for _, digit := range digits {
+		sum += int(digit-'0') * weight
+		weight--
+	}
+
+	remainder := sum * 10 % 11
+	if remainder == 10 {
+		remainder = 0
+	}
+
+	return byte('0' + remainder)
+}
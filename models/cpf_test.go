@@ -0,0 +1,54 @@
+package models
+
+import "testing"
+
+func TestNormalizeCPF(t *testing.T) {
+	tests := []struct {
+		s     string
+		cpf   string
+		valid bool
+	}{
+		{"48372162000", "48372162000", true},
+		{"52998224725", "52998224725", true},
+		{"483.721.620-00", "48372162000", true},
+		{"483721620-00", "48372162000", true},
+		// repeated digits pass the check digits
+		{"00000000000", "", false},
+		{"111.111.111-11", "", false},
+		// wrong check digits
+		{"48372162001", "", false},
+		{"48372162010", "", false},
+		{"12345678900", "", false},
+		{"4837216200", "", false},
+		{"483.721.620.00", "", false},
+		{"4837216200a", "", false},
+		{"", "", false},
+	}
+	for _, test := range tests {
+		cpf, valid := NormalizeCPF(test.s)
+		if cpf != test.cpf || valid != test.valid {
+			t.Errorf("%q: got %q, %t, want %q, %t", test.s, cpf, valid, test.cpf, test.valid)
+		}
+	}
+}
+
+func TestCPFDigits(t *testing.T) {
+	tests := []struct {
+		s      string
+		digits string
+		ok     bool
+	}{
+		{"483.721.620-00", "48372162000", true},
+		// the check digits aren't validated
+		{"48372162001", "48372162001", true},
+		{"000.000.000-00", "00000000000", true},
+		{"4837216200", "", false},
+		{"483-721-620.00", "", false},
+	}
+	for _, test := range tests {
+		digits, ok := CPFDigits(test.s)
+		if digits != test.digits || ok != test.ok {
+			t.Errorf("%q: got %q, %t, want %q, %t", test.s, digits, ok, test.digits, test.ok)
+		}
+	}
+}
@@ -1,7 +1,7 @@
 package models
 
 import (
-	"fmt"
+	"encoding/json"
 	"time"
 )
 
@@ -14,18 +14,55 @@ type Driver struct {
 	Gender     *Gender    `firestore:"gender" json:"gender,omitempty"`
 	HasVehicle *bool      `firestore:"has_vehicle" json:"has_vehicle,omitempty"`
 	CNHType    *CNHType   `firestore:"cnh_type" json:"cnh_type,omitempty"`
+	// UpdateTime is set by the store, it's the version of the Driver
+	UpdateTime time.Time `firestore:"-" json:"-"`
 }
 
+// UnmarshalJSON decodes every field of a Driver, returning a
+// ValidationError with all the invalid ones
+func (d *Driver) UnmarshalJSON(b []byte) error {
+	return decodeFields(b, []jsonField{
+		{"cpf", &d.CPF},
+		{"name", &d.Name},
+		{"birth_date", &d.BirthDate},
+		{"gender", &d.Gender},
+		{"has_vehicle", &d.HasVehicle},
+		{"cnh_type", &d.CNHType},
+	})
+}
+
+// ValidateDriver returns a ValidationError with all missing fields
 func (d *Driver) ValidateDriver() error {
-	if d.CPF == nil ||
-		d.Name == nil ||
-		d.BirthDate == nil ||
-		d.Gender == nil ||
-		d.HasVehicle == nil ||
-		d.CNHType == nil {
-		fields := "['cpf', 'name', 'birth_date', 'gender', 'has_vehicle', 'cnh_type']"
-		return fmt.Errorf("Driver must have all fields: %s", fields)
+	var errs ValidationError
+	if d.CPF == nil {
+		errs.required("cpf")
+	}
+	if d.Name == nil {
+		errs.required("name")
+	}
+	if d.BirthDate == nil {
+		errs.required("birth_date")
+	}
+	if d.Gender == nil {
+		errs.required("gender")
+	}
+	if d.HasVehicle == nil {
+		errs.required("has_vehicle")
+	}
+	if d.CNHType == nil {
+		errs.required("cnh_type")
+	}
+
+	return errs.Err()
+}
+
+// NewDriver decodes and validates a Driver, aggregating all Violations
+func NewDriver(b []byte) (*Driver, error) {
+	var driver Driver
+	err := MergeErrors(json.Unmarshal(b, &driver), driver.ValidateDriver())
+	if err != nil {
+		return nil, err
 	}
 
-	return nil
+	return &driver, nil
 }
@@ -2,8 +2,6 @@ package models
 
 import (
 	"encoding/json"
-	"fmt"
-	"regexp"
 )
 
 type DriverID string
@@ -15,14 +13,11 @@ func (id *DriverID) UnmarshalJSON(b []byte) error {
 		return err
 	}
 
-	matched, err := regexp.MatchString(`^\d{11}$`, sID)
-	if err != nil {
-		return err
-	}
-	if !matched {
-		return fmt.Errorf("invalid value for 'driver_id' (must be valid CPF) ")
+	normalized, ok := NormalizeCPF(sID)
+	if !ok {
+		return &Violation{Rule: RuleCPF, Message: "invalid value for 'driver_id' (must be valid CPF)"}
 	}
 
-	*id = DriverID(sID)
+	*id = DriverID(normalized)
 	return nil
 }
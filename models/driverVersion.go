@@ -0,0 +1,46 @@
+package models
+
+import "time"
+
+// DriverVersion is a Driver's values from ValidFrom on, kept as it's
+// history. Versions are never changed once added.
+type DriverVersion struct {
+	// ValidFrom is the Driver's UpdateTime, when stores leave it zero
+	// Firestore sets it to the write's time
+	ValidFrom time.Time `firestore:"valid_from,serverTimestamp" json:"valid_from"`
+	// ValidTo is when the next version begins, nil for the current one.
+	// It isn't stored, it comes from the next version.
+	ValidTo *time.Time `firestore:"-" json:"valid_to,omitempty"`
+	Driver  *Driver    `firestore:"driver" json:"driver"`
+}
+
+// NewDriverVersion returns a version of driver from it's UpdateTime
+func NewDriverVersion(driver *Driver) *DriverVersion {
+	stored := *driver
+	stored.Age = 0
+
+	return &DriverVersion{ValidFrom: driver.UpdateTime, Driver: &stored}
+}
+
+// VersionAt returns the version of history valid at t, or nil if the
+// Driver didn't exist yet. history must be ordered oldest first.
+func VersionAt(history []*DriverVersion, t time.Time) *DriverVersion {
+	var version *DriverVersion
+	for _, v := range history {
+		if v.ValidFrom.After(t) {
+			break
+		}
+		version = v
+	}
+
+	return version
+}
+
+// SetValidTo sets the ValidTo of each version of history, ordered oldest
+// first, from the next one
+func SetValidTo(history []*DriverVersion) {
+	for i := 0; i+1 < len(history); i++ {
+		validTo := history[i+1].ValidFrom
+		history[i].ValidTo = &validTo
+	}
+}
@@ -0,0 +1,51 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestVersionAt(t *testing.T) {
+	first := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	second := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	history := []*DriverVersion{{ValidFrom: first}, {ValidFrom: second}}
+
+	tests := []struct {
+		t    time.Time
+		want *DriverVersion
+	}{
+		// the Driver didn't exist yet
+		{first.Add(-time.Nanosecond), nil},
+		// a version is valid from it's ValidFrom on
+		{first, history[0]},
+		{second.Add(-time.Nanosecond), history[0]},
+		{second, history[1]},
+		{second.AddDate(1, 0, 0), history[1]},
+		// on any offset
+		{second.In(time.FixedZone("", -3*60*60)), history[1]},
+	}
+	for _, test := range tests {
+		if version := VersionAt(history, test.t); version != test.want {
+			t.Errorf("%s: got %+v, want %+v", test.t, version, test.want)
+		}
+	}
+
+	if version := VersionAt(nil, second); version != nil {
+		t.Errorf("got %+v without history, want nil", version)
+	}
+}
+
+func TestSetValidTo(t *testing.T) {
+	first := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	second := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	history := []*DriverVersion{{ValidFrom: first}, {ValidFrom: second}}
+
+	SetValidTo(history)
+	if history[0].ValidTo == nil || !history[0].ValidTo.Equal(second) {
+		t.Errorf("got valid_to %v, want %s", history[0].ValidTo, second)
+	}
+	// the current version has no end
+	if history[1].ValidTo != nil {
+		t.Errorf("got valid_to %v on the current version, want nil", history[1].ValidTo)
+	}
+}
@@ -0,0 +1,16 @@
+package models
+
+import (
+	"time"
+)
+
+// ErasureReceipt is returned when a Driver's personal data is erased
+// (LGPD data subject request), as proof of what was done
+type ErasureReceipt struct {
+	ID              string    `json:"id"`
+	CPF             string    `json:"cpf"`
+	ErasedAt        time.Time `json:"erased_at"`
+	DriverDeleted   bool      `json:"driver_deleted"`
+	TripsDeleted    int       `json:"trips_deleted"`
+	TripsAnonymized int       `json:"trips_anonymized"`
+}
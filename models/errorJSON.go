@@ -1,5 +0,0 @@
-package models
-
-type ErrorJSON struct {
-	Error string `json:"error"`
-}
@@ -2,7 +2,6 @@ package models
 
 import (
 	"encoding/json"
-	"fmt"
 	"strings"
 )
 
@@ -15,7 +14,7 @@ func (gender *Gender) UnmarshalJSON(b []byte) error {
 	sGender = strings.ToUpper(sGender)
 	validGenders := "FMO" // "O" stands for other
 	if len(sGender) != 1 || !strings.Contains(validGenders, sGender) {
-		return fmt.Errorf("'gender' must be 'F', 'M' or 'O'")
+		return &Violation{Rule: RuleEnum, Message: "'gender' must be 'F', 'M' or 'O'"}
 	}
 
 	*gender = Gender(sGender)
@@ -0,0 +1,15 @@
+package models
+
+// Match is a Driver that could carry a freight, ranked by Score (from 0
+// to 1, higher is better)
+type Match struct {
+	Driver     *Driver `json:"driver"`
+	LatestTrip *Trip   `json:"latest_trip"`
+	// from the latest Trip's destination to the freight's origin
+	DistanceKm float64 `json:"distance_km"`
+	// from the freight's destination back to the latest Trip's origin
+	ReturnDistanceKm float64 `json:"return_distance_km"`
+	// since the latest Trip arrived at the Terminal
+	IdleHours float64 `json:"idle_hours"`
+	Score     float64 `json:"score"`
+}
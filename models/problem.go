@@ -0,0 +1,15 @@
+package models
+
+// Problem is the body of every error response, as RFC 7807 problem details
+// ("application/problem+json"). Code is a stable, machine-readable
+// identifier of the error, and Violations lists every field of the request
+// that failed validation.
+type Problem struct {
+	Type       string       `json:"type"`
+	Title      string       `json:"title"`
+	Status     int          `json:"status"`
+	Code       string       `json:"code"`
+	Detail     string       `json:"detail,omitempty"`
+	Instance   string       `json:"instance,omitempty"`
+	Violations []*Violation `json:"violations,omitempty"`
+}
@@ -1,13 +1,29 @@
 package models
 
 import (
+	"crypto/rand"
 	"encoding/json"
 	"fmt"
+	"regexp"
 	"time"
 
+	"github.com/oklog/ulid"
 	"google.golang.org/genproto/googleapis/type/latlng"
+
+	"github.com/rafaft/truck-pad/geo"
 )
 
+// legacyIDLayout is the layout of Trip IDs from before they were globally
+// unique, when a Trip's ID was it's timestamp, on the offset it was sent
+// with, and only unique per Driver
+const legacyIDLayout = "20060102150405"
+
+var legacyIDRegex = regexp.MustCompile(`^\d{14}$`)
+
+// GeohashPrecision is the length of the longest geohash prefix of a
+// Trip's origin and destination (6 characters is a cell of about 1km)
+const GeohashPrecision = 6
+
 // Trip type for Firestore Trips collection
 type Trip struct {
 	ID          string         `firestore:"id" json:"id,omitempty"`
@@ -17,54 +33,118 @@ type Trip struct {
 	Time        *time.Time     `firestore:"time" json:"time,omitempty"`
 	Origin      *latlng.LatLng `firestore:"origin" json:"origin,omitempty"`
 	Destination *latlng.LatLng `firestore:"destination" json:"destination,omitempty"`
+	// LegacyID is the ID the Trip would have had before IDs were ULIDs,
+	// so integrations that build it from the Trip's time still find it
+	LegacyID string `firestore:"legacy_id,omitempty" json:"-"`
+	// geohash prefixes, for querying Trips by origin and destination
+	OriginGeohashes      []string `firestore:"origin_geohashes,omitempty" json:"-"`
+	DestinationGeohashes []string `firestore:"destination_geohashes,omitempty" json:"-"`
 }
 
+// UnmarshalJSON decodes every field of a Trip, returning a
+// ValidationError with all the invalid ones
+func (t *Trip) UnmarshalJSON(b []byte) error {
+	return decodeFields(b, []jsonField{
+		{"id", &t.ID},
+		{"driver_id", &t.DriverID},
+		{"has_load", &t.HasLoad},
+		{"vehicle_type", &t.VehicleType},
+		{"time", &t.Time},
+		{"origin", &t.Origin},
+		{"destination", &t.Destination},
+	})
+}
+
+// ValidateTrip returns a ValidationError with all missing fields and
+// coordinates out of range
 func (t *Trip) ValidateTrip() error {
-	if t.DriverID == nil ||
-		t.HasLoad == nil ||
-		t.VehicleType == nil ||
-		t.Time == nil ||
-		t.Origin == nil ||
-		t.Destination == nil {
-		fields := "['driver_id', 'has_load', 'vehicle_type', 'time', 'origin', 'destination']"
-		return fmt.Errorf("Trip must have all fields: %s", fields)
+	var errs ValidationError
+	if t.DriverID == nil {
+		errs.required("driver_id")
 	}
-
-	if t.Origin.Latitude > 90 || t.Origin.Latitude < -90 ||
-		t.Destination.Latitude > 90 || t.Destination.Latitude < -90 {
-		return fmt.Errorf("latitude outside permitted range -90.0 to 90.0")
+	if t.HasLoad == nil {
+		errs.required("has_load")
+	}
+	if t.VehicleType == nil {
+		errs.required("vehicle_type")
 	}
+	if t.Time == nil {
+		errs.required("time")
+	}
+	validateLatLng(&errs, "origin", t.Origin)
+	validateLatLng(&errs, "destination", t.Destination)
+
+	return errs.Err()
+}
 
-	if t.Origin.Longitude > 180 || t.Origin.Longitude < -180 ||
-		t.Destination.Longitude > 180 || t.Destination.Longitude < -180 {
-		return fmt.Errorf("longitude outside permitted range -180.0 to 180.0")
+// validateLatLng adds the Violations of the coordinates on field
+func validateLatLng(errs *ValidationError, field string, ll *latlng.LatLng) {
+	if ll == nil {
+		errs.required(field)
+		return
 	}
 
-	return nil
+	if ll.Latitude > 90 || ll.Latitude < -90 {
+		errs.Add(field+".latitude", RuleRange, "latitude outside permitted range -90.0 to 90.0")
+	}
+	if ll.Longitude > 180 || ll.Longitude < -180 {
+		errs.Add(field+".longitude", RuleRange, "longitude outside permitted range -180.0 to 180.0")
+	}
 }
 
 func (t *Trip) SetID() error {
 	if t.Time == nil {
 		return fmt.Errorf("cannot set trip ID with field Time==nil")
 	}
-	// a trip's ID is it's timestamp on string format
-	t.ID = t.Time.Format("20060102150405")
+	// a trip's ID is a ULID, which is globally unique and sorts by the
+	// trip's timestamp
+	id, err := ulid.New(ulid.Timestamp(*t.Time), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("cannot set trip ID for time=%s", t.Time.Format(time.RFC3339))
+	}
+
+	t.ID = id.String()
+	t.LegacyID = LegacyTripID(*t.Time)
+	return nil
+}
+
+// SetGeohashes sets the geohash prefixes of the Trip's origin and destination
+func (t *Trip) SetGeohashes() error {
+	if t.Origin == nil || t.Destination == nil {
+		return fmt.Errorf("cannot set trip geohashes with fields Origin==nil or Destination==nil")
+	}
+
+	t.OriginGeohashes = geo.Prefixes(t.Origin.Latitude, t.Origin.Longitude, GeohashPrecision)
+	t.DestinationGeohashes = geo.Prefixes(t.Destination.Latitude, t.Destination.Longitude, GeohashPrecision)
 	return nil
 }
 
+// LegacyTripID returns the legacy ID of a Trip at t, on t's offset
+func LegacyTripID(t time.Time) string {
+	return t.Format(legacyIDLayout)
+}
+
+// IsLegacyTripID reports whether id is a legacy (timestamp) Trip ID
+func IsLegacyTripID(id string) bool {
+	return legacyIDRegex.MatchString(id)
+}
+
 func NewTrip(b []byte) (*Trip, error) {
 	var trip Trip
-	err := json.Unmarshal(b, &trip)
+	err := MergeErrors(json.Unmarshal(b, &trip), trip.ValidateTrip())
 	if err != nil {
 		return nil, err
 	}
 
-	err = trip.ValidateTrip()
+	err = trip.SetID()
 	if err != nil {
 		return nil, err
 	}
 
-	trip.SetID()
+	err = trip.SetGeohashes()
+	if err != nil {
+		return nil, err
+	}
 
 	return &trip, nil
 }
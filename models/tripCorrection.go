@@ -0,0 +1,120 @@
+package models
+
+import (
+	"crypto/rand"
+	"reflect"
+	"time"
+
+	"github.com/oklog/ulid"
+	"google.golang.org/genproto/googleapis/type/latlng"
+)
+
+// actions of a TripCorrection
+const (
+	CorrectionUpdate = "update"
+	CorrectionDelete = "delete"
+)
+
+// FieldChange is the value of a Trip's field before and after a
+// correction. New is nil when the Trip was deleted.
+type FieldChange struct {
+	Field string      `firestore:"field" json:"field"`
+	Old   interface{} `firestore:"old" json:"old"`
+	New   interface{} `firestore:"new" json:"new"`
+}
+
+// TripCorrection is the record of an update or deletion of a Trip, kept
+// as an audit trail. Corrections are never changed once added.
+type TripCorrection struct {
+	ID       string `firestore:"id" json:"id"`
+	DriverID string `firestore:"driver_id" json:"driver_id"`
+	TripID   string `firestore:"trip_id" json:"trip_id"`
+	// a Trip's ID changes with it's time
+	NewTripID string `firestore:"new_trip_id,omitempty" json:"new_trip_id,omitempty"`
+	Action    string `firestore:"action" json:"action"`
+	// Author and AuthorID are the name and ID of the authenticated client
+	// (e.g.: the API key) that made the correction
+	Author   string `firestore:"author,omitempty" json:"author,omitempty"`
+	AuthorID string `firestore:"author_id,omitempty" json:"author_id,omitempty"`
+	// From is the request's "From" header (RFC 7231), e.g.: the terminal
+	// operator's email. It's chosen by the client, so it's not verified.
+	From    string         `firestore:"from,omitempty" json:"from,omitempty"`
+	Time    time.Time      `firestore:"time" json:"time"`
+	Changes []*FieldChange `firestore:"changes" json:"changes"`
+}
+
+// NewTripCorrection records the changes from old to trip, or the deletion
+// of old if trip is nil. Only the fields that changed are recorded.
+func NewTripCorrection(old, trip *Trip) *TripCorrection {
+	now := time.Now().UTC()
+	correction := &TripCorrection{
+		ID:       ulid.MustNew(ulid.Timestamp(now), rand.Reader).String(),
+		DriverID: string(*old.DriverID),
+		TripID:   old.ID,
+		Action:   CorrectionUpdate,
+		Time:     now,
+		Changes:  make([]*FieldChange, 0),
+	}
+	if trip == nil {
+		correction.Action = CorrectionDelete
+		trip = &Trip{}
+	} else if trip.ID != old.ID {
+		correction.NewTripID = trip.ID
+	}
+
+	fields := []struct {
+		name     string
+		old, new interface{}
+	}{
+		{"has_load", old.HasLoad, trip.HasLoad},
+		{"vehicle_type", old.VehicleType, trip.VehicleType},
+		{"time", old.Time, trip.Time},
+		{"origin", old.Origin, trip.Origin},
+		{"destination", old.Destination, trip.Destination},
+	}
+	for _, field := range fields {
+		oldValue, newValue := derefField(field.old), derefField(field.new)
+		if !sameValue(oldValue, newValue) {
+			correction.Changes = append(correction.Changes, &FieldChange{field.name, oldValue, newValue})
+		}
+	}
+
+	return correction
+}
+
+// derefField returns the value of a Trip's field, or nil if it's not set
+func derefField(field interface{}) interface{} {
+	switch v := field.(type) {
+	case *bool:
+		if v != nil {
+			return *v
+		}
+	case *VehicleType:
+		if v != nil {
+			return int(*v)
+		}
+	case *time.Time:
+		if v != nil {
+			return v.UTC()
+		}
+	case *latlng.LatLng:
+		// kept as a LatLng, which Firestore stores as a geographical point
+		if v != nil {
+			return &latlng.LatLng{Latitude: v.Latitude, Longitude: v.Longitude}
+		}
+	}
+
+	return nil
+}
+
+// sameValue compares the values returned by derefField. LatLngs have
+// internal state, so only their coordinates are compared.
+func sameValue(a, b interface{}) bool {
+	llA, okA := a.(*latlng.LatLng)
+	llB, okB := b.(*latlng.LatLng)
+	if okA && okB {
+		return llA.Latitude == llB.Latitude && llA.Longitude == llB.Longitude
+	}
+
+	return reflect.DeepEqual(a, b)
+}
@@ -0,0 +1,169 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// rules broken by a Violation
+const (
+	RuleRequired  = "required"
+	RuleType      = "type"
+	RuleFormat    = "format"
+	RuleEnum      = "enum"
+	RuleRange     = "range"
+	RuleCPF       = "cpf"
+	RuleImmutable = "immutable"
+	RuleUnknown   = "unknown"
+	RuleExclusive = "exclusive"
+)
+
+// Violation is a field of a request that failed validation. Field is the
+// path of the field on the request's body, e.g.: "origin.latitude".
+type Violation struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+func (v *Violation) Error() string {
+	return v.Message
+}
+
+// ValidationError aggregates all Violations of a request, instead of
+// stopping at the first one
+type ValidationError struct {
+	Violations []*Violation
+}
+
+func (e *ValidationError) Error() string {
+	messages := make([]string, len(e.Violations))
+	for i, violation := range e.Violations {
+		messages[i] = violation.Message
+	}
+
+	return strings.Join(messages, "; ")
+}
+
+// Add adds a Violation of rule on field
+func (e *ValidationError) Add(field, rule, message string) {
+	e.Violations = append(e.Violations, &Violation{
+		Field:   field,
+		Rule:    rule,
+		Message: message,
+	})
+}
+
+// addError adds err as a Violation on field. Errors that are not a
+// Violation are reported as a type or format error of the field.
+func (e *ValidationError) addError(field string, err error) {
+	switch err := err.(type) {
+	case *Violation:
+		e.Add(field, err.Rule, err.Message)
+	case *ValidationError:
+		for _, violation := range err.Violations {
+			e.Add(field+"."+violation.Field, violation.Rule, violation.Message)
+		}
+	case *json.UnmarshalTypeError:
+		if len(err.Field) > 0 {
+			field += "." + err.Field
+		}
+		e.Add(field, RuleType, fmt.Sprintf("'%s' must be of type %s", field, err.Type))
+	default:
+		e.Add(field, RuleFormat, fmt.Sprintf("invalid value for '%s'", field))
+	}
+}
+
+// hasField reports whether there is already a Violation on field
+func (e *ValidationError) hasField(field string) bool {
+	for _, violation := range e.Violations {
+		if violation.Field == field {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Without returns the error without the Violations on field, nil if
+// there are no others
+func (e *ValidationError) Without(field string) error {
+	var others ValidationError
+	for _, violation := range e.Violations {
+		if violation.Field != field {
+			others.Violations = append(others.Violations, violation)
+		}
+	}
+
+	return others.Err()
+}
+
+// Err returns e if there are Violations, otherwise nil
+func (e *ValidationError) Err() error {
+	if len(e.Violations) == 0 {
+		return nil
+	}
+
+	return e
+}
+
+// MergeErrors merges the Violations of errs, skipping those on fields that
+// already have one (a field that failed decoding is also missing).
+// Any error that is not a ValidationError is returned as is.
+func MergeErrors(errs ...error) error {
+	var merged ValidationError
+	for _, err := range errs {
+		if err == nil {
+			continue
+		}
+
+		validationErr, ok := err.(*ValidationError)
+		if !ok {
+			return err
+		}
+
+		for _, violation := range validationErr.Violations {
+			if !merged.hasField(violation.Field) {
+				merged.Violations = append(merged.Violations, violation)
+			}
+		}
+	}
+
+	return merged.Err()
+}
+
+// jsonField is a field of a JSON object and where to decode it into
+type jsonField struct {
+	name   string
+	target interface{}
+}
+
+// decodeFields decodes each field of the JSON object b on it's own, so
+// every invalid field is reported, not only the first one. Unknown fields
+// are ignored, as json.Unmarshal does.
+func decodeFields(b []byte, fields []jsonField) error {
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(b, &object); err != nil {
+		return err
+	}
+
+	var errs ValidationError
+	for _, field := range fields {
+		value, exist := object[field.name]
+		if !exist {
+			continue
+		}
+
+		if err := json.Unmarshal(value, field.target); err != nil {
+			errs.addError(field.name, err)
+		}
+	}
+
+	return errs.Err()
+}
+
+// required adds a Violation for a missing field
+func (e *ValidationError) required(field string) {
+	e.Add(field, RuleRequired, fmt.Sprintf("'%s' is required", field))
+}
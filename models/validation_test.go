@@ -0,0 +1,90 @@
+package models
+
+import (
+	"reflect"
+	"testing"
+)
+
+// violationFields returns the fields and rules of err's Violations, in order
+func violationFields(t *testing.T, err error) []string {
+	t.Helper()
+	validationErr, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatalf("got error %v, want a ValidationError", err)
+	}
+
+	fields := make([]string, 0)
+	for _, violation := range validationErr.Violations {
+		fields = append(fields, violation.Field+":"+violation.Rule)
+	}
+
+	return fields
+}
+
+func TestNewDriverViolations(t *testing.T) {
+	tests := []struct {
+		body   string
+		fields []string
+	}{
+		// every invalid field, then every missing one, once each
+		{
+			`{"cpf":"52998224700","birth_date":"yesterday","gender":"X","has_vehicle":"yes"}`,
+			[]string{"cpf:cpf", "birth_date:format", "gender:enum", "has_vehicle:type", "name:required", "cnh_type:required"},
+		},
+		{
+			`{"cpf":"52998224725","name":"Ana","birth_date":"1980-05-01T00:00:00Z","gender":"f","has_vehicle":true,"cnh_type":"F"}`,
+			[]string{"cnh_type:enum"},
+		},
+		{`{}`, []string{"cpf:required", "name:required", "birth_date:required", "gender:required", "has_vehicle:required", "cnh_type:required"}},
+	}
+	for _, test := range tests {
+		_, err := NewDriver([]byte(test.body))
+		if fields := violationFields(t, err); !reflect.DeepEqual(fields, test.fields) {
+			t.Errorf("%s: got violations %v, want %v", test.body, fields, test.fields)
+		}
+	}
+
+	if _, err := NewDriver([]byte(`{"cpf":`)); err == nil {
+		t.Error("malformed JSON: got no error")
+	} else if _, ok := err.(*ValidationError); ok {
+		t.Errorf("malformed JSON: got a ValidationError %v, want the syntax error", err)
+	}
+}
+
+func TestNewTripViolations(t *testing.T) {
+	tests := []struct {
+		body   string
+		fields []string
+	}{
+		{
+			`{"driver_id":"123","has_load":1,"vehicle_type":9,"origin":{"latitude":91,"longitude":-181},"destination":"x"}`,
+			[]string{"driver_id:cpf", "has_load:type", "vehicle_type:enum", "destination:type", "time:required", "origin.latitude:range", "origin.longitude:range"},
+		},
+		{
+			`{"driver_id":"52998224725","has_load":true,"vehicle_type":"1","time":"2020-01-01","origin":{"latitude":"x","longitude":0},"destination":{"latitude":0,"longitude":0}}`,
+			[]string{"vehicle_type:type", "time:format", "origin.latitude:type"},
+		},
+	}
+	for _, test := range tests {
+		_, err := NewTrip([]byte(test.body))
+		if fields := violationFields(t, err); !reflect.DeepEqual(fields, test.fields) {
+			t.Errorf("%s: got violations %v, want %v", test.body, fields, test.fields)
+		}
+	}
+}
+
+func TestMergeErrors(t *testing.T) {
+	var decoding, validation ValidationError
+	decoding.Add("gender", RuleEnum, "'gender' must be 'F', 'M' or 'O'")
+	validation.required("gender")
+	validation.required("name")
+
+	err := MergeErrors(nil, decoding.Err(), validation.Err())
+	if fields := violationFields(t, err); !reflect.DeepEqual(fields, []string{"gender:enum", "name:required"}) {
+		t.Errorf("got violations %v, want gender:enum and name:required", fields)
+	}
+
+	if err := MergeErrors(nil, (&ValidationError{}).Err()); err != nil {
+		t.Errorf("got %v, want no error without violations", err)
+	}
+}
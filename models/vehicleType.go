@@ -2,11 +2,18 @@ package models
 
 import (
 	"encoding/json"
-	"fmt"
 )
 
 type VehicleType int
 
+const (
+	Truck34         VehicleType = 1 // Caminhão 3/4
+	TruckToco       VehicleType = 2 // Caminhão Toco
+	Truck           VehicleType = 3 // Caminhão Truck
+	SimpleTrailer   VehicleType = 4 // Carreta Simples
+	ExtendedTrailer VehicleType = 5 // Carreta Eixo Extendido
+)
+
 func (vt *VehicleType) UnmarshalJSON(b []byte) error {
 	vehicleTypes := map[int]string{
 		1: "TRUCK_34",
@@ -24,7 +31,7 @@ func (vt *VehicleType) UnmarshalJSON(b []byte) error {
 
 	_, exist := vehicleTypes[vehicleType]
 	if !exist {
-		return fmt.Errorf("invalid vehicle_type")
+		return &Violation{Rule: RuleEnum, Message: "'vehicle_type' must be 1, 2, 3, 4 or 5"}
 	}
 
 	*vt = VehicleType(vehicleType)
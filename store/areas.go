@@ -0,0 +1,100 @@
+package store
+
+import (
+	"github.com/rafaft/truck-pad/geo"
+	"github.com/rafaft/truck-pad/models"
+)
+
+// maxGeohashCells is the most values Firestore accepts on an
+// "array-contains-any" filter
+const maxGeohashCells = 10
+
+// maxTripsChunk is the most Trips read by a query when Trips are skipped
+// while reading, so their query is read in chunks
+const maxTripsChunk = 1000
+
+// inTripAreas reports whether the Trip's origin and destination are within
+// the filter's areas. Stores may narrow down Trips by area (with geohashes
+// or bounding boxes), but exact distances are always checked by it.
+func inTripAreas(trip *models.Trip, filter TripFilter) bool {
+	if filter.Origin != nil {
+		if trip.Origin == nil || !filter.Origin.Contains(trip.Origin.Latitude, trip.Origin.Longitude) {
+			return false
+		}
+	}
+	if filter.Destination != nil {
+		if trip.Destination == nil || !filter.Destination.Contains(trip.Destination.Latitude, trip.Destination.Longitude) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// geohashFilter returns the field and geohash cells that narrow down the
+// Trips of filter's areas. Firestore accepts a single "array-contains-any"
+// filter per query, so with both areas only the smaller one is narrowed
+// down (the one covered by finer cells, or fewer of them), the other one
+// is only checked by inTripAreas. Returns no cells if neither area can be
+// covered by maxGeohashCells cells.
+func geohashFilter(filter TripFilter) (field string, cells []string) {
+	if filter.Origin != nil {
+		field = "origin_geohashes"
+		cells = geo.Cover(filter.Origin.Bounds(), models.GeohashPrecision, maxGeohashCells)
+	}
+	if filter.Destination != nil {
+		destinationCells := geo.Cover(filter.Destination.Bounds(), models.GeohashPrecision, maxGeohashCells)
+		if narrowerCells(destinationCells, cells) {
+			field, cells = "destination_geohashes", destinationCells
+		}
+	}
+
+	return field, cells
+}
+
+// narrowerCells reports whether the cells of a cover are a smaller area than
+// the other's. Cells of a cover have the same precision.
+func narrowerCells(cells, other []string) bool {
+	if len(cells) == 0 {
+		return false
+	}
+	if len(other) == 0 {
+		return true
+	}
+	if len(cells[0]) != len(other[0]) {
+		return len(cells[0]) > len(other[0])
+	}
+
+	return len(cells) < len(other)
+}
+
+// tripSelection returns the fields that must be read to apply filter.
+// Besides the requested fields, time is needed for the cursors of page
+// tokens and chunked reads, and origin/destination for checking areas. reproject is true when fields
+// were added, and must be removed before returning Trips.
+func tripSelection(filter TripFilter) (fields []string, reproject bool) {
+	if len(filter.Fields) == 0 {
+		return nil, false
+	}
+
+	fields = filter.Fields
+	required := make([]string, 0)
+	if filter.PageSize > 0 || filter.Limit > 0 {
+		required = append(required, "time")
+	}
+	if filter.Origin != nil {
+		required = append(required, "origin")
+	}
+	if filter.Destination != nil {
+		required = append(required, "destination")
+	}
+
+	for _, field := range required {
+		if !containsString(fields, field) {
+			fields = append([]string{field}, fields...)
+			reproject = true
+		}
+	}
+
+	return fields, reproject
+}
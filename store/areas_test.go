@@ -0,0 +1,156 @@
+package store
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"google.golang.org/genproto/googleapis/type/latlng"
+
+	"github.com/rafaft/truck-pad/geo"
+)
+
+func TestTripAreas(t *testing.T) {
+	forEachTestStore(t, func(t *testing.T, s Store) {
+		ctx := context.Background()
+
+		// oldest first
+		destinations := []struct {
+			name string
+			*latlng.LatLng
+		}{
+			{"fiji", &latlng.LatLng{Latitude: -17.7, Longitude: 178.1}},
+			{"samoa", &latlng.LatLng{Latitude: -13.8, Longitude: -172.1}},
+			{"greenwich", &latlng.LatLng{Latitude: -15, Longitude: 0}},
+			{"são paulo", &latlng.LatLng{Latitude: -23.55, Longitude: -46.63}},
+			{"santo amaro", &latlng.LatLng{Latitude: -23.9, Longitude: -46.63}},
+			{"outside corner", &latlng.LatLng{Latitude: -23.9, Longitude: -46.98}},
+		}
+		names := make(map[string]string)
+		start := time.Date(2020, 2, 14, 15, 0, 0, 0, time.UTC)
+		for i, destination := range destinations {
+			trip := newTestTrip(t, "52998224725", start.Add(time.Duration(i)*time.Hour), destination.LatLng)
+			if err := s.AddTrip(ctx, trip); err != nil {
+				t.Fatal(err)
+			}
+			names[trip.ID] = destination.name
+		}
+
+		tests := []struct {
+			name   string
+			filter TripFilter
+			want   []string
+		}{
+			{
+				"box across the antimeridian",
+				TripFilter{Destination: geo.NewBox(geo.BoundingBox{MinLat: -20, MinLng: 170, MaxLat: -10, MaxLng: -170})},
+				[]string{"fiji", "samoa"},
+			},
+			{
+				// the corner is within the circle's bounding box
+				"circle",
+				TripFilter{Destination: geo.NewCircle(-23.55, -46.63, 50)},
+				[]string{"santo amaro", "são paulo"},
+			},
+			{
+				"circle with a limit",
+				TripFilter{Destination: geo.NewCircle(-23.55, -46.63, 50), Limit: 1},
+				[]string{"santo amaro"},
+			},
+			{
+				"both areas",
+				TripFilter{
+					Origin:      geo.NewCircle(-23.55, -46.63, 10),
+					Destination: geo.NewBox(geo.BoundingBox{MinLat: -20, MinLng: 170, MaxLat: -10, MaxLng: -170}),
+				},
+				[]string{"fiji", "samoa"},
+			},
+			{
+				"origin outside",
+				TripFilter{Origin: geo.NewCircle(0, 0, 100), Destination: geo.NewCircle(-23.55, -46.63, 50)},
+				[]string{},
+			},
+		}
+		for _, test := range tests {
+			trips, _, err := s.GetTrips(ctx, test.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := make([]string, 0)
+			for _, trip := range trips {
+				got = append(got, names[trip.ID])
+			}
+			if test.filter.Limit == 0 {
+				sort.Strings(got)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+			}
+		}
+
+		// pages are filled after skipping the Trips out of the area
+		trips, next, err := s.GetTrips(ctx, TripFilter{Destination: geo.NewCircle(-23.55, -46.63, 50), PageSize: 1})
+		if err != nil || len(trips) != 1 || len(next) == 0 {
+			t.Fatalf("got %d trips, %q, %v, want a page of 1", len(trips), next, err)
+		}
+		trips, next, err = s.GetTrips(ctx, TripFilter{Destination: geo.NewCircle(-23.55, -46.63, 50), PageSize: 1, PageToken: next})
+		if err != nil || len(trips) != 1 || len(next) > 0 {
+			t.Errorf("got %d trips, %q, %v, want the last page of 1", len(trips), next, err)
+		}
+	})
+}
+
+func TestGeohashFilter(t *testing.T) {
+	city := geo.NewCircle(-23.55, -46.63, 10)
+	state := geo.NewBox(geo.BoundingBox{MinLat: -26.7, MinLng: -54.6, MaxLat: -22.5, MaxLng: -48})
+	world := geo.NewBox(geo.BoundingBox{MinLat: -90, MinLng: -180, MaxLat: 90, MaxLng: 180})
+
+	tests := []struct {
+		name   string
+		filter TripFilter
+		field  string
+	}{
+		{"no area", TripFilter{}, ""},
+		{"origin", TripFilter{Origin: state}, "origin_geohashes"},
+		{"destination", TripFilter{Destination: state}, "destination_geohashes"},
+		{"smaller origin", TripFilter{Origin: city, Destination: state}, "origin_geohashes"},
+		{"smaller destination", TripFilter{Origin: state, Destination: city}, "destination_geohashes"},
+		{"uncovered origin", TripFilter{Origin: world, Destination: state}, "destination_geohashes"},
+		{"uncovered destination", TripFilter{Origin: state, Destination: world}, "origin_geohashes"},
+	}
+	for _, test := range tests {
+		field, cells := geohashFilter(test.filter)
+		if len(cells) == 0 {
+			field = ""
+		}
+		if field != test.field || len(cells) > maxGeohashCells {
+			t.Errorf("%s: got %s with %d cells, want %s", test.name, field, len(cells), test.field)
+		}
+	}
+	if _, cells := geohashFilter(TripFilter{Origin: world}); cells != nil {
+		t.Errorf("got %v for the whole world, want no cells", cells)
+	}
+}
+
+func TestTripSelection(t *testing.T) {
+	tests := []struct {
+		filter    TripFilter
+		fields    []string
+		reproject bool
+	}{
+		{TripFilter{}, nil, false},
+		{TripFilter{Fields: []string{"id"}}, []string{"id"}, false},
+		{TripFilter{Fields: []string{"id"}, PageSize: 10}, []string{"time", "id"}, true},
+		{TripFilter{Fields: []string{"id", "time"}, Limit: 1}, []string{"id", "time"}, false},
+		{TripFilter{Fields: []string{"id"}, Destination: geo.NewCircle(0, 0, 1)}, []string{"destination", "id"}, true},
+	}
+	for _, test := range tests {
+		fields, reproject := tripSelection(test.filter)
+		if !reflect.DeepEqual(fields, test.fields) || reproject != test.reproject {
+			t.Errorf("%+v: got %v, %t, want %v, %t", test.filter, fields, reproject, test.fields, test.reproject)
+		}
+	}
+}
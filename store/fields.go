@@ -0,0 +1,77 @@
+package store
+
+import (
+	"github.com/rafaft/truck-pad/models"
+)
+
+// SelectDriverFields returns a copy of driver with only the given fields
+// set, mimicking a Firestore projection. An empty list selects every field.
+func SelectDriverFields(driver *models.Driver, fields []string) *models.Driver {
+	if len(fields) == 0 {
+		selected := *driver
+		return &selected
+	}
+
+	selected := models.Driver{
+		UpdateTime: driver.UpdateTime,
+	}
+	for _, field := range fields {
+		switch field {
+		case "cpf":
+			selected.CPF = driver.CPF
+		case "name":
+			selected.Name = driver.Name
+		case "birth_date":
+			selected.BirthDate = driver.BirthDate
+		case "gender":
+			selected.Gender = driver.Gender
+		case "has_vehicle":
+			selected.HasVehicle = driver.HasVehicle
+		case "cnh_type":
+			selected.CNHType = driver.CNHType
+		}
+	}
+
+	return &selected
+}
+
+// selectTripFields returns a copy of trip with only the given fields set,
+// mimicking a Firestore projection. An empty list selects every field.
+func selectTripFields(trip *models.Trip, fields []string) *models.Trip {
+	if len(fields) == 0 {
+		selected := *trip
+		return &selected
+	}
+
+	var selected models.Trip
+	for _, field := range fields {
+		switch field {
+		case "id":
+			selected.ID = trip.ID
+		case "driver_id":
+			selected.DriverID = trip.DriverID
+		case "has_load":
+			selected.HasLoad = trip.HasLoad
+		case "vehicle_type":
+			selected.VehicleType = trip.VehicleType
+		case "time":
+			selected.Time = trip.Time
+		case "origin":
+			selected.Origin = trip.Origin
+		case "destination":
+			selected.Destination = trip.Destination
+		}
+	}
+
+	return &selected
+}
+
+func containsString(values []string, s string) bool {
+	for _, value := range values {
+		if value == s {
+			return true
+		}
+	}
+
+	return false
+}
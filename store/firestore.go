@@ -0,0 +1,1130 @@
+package store
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/rafaft/truck-pad/models"
+)
+
+// TripsLayout defines where FirestoreStore keeps Trips
+type TripsLayout int
+
+const (
+	// SubcollectionTrips keeps Trips under "drivers/{cpf}/trips"
+	SubcollectionTrips TripsLayout = iota
+	// TopLevelTrips keeps Trips under the top level "trips" collection
+	TopLevelTrips
+)
+
+// ParseTripsLayout accepts "subcollection" (also the empty string) or "toplevel"
+func ParseTripsLayout(s string) (TripsLayout, error) {
+	switch s {
+	case "", "subcollection":
+		return SubcollectionTrips, nil
+	case "toplevel":
+		return TopLevelTrips, nil
+	default:
+		return 0, fmt.Errorf("unknown trips layout=%s", s)
+	}
+}
+
+// FirestoreStore implements Store on top of Firestore.
+// Drivers are stored in the "drivers" collection, using their CPF as
+// document ID, and Trips are stored according to the TripsLayout, using
+// their ID as document ID. The "trip_times" collection keeps Trips unique
+// per Driver and time, and "idempotency_keys" the idempotent requests.
+type FirestoreStore struct {
+	client *firestore.Client
+	layout TripsLayout
+}
+
+func NewFirestoreStore(client *firestore.Client, layout TripsLayout) *FirestoreStore {
+	return &FirestoreStore{
+		client: client,
+		layout: layout,
+	}
+}
+
+func (s *FirestoreStore) AddDriver(ctx context.Context, driver *models.Driver) error {
+	doc := s.client.Collection("drivers").Doc(string(*driver.CPF))
+	// the version's valid_from is the write's time, the Driver's UpdateTime
+	batch := s.client.Batch()
+	batch.Create(doc, driver)
+	batch.Create(s.driverVersionRef(doc), models.NewDriverVersion(driver))
+	results, err := batch.Commit(ctx)
+	if status.Code(err) == codes.AlreadyExists {
+		return ErrConflict
+	}
+	if err != nil {
+		return err
+	}
+
+	driver.UpdateTime = results[0].UpdateTime
+	return nil
+}
+
+func (s *FirestoreStore) GetDrivers(ctx context.Context, filter DriverFilter) ([]*models.Driver, string, error) {
+	q, err := s.createDriversQuery(filter)
+	if err != nil {
+		return nil, "", err
+	}
+
+	docs, err := q.Documents(ctx).GetAll()
+	if err != nil {
+		return nil, "", err
+	}
+
+	nextPageToken := ""
+	if filter.PageSize > 0 && len(docs) > filter.PageSize {
+		docs = docs[:filter.PageSize]
+		nextPageToken = encodeCursor(cursor{Key: docs[len(docs)-1].Ref.ID})
+	}
+
+	result := make([]*models.Driver, len(docs))
+	for i, docSnapShot := range docs {
+		var driver models.Driver
+		err = docSnapShot.DataTo(&driver)
+		if err != nil {
+			return nil, "", err
+		}
+		driver.UpdateTime = docSnapShot.UpdateTime
+
+		result[i] = &driver
+	}
+
+	return result, nextPageToken, nil
+}
+
+func (s *FirestoreStore) EachDriver(ctx context.Context, filter DriverFilter, fn func(driver *models.Driver) error) error {
+	filter.PageSize, filter.PageToken = 0, ""
+	q, err := s.createDriversQuery(filter)
+	if err != nil {
+		return err
+	}
+
+	iter := q.Documents(ctx)
+	defer iter.Stop()
+
+	for {
+		docSnapShot, err := iter.Next()
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var driver models.Driver
+		if err = docSnapShot.DataTo(&driver); err != nil {
+			return err
+		}
+		driver.UpdateTime = docSnapShot.UpdateTime
+
+		if err = fn(&driver); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *FirestoreStore) UpdateDriver(ctx context.Context, cpf string, driver *models.Driver, lastUpdateTime time.Time) error {
+	// explicitly convert Driver to map, because it's easier to iterate it
+	mapDriver := map[string]interface{}{
+		"name":        driver.Name,
+		"birth_date":  driver.BirthDate,
+		"gender":      driver.Gender,
+		"has_vehicle": driver.HasVehicle,
+		"cnh_type":    driver.CNHType,
+	}
+
+	// create slice of updates
+	updates := make([]firestore.Update, 0)
+	for fieldName, fieldValue := range mapDriver {
+		if !reflect.ValueOf(fieldValue).IsNil() {
+			update := firestore.Update{
+				Path:  fieldName,
+				Value: fieldValue,
+			}
+			updates = append(updates, update)
+		}
+	}
+
+	// the Driver is read to add it's new version, in a transaction, so
+	// it's the version the update applies to
+	doc := s.client.Collection("drivers").Doc(cpf)
+	return s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		snapshot, err := tx.Get(doc)
+		if status.Code(err) == codes.NotFound {
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+		// the update fails if the document changed since lastUpdateTime
+		if !lastUpdateTime.IsZero() && !snapshot.UpdateTime.Equal(lastUpdateTime) {
+			return ErrPreconditionFailed
+		}
+
+		var updated models.Driver
+		if err = snapshot.DataTo(&updated); err != nil {
+			return err
+		}
+		// Drivers added before versions were kept have no history, their
+		// current values become the first version
+		legacy, err := tx.Documents(doc.Collection("history").Limit(1)).GetAll()
+		if err != nil {
+			return err
+		}
+		if len(legacy) == 0 {
+			updated.UpdateTime = snapshot.UpdateTime
+			if err = tx.Create(s.driverVersionRef(doc), models.NewDriverVersion(&updated)); err != nil {
+				return err
+			}
+		}
+
+		if driver.Name != nil {
+			updated.Name = driver.Name
+		}
+		if driver.BirthDate != nil {
+			updated.BirthDate = driver.BirthDate
+		}
+		if driver.Gender != nil {
+			updated.Gender = driver.Gender
+		}
+		if driver.HasVehicle != nil {
+			updated.HasVehicle = driver.HasVehicle
+		}
+		if driver.CNHType != nil {
+			updated.CNHType = driver.CNHType
+		}
+		// valid_from is set to the commit's time
+		updated.UpdateTime = time.Time{}
+
+		if err = tx.Update(doc, updates); err != nil {
+			return err
+		}
+		return tx.Create(s.driverVersionRef(doc), models.NewDriverVersion(&updated))
+	})
+}
+
+func (s *FirestoreStore) ImportDrivers(ctx context.Context, drivers []*models.Driver, replace, dryRun bool) ([]ImportResult, error) {
+	refs := make([]*firestore.DocumentRef, len(drivers))
+	for i, driver := range drivers {
+		refs[i] = s.client.Collection("drivers").Doc(string(*driver.CPF))
+	}
+
+	// CPFs already registered, and the ones seen on drivers
+	exist := make(map[string]bool)
+	// the registered Drivers, to keep the values of the ones added before
+	// versions were kept
+	registered := make(map[string]*firestore.DocumentSnapshot)
+	for start := 0; start < len(refs); start += maxBatchWrites {
+		end := start + maxBatchWrites
+		if end > len(refs) {
+			end = len(refs)
+		}
+
+		docs, err := s.client.GetAll(ctx, refs[start:end])
+		if err != nil {
+			return nil, err
+		}
+		for _, doc := range docs {
+			if doc.Exists() {
+				exist[doc.Ref.ID] = true
+				registered[doc.Ref.ID] = doc
+			}
+		}
+	}
+
+	results := make([]ImportResult, len(drivers))
+	writer := newBatchWriter(s.client)
+	for i, driver := range drivers {
+		cpf := string(*driver.CPF)
+		switch {
+		case !exist[cpf]:
+			results[i] = ImportCreated
+		case replace:
+			results[i] = ImportReplaced
+		default:
+			results[i] = ImportSkipped
+		}
+		exist[cpf] = true
+
+		if dryRun || results[i] == ImportSkipped {
+			continue
+		}
+
+		if snapshot := registered[cpf]; snapshot != nil {
+			// only the first time a CPF is replaced
+			delete(registered, cpf)
+			if err := s.addLegacyVersion(ctx, writer, snapshot); err != nil {
+				return nil, err
+			}
+		}
+
+		// Set instead of Create, so a Driver registered meanwhile is
+		// replaced, instead of failing the whole batch
+		err := writer.write(ctx, 2, func(b *firestore.WriteBatch) {
+			b.Set(refs[i], driver)
+			b.Create(s.driverVersionRef(refs[i]), models.NewDriverVersion(driver))
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := writer.flush(ctx); err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+// addLegacyVersion adds the values of a Driver added before versions were
+// kept as it's first version, if it has no history
+func (s *FirestoreStore) addLegacyVersion(ctx context.Context, writer *batchWriter,
+	snapshot *firestore.DocumentSnapshot) error {
+	history, err := snapshot.Ref.Collection("history").Limit(1).Documents(ctx).GetAll()
+	if err != nil || len(history) > 0 {
+		return err
+	}
+
+	var driver models.Driver
+	if err = snapshot.DataTo(&driver); err != nil {
+		return err
+	}
+	driver.UpdateTime = snapshot.UpdateTime
+
+	return writer.write(ctx, 1, func(b *firestore.WriteBatch) {
+		b.Create(s.driverVersionRef(snapshot.Ref), models.NewDriverVersion(&driver))
+	})
+}
+
+func (s *FirestoreStore) GetDriverHistory(ctx context.Context, cpf string) ([]*models.DriverVersion, error) {
+	docs, err := s.client.Collection("drivers").Doc(cpf).Collection("history").
+		OrderBy("valid_from", firestore.Asc).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+
+	history := make([]*models.DriverVersion, len(docs))
+	for i, doc := range docs {
+		var version models.DriverVersion
+		if err = doc.DataTo(&version); err != nil {
+			return nil, err
+		}
+
+		history[i] = &version
+	}
+
+	return history, nil
+}
+
+// driverVersionRef is a new document on the history of a Driver
+func (s *FirestoreStore) driverVersionRef(driverRef *firestore.DocumentRef) *firestore.DocumentRef {
+	return driverRef.Collection("history").NewDoc()
+}
+
+func (s *FirestoreStore) EraseDriver(ctx context.Context, cpf string, keepTrips bool) (*Erasure, error) {
+	driverRef := s.client.Collection("drivers").Doc(cpf)
+	driverSnapshot, err := driverRef.Get(ctx)
+	if err != nil && status.Code(err) != codes.NotFound {
+		return nil, err
+	}
+
+	// whatever the layout, the Driver's Trips may exist on both the
+	// subcollection and the top level collection (during a migration)
+	subcollectionTrips, err := driverRef.Collection("trips").Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+	topLevelTrips, err := s.client.Collection("trips").Where("driver_id", "==", cpf).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+	corrections, err := driverRef.Collection("trip_corrections").DocumentRefs(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+	history, err := driverRef.Collection("history").DocumentRefs(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+	requests, err := s.client.Collection("idempotency_keys").Where("driver_id", "==", cpf).Select().Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+
+	var erasure Erasure
+	erasure.DriverDeleted = driverSnapshot.Exists()
+	if !erasure.DriverDeleted && len(subcollectionTrips)+len(topLevelTrips) == 0 {
+		return nil, ErrNotFound
+	}
+
+	anonymousID := newAnonymousDriverID()
+	writer := newBatchWriter(s.client)
+	// the time keys of the Driver's Trips go as well (they have the CPF)
+	for _, doc := range append(subcollectionTrips, topLevelTrips...) {
+		tripTime, ok := doc.Data()["time"].(time.Time)
+		if !ok {
+			continue
+		}
+		err = writer.write(ctx, 1, func(b *firestore.WriteBatch) {
+			b.Delete(s.tripTimeRef(cpf, tripTime))
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, doc := range subcollectionTrips {
+		if keepTrips {
+			// the subcollection's path contains the CPF, so the Trip is
+			// moved under the pseudonym
+			data := doc.Data()
+			data["driver_id"] = anonymousID
+			newRef := s.client.Collection("drivers").Doc(anonymousID).Collection("trips").Doc(doc.Ref.ID)
+			err = writer.write(ctx, 2, func(b *firestore.WriteBatch) {
+				b.Create(newRef, data)
+				b.Delete(doc.Ref)
+			})
+			erasure.TripsAnonymized++
+		} else {
+			err = writer.write(ctx, 1, func(b *firestore.WriteBatch) {
+				b.Delete(doc.Ref)
+			})
+			erasure.TripsDeleted++
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, doc := range topLevelTrips {
+		if keepTrips {
+			err = writer.write(ctx, 1, func(b *firestore.WriteBatch) {
+				b.Update(doc.Ref, []firestore.Update{{Path: "driver_id", Value: anonymousID}})
+			})
+			erasure.TripsAnonymized++
+		} else {
+			err = writer.write(ctx, 1, func(b *firestore.WriteBatch) {
+				b.Delete(doc.Ref)
+			})
+			erasure.TripsDeleted++
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// corrections have the Trips' IDs, which would identify the Driver,
+	// the history has the Driver's personal data and the responses of
+	// it's idempotent requests have it's Trips
+	refs := append(corrections, history...)
+	for _, doc := range requests {
+		refs = append(refs, doc.Ref)
+	}
+	for _, ref := range refs {
+		ref := ref
+		err = writer.write(ctx, 1, func(b *firestore.WriteBatch) {
+			b.Delete(ref)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// the Driver goes last, so a failed erasure can be retried
+	err = writer.write(ctx, 1, func(b *firestore.WriteBatch) {
+		b.Delete(driverRef)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err = writer.flush(ctx); err != nil {
+		return nil, err
+	}
+
+	return &erasure, nil
+}
+
+func (s *FirestoreStore) AddTrip(ctx context.Context, trip *models.Trip) error {
+	collection, q := s.driverTrips(string(*trip.DriverID))
+
+	// Trips created before time keys existed can only be found by query
+	docs, err := q.Where("time", "==", *trip.Time).Limit(1).Documents(ctx).GetAll()
+	if err != nil {
+		return err
+	}
+	if len(docs) > 0 {
+		return ErrConflict
+	}
+
+	// the time key and the Trip are created atomically, so concurrent
+	// requests for the same Driver and time can't both succeed
+	batch := s.client.Batch()
+	batch.Create(s.tripTimeRef(string(*trip.DriverID), *trip.Time), map[string]interface{}{
+		"trip_id": trip.ID,
+	})
+	batch.Create(collection.Doc(trip.ID), trip)
+	_, err = batch.Commit(ctx)
+	if status.Code(err) == codes.AlreadyExists {
+		return ErrConflict
+	}
+
+	return err
+}
+
+// maxBatchTrips is how many Trips fit on a WriteBatch (500 writes), since
+// each one also has a time key
+const maxBatchTrips = 250
+
+func (s *FirestoreStore) AddTrips(ctx context.Context, trips []*models.Trip) ([]error, error) {
+	results := make([]error, len(trips))
+
+	// the existing times of each Driver are read with a single query, for
+	// the time range of the Driver's Trips on the batch
+	byDriver := make(map[string][]int)
+	for i, trip := range trips {
+		byDriver[string(*trip.DriverID)] = append(byDriver[string(*trip.DriverID)], i)
+	}
+	for driverID, indexes := range byDriver {
+		from, to := *trips[indexes[0]].Time, *trips[indexes[0]].Time
+		for _, i := range indexes {
+			if trips[i].Time.Before(from) {
+				from = *trips[i].Time
+			}
+			if trips[i].Time.After(to) {
+				to = *trips[i].Time
+			}
+		}
+
+		_, q := s.driverTrips(driverID)
+		docs, err := q.Where("time", ">=", from).Where("time", "<=", to).Select("time").Documents(ctx).GetAll()
+		if err != nil {
+			return nil, err
+		}
+
+		existing := make(map[int64]bool)
+		for _, doc := range docs {
+			if t, ok := doc.Data()["time"].(time.Time); ok {
+				existing[t.UnixNano()/int64(time.Microsecond)] = true
+			}
+		}
+		for _, i := range indexes {
+			key := trips[i].Time.UnixNano() / int64(time.Microsecond)
+			if existing[key] {
+				results[i] = ErrConflict
+			}
+			existing[key] = true
+		}
+	}
+
+	pending := make([]int, 0)
+	for i := range trips {
+		if results[i] == nil {
+			pending = append(pending, i)
+		}
+	}
+	for start := 0; start < len(pending); start += maxBatchTrips {
+		end := start + maxBatchTrips
+		if end > len(pending) {
+			end = len(pending)
+		}
+
+		batch := s.client.Batch()
+		for _, i := range pending[start:end] {
+			collection, _ := s.driverTrips(string(*trips[i].DriverID))
+			batch.Create(s.tripTimeRef(string(*trips[i].DriverID), *trips[i].Time), map[string]interface{}{
+				"trip_id": trips[i].ID,
+			})
+			batch.Create(collection.Doc(trips[i].ID), trips[i])
+		}
+		_, err := batch.Commit(ctx)
+		if status.Code(err) == codes.AlreadyExists {
+			// another request added one of the Trips meanwhile, so
+			// they're added one by one to find out which
+			for _, i := range pending[start:end] {
+				results[i] = s.AddTrip(ctx, trips[i])
+				if results[i] != nil && results[i] != ErrConflict {
+					return nil, results[i]
+				}
+			}
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	return results, nil
+}
+
+func (s *FirestoreStore) UpdateTrip(ctx context.Context, old, trip *models.Trip, correction *models.TripCorrection) error {
+	driverID := string(*old.DriverID)
+	collection, q := s.driverTrips(driverID)
+
+	err := s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		oldRef, err := s.findTripRef(tx, old)
+		if err != nil {
+			return err
+		}
+
+		if !trip.Time.Equal(*old.Time) {
+			// Trips added before the time keys don't have one
+			docs, err := tx.Documents(q.Where("time", "==", *trip.Time).Select()).GetAll()
+			if err != nil {
+				return err
+			}
+			if len(docs) > 0 {
+				return ErrConflict
+			}
+
+			// the time key moves with the Trip, creating it fails if a
+			// concurrent request took the time meanwhile
+			err = tx.Create(s.tripTimeRef(driverID, *trip.Time), map[string]interface{}{
+				"trip_id": trip.ID,
+			})
+			if err != nil {
+				return err
+			}
+			if err = tx.Delete(s.tripTimeRef(driverID, *old.Time)); err != nil {
+				return err
+			}
+		}
+
+		if trip.ID != old.ID {
+			if err = tx.Delete(oldRef); err != nil {
+				return err
+			}
+			if err = tx.Create(collection.Doc(trip.ID), trip); err != nil {
+				return err
+			}
+		} else if err = tx.Set(oldRef, trip); err != nil {
+			return err
+		}
+
+		return tx.Create(s.tripCorrectionRef(correction), correction)
+	})
+	if status.Code(err) == codes.AlreadyExists {
+		return ErrConflict
+	}
+
+	return err
+}
+
+func (s *FirestoreStore) DeleteTrip(ctx context.Context, trip *models.Trip, correction *models.TripCorrection) error {
+	driverID := string(*trip.DriverID)
+
+	return s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		ref, err := s.findTripRef(tx, trip)
+		if err != nil {
+			return err
+		}
+
+		if err = tx.Delete(ref); err != nil {
+			return err
+		}
+		if err = tx.Delete(s.tripTimeRef(driverID, *trip.Time)); err != nil {
+			return err
+		}
+
+		return tx.Create(s.tripCorrectionRef(correction), correction)
+	})
+}
+
+func (s *FirestoreStore) GetTripCorrections(ctx context.Context, driverID string) ([]*models.TripCorrection, error) {
+	docs, err := s.client.Collection("drivers").Doc(driverID).Collection("trip_corrections").
+		OrderBy("time", firestore.Asc).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+
+	corrections := make([]*models.TripCorrection, len(docs))
+	for i, doc := range docs {
+		var correction models.TripCorrection
+		if err = doc.DataTo(&correction); err != nil {
+			return nil, err
+		}
+
+		corrections[i] = &correction
+	}
+
+	return corrections, nil
+}
+
+// findTripRef returns the document of a Driver's Trip, ErrNotFound, or
+// ErrPreconditionFailed if it's values aren't trip's anymore. It's found
+// by the Trip's ID field, since Trips added before their ID was the
+// document's ID have a random one.
+func (s *FirestoreStore) findTripRef(tx *firestore.Transaction, trip *models.Trip) (*firestore.DocumentRef, error) {
+	_, q := s.driverTrips(string(*trip.DriverID))
+	docs, err := tx.Documents(q.Where("id", "==", trip.ID).Limit(1)).GetAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(docs) == 0 {
+		return nil, ErrNotFound
+	}
+
+	var stored models.Trip
+	if err = docs[0].DataTo(&stored); err != nil {
+		return nil, err
+	}
+	if !sameTripValues(&stored, trip) {
+		return nil, ErrPreconditionFailed
+	}
+
+	return docs[0].Ref, nil
+}
+
+// tripCorrectionRef is the document of a correction, under the Driver,
+// whatever the TripsLayout, so corrections survive the Trip's deletion
+func (s *FirestoreStore) tripCorrectionRef(correction *models.TripCorrection) *firestore.DocumentRef {
+	return s.client.Collection("drivers").Doc(correction.DriverID).Collection("trip_corrections").Doc(correction.ID)
+}
+
+// driverTrips returns the collection where a Driver's Trips are added,
+// and a query for them, according to the TripsLayout
+func (s *FirestoreStore) driverTrips(driverID string) (*firestore.CollectionRef, firestore.Query) {
+	if s.layout == TopLevelTrips {
+		collection := s.client.Collection("trips")
+		return collection, collection.Where("driver_id", "==", driverID)
+	}
+
+	collection := s.client.Collection("drivers").Doc(driverID).Collection("trips")
+	return collection, collection.Query
+}
+
+// tripTimeRef is the document that makes a Driver's Trips unique by time,
+// since the Trips' own IDs are random. Firestore keeps times with
+// microsecond precision.
+func (s *FirestoreStore) tripTimeRef(driverID string, t time.Time) *firestore.DocumentRef {
+	return s.client.Collection("trip_times").Doc(fmt.Sprintf("%s_%d", driverID, t.UnixNano()/int64(time.Microsecond)))
+}
+
+func (s *FirestoreStore) GetTrips(ctx context.Context, filter TripFilter) ([]*models.Trip, string, error) {
+	docs := make([]*firestore.DocumentSnapshot, 0)
+	trips := make([]*models.Trip, 0)
+	err := s.eachTripDocument(ctx, filter, func(doc *firestore.DocumentSnapshot, trip *models.Trip) error {
+		docs = append(docs, doc)
+		trips = append(trips, trip)
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	nextPageToken := ""
+	if filter.PageSize > 0 && len(trips) > filter.PageSize {
+		docs = docs[:filter.PageSize]
+		trips = trips[:filter.PageSize]
+
+		nextPageToken = encodeCursor(cursor{
+			Time: trips[len(trips)-1].Time,
+			Key:  documentPath(docs[len(docs)-1].Ref),
+		})
+	}
+
+	// remove fields that were only read for filtering or pagination
+	if _, reproject := tripSelection(filter); reproject {
+		for i, trip := range trips {
+			trips[i] = selectTripFields(trip, filter.Fields)
+		}
+	}
+
+	return trips, nextPageToken, nil
+}
+
+func (s *FirestoreStore) EachTrip(ctx context.Context, filter TripFilter, fn func(trip *models.Trip) error) error {
+	filter.PageSize, filter.PageToken = 0, ""
+	_, reproject := tripSelection(filter)
+
+	return s.eachTripDocument(ctx, filter, func(doc *firestore.DocumentSnapshot, trip *models.Trip) error {
+		if reproject {
+			trip = selectTripFields(trip, filter.Fields)
+		}
+		return fn(trip)
+	})
+}
+
+// eachTripDocument calls fn with each Trip of the query of filter, up to
+// it's limit (or page size plus one, to know whether there's a next page)
+func (s *FirestoreStore) eachTripDocument(ctx context.Context, filter TripFilter,
+	fn func(doc *firestore.DocumentSnapshot, trip *models.Trip) error) error {
+	q, err := s.createTripsQuery(filter)
+	if err != nil {
+		return err
+	}
+
+	maxDocs := filter.Limit
+	if filter.PageSize > 0 {
+		maxDocs = filter.PageSize + 1
+	}
+
+	// when documents are skipped while reading, the query is read in
+	// chunks (growing up to maxTripsChunk) until there are maxDocs Trips,
+	// instead of reading every matching document
+	chunk := 0
+	if maxDocs > 0 && s.skipsTripDocuments(filter) {
+		chunk = maxDocs
+	}
+
+	n := 0
+	var last *firestore.DocumentSnapshot
+	for {
+		chunkQuery := q
+		if chunk > 0 {
+			chunkQuery = q.Limit(chunk)
+			if last != nil {
+				chunkQuery = chunkQuery.StartAfter(last)
+			}
+		}
+
+		read := 0
+		err := func() error {
+			iter := chunkQuery.Documents(ctx)
+			defer iter.Stop()
+
+			for maxDocs <= 0 || n < maxDocs {
+				docSnapShot, err := iter.Next()
+				if err == iterator.Done {
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+				read++
+				last = docSnapShot
+
+				// the "trips" collection group also matches the top level
+				// collection, which may have already been (partially) migrated
+				if s.layout == SubcollectionTrips && docSnapShot.Ref.Parent.Parent == nil {
+					continue
+				}
+
+				var trip models.Trip
+				if err = docSnapShot.DataTo(&trip); err != nil {
+					return err
+				}
+
+				// geohash cells only narrow down the Trips
+				if !inTripAreas(&trip, filter) {
+					continue
+				}
+
+				if err = fn(docSnapShot, &trip); err != nil {
+					return err
+				}
+				n++
+			}
+
+			return nil
+		}()
+		if err != nil {
+			return err
+		}
+
+		// the query ran out of documents, or there are enough Trips
+		if chunk == 0 || read < chunk || n >= maxDocs {
+			return nil
+		}
+		if chunk *= 2; chunk > maxTripsChunk {
+			chunk = maxTripsChunk
+		}
+	}
+}
+
+// skipsTripDocuments reports whether some documents of the query of filter
+// may be skipped while reading: the top level ones of a collection group,
+// and the ones the geohash cells of an area matched, but are out of it
+func (s *FirestoreStore) skipsTripDocuments(filter TripFilter) bool {
+	return s.layout == SubcollectionTrips || filter.Origin != nil || filter.Destination != nil
+}
+
+// cursorDocumentID returns the value of a DocumentID ordering for the
+// document at path (relative to the database root, as on page tokens).
+// The client expects it relative to the query's path: the "trips"
+// collection for TopLevelTrips, and the database for a collection group.
+func (s *FirestoreStore) cursorDocumentID(path string) string {
+	if s.layout == TopLevelTrips {
+		return strings.TrimPrefix(path, "trips/")
+	}
+
+	return "documents/" + path
+}
+
+func (s *FirestoreStore) createDriversQuery(filter DriverFilter) (firestore.Query, error) {
+	q := s.client.Collection("drivers").Query
+
+	if len(filter.CPF) > 0 {
+		q = q.Where("cpf", "==", filter.CPF) // TODO: query for the document ID
+	}
+	if len(filter.Gender) > 0 {
+		q = q.Where("gender", "==", filter.Gender)
+	}
+	if filter.HasVehicle != nil {
+		q = q.Where("has_vehicle", "==", *filter.HasVehicle)
+	}
+	if len(filter.CNHType) > 0 {
+		q = q.Where("cnh_type", "==", filter.CNHType)
+	}
+	if filter.PageSize > 0 {
+		q = q.OrderBy(firestore.DocumentID, firestore.Asc).Limit(filter.PageSize + 1)
+	}
+	if len(filter.PageToken) > 0 {
+		after, err := decodeCursor(filter.PageToken)
+		if err != nil {
+			return q, err
+		}
+		q = q.StartAfter(after.Key)
+	}
+
+	// get only requested fields
+	if len(filter.Fields) > 0 {
+		q = q.Select(filter.Fields...)
+	}
+
+	return q, nil
+}
+
+func (s *FirestoreStore) createTripsQuery(filter TripFilter) (firestore.Query, error) {
+	q := s.client.Collection("trips").Query
+	if s.layout == SubcollectionTrips {
+		q = s.client.CollectionGroup("trips").Query
+	}
+
+	// add filters
+	if len(filter.DriverID) > 0 {
+		q = q.Where("driver_id", "==", filter.DriverID)
+	}
+	if len(filter.ID) > 0 {
+		q = q.Where("id", "==", filter.ID)
+	}
+	if len(filter.LegacyID) > 0 {
+		q = q.Where("legacy_id", "==", filter.LegacyID)
+	}
+	if filter.HasLoad != nil {
+		q = q.Where("has_load", "==", *filter.HasLoad)
+	}
+	if filter.VehicleType != nil {
+		q = q.Where("vehicle_type", "==", *filter.VehicleType)
+	}
+	if filter.Time != nil {
+		q = q.Where("time", "==", *filter.Time)
+	}
+	if filter.From != nil {
+		q = q.Where("time", ">=", *filter.From)
+	}
+	if filter.To != nil {
+		q = q.Where("time", "<", *filter.To)
+	}
+	// areas are narrowed down by geohash cells (the indexes of these
+	// queries are on firestore.indexes.json)
+	if field, cells := geohashFilter(filter); len(cells) > 0 {
+		q = q.Where(field, "array-contains-any", cells)
+	}
+
+	direction := firestore.Desc
+	if filter.Ascending {
+		direction = firestore.Asc
+	}
+	q = q.OrderBy("time", direction)
+
+	if filter.PageSize > 0 {
+		// Trips with the same time are ordered by their path
+		q = q.OrderBy(firestore.DocumentID, direction)
+	}
+	if len(filter.PageToken) > 0 {
+		after, err := decodeTripCursor(filter.PageToken)
+		if err != nil {
+			return q, err
+		}
+		q = q.StartAfter(*after.Time, s.cursorDocumentID(after.Key))
+	}
+
+	// when documents may be skipped, eachTripDocument limits each chunk
+	if !s.skipsTripDocuments(filter) {
+		if filter.PageSize > 0 {
+			q = q.Limit(filter.PageSize + 1)
+		} else if filter.Limit > 0 {
+			q = q.Limit(filter.Limit)
+		}
+	}
+
+	// get only requested fields
+	if fields, _ := tripSelection(filter); len(fields) > 0 {
+		q = q.Select(fields...)
+	}
+
+	return q, nil
+}
+
+// documentPath returns the path of a document relative to the database
+// root, e.g.: "drivers/48372162000/trips/01E1199GJ0VM7HF4AQGJRPE0V3"
+func documentPath(ref *firestore.DocumentRef) string {
+	path := ref.ID
+	for parent := ref.Parent; parent != nil; {
+		path = parent.ID + "/" + path
+		if parent.Parent == nil {
+			break
+		}
+		path = parent.Parent.ID + "/" + path
+		parent = parent.Parent.Parent
+	}
+
+	return path
+}
+
+// Firestore doesn't accept more than 500 writes per batch
+const maxBatchWrites = 500
+
+// idempotencyRef is the document of an idempotent request. Keys are
+// chosen by clients, so they're hashed into a valid document ID.
+func (s *FirestoreStore) idempotencyRef(key string) *firestore.DocumentRef {
+	return s.client.Collection("idempotency_keys").Doc(fmt.Sprintf("%x", sha256.Sum256([]byte(key))))
+}
+
+func (s *FirestoreStore) BeginIdempotentRequest(ctx context.Context, req *IdempotentRequest) (*IdempotentRequest, error) {
+	ref := s.idempotencyRef(req.Key)
+
+	var existing *IdempotentRequest
+	err := s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		existing = nil
+
+		doc, err := tx.Get(ref)
+		if err != nil && status.Code(err) != codes.NotFound {
+			return err
+		}
+		if doc != nil && doc.Exists() {
+			var stored IdempotentRequest
+			if err = doc.DataTo(&stored); err != nil {
+				return err
+			}
+			if stored.ExpiresAt.After(time.Now()) {
+				existing = &stored
+				return nil
+			}
+		}
+
+		return tx.Set(ref, req)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return existing, nil
+}
+
+func (s *FirestoreStore) CompleteIdempotentRequest(ctx context.Context, req *IdempotentRequest) error {
+	completed := *req
+	completed.Completed = true
+
+	_, err := s.idempotencyRef(req.Key).Set(ctx, &completed)
+	return err
+}
+
+func (s *FirestoreStore) ReleaseIdempotentRequest(ctx context.Context, key string) error {
+	_, err := s.idempotencyRef(key).Delete(ctx)
+	return err
+}
+
+func (s *FirestoreStore) AddAPIKey(ctx context.Context, key *models.APIKey) error {
+	_, err := s.client.Collection("api_keys").Doc(key.ID).Create(ctx, key)
+	if status.Code(err) == codes.AlreadyExists {
+		return ErrConflict
+	}
+
+	return err
+}
+
+func (s *FirestoreStore) GetAPIKeys(ctx context.Context) ([]*models.APIKey, error) {
+	docs, err := s.client.Collection("api_keys").OrderBy("create_time", firestore.Asc).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]*models.APIKey, len(docs))
+	for i, doc := range docs {
+		var key models.APIKey
+		if err = doc.DataTo(&key); err != nil {
+			return nil, err
+		}
+
+		keys[i] = &key
+	}
+
+	return keys, nil
+}
+
+func (s *FirestoreStore) GetAPIKeyByHash(ctx context.Context, hash string) (*models.APIKey, error) {
+	docs, err := s.client.Collection("api_keys").Where("hash", "==", hash).Limit(1).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(docs) == 0 {
+		return nil, ErrNotFound
+	}
+
+	var key models.APIKey
+	if err = docs[0].DataTo(&key); err != nil {
+		return nil, err
+	}
+
+	return &key, nil
+}
+
+func (s *FirestoreStore) DeleteAPIKey(ctx context.Context, id string) error {
+	_, err := s.client.Collection("api_keys").Doc(id).Delete(ctx, firestore.Exists)
+	if status.Code(err) == codes.NotFound {
+		return ErrNotFound
+	}
+
+	return err
+}
+
+// batchWriter groups writes into as few WriteBatches as possible. Writes
+// added by the same call to write are always committed together.
+type batchWriter struct {
+	client *firestore.Client
+	batch  *firestore.WriteBatch
+	writes int
+}
+
+func newBatchWriter(client *firestore.Client) *batchWriter {
+	return &batchWriter{
+		client: client,
+		batch:  client.Batch(),
+	}
+}
+
+// write adds the n writes of f to the current batch, committing it first
+// if they wouldn't fit
+func (w *batchWriter) write(ctx context.Context, n int, f func(b *firestore.WriteBatch)) error {
+	if w.writes+n > maxBatchWrites {
+		if err := w.flush(ctx); err != nil {
+			return err
+		}
+	}
+
+	f(w.batch)
+	w.writes += n
+
+	return nil
+}
+
+func (w *batchWriter) flush(ctx context.Context) error {
+	if w.writes == 0 {
+		return nil
+	}
+
+	_, err := w.batch.Commit(ctx)
+	w.batch = w.client.Batch()
+	w.writes = 0
+
+	return err
+}
@@ -0,0 +1,183 @@
+package store
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/genproto/googleapis/type/latlng"
+
+	"github.com/rafaft/truck-pad/geo"
+	"github.com/rafaft/truck-pad/models"
+)
+
+func TestParseTripsLayout(t *testing.T) {
+	tests := []struct {
+		s      string
+		layout TripsLayout
+		err    bool
+	}{
+		{"", SubcollectionTrips, false},
+		{"subcollection", SubcollectionTrips, false},
+		{"toplevel", TopLevelTrips, false},
+		{"TopLevel", 0, true},
+	}
+	for _, test := range tests {
+		layout, err := ParseTripsLayout(test.s)
+		if (err != nil) != test.err || layout != test.layout {
+			t.Errorf("%q: got %v, %v", test.s, layout, err)
+		}
+	}
+}
+
+func newFirestoreTestTrip(t *testing.T, cpf string, tripTime time.Time) *models.Trip {
+	t.Helper()
+
+	driverID := models.DriverID(cpf)
+	hasLoad := true
+	vehicleType := models.VehicleType(1)
+	trip := &models.Trip{
+		DriverID:    &driverID,
+		HasLoad:     &hasLoad,
+		VehicleType: &vehicleType,
+		Time:        &tripTime,
+		Origin:      &latlng.LatLng{Latitude: -23.55, Longitude: -46.63},
+		Destination: &latlng.LatLng{Latitude: -22.9, Longitude: -43.2},
+	}
+	if err := trip.SetID(); err != nil {
+		t.Fatal(err)
+	}
+	if err := trip.SetGeohashes(); err != nil {
+		t.Fatal(err)
+	}
+
+	return trip
+}
+
+// TestFirestoreTripsLayouts runs against the Firestore emulator, it's
+// skipped unless FIRESTORE_EMULATOR_HOST is set
+func TestFirestoreTripsLayouts(t *testing.T) {
+	if os.Getenv("FIRESTORE_EMULATOR_HOST") == "" {
+		t.Skip("FIRESTORE_EMULATOR_HOST is not set")
+	}
+
+	ctx := context.Background()
+	client, err := firestore.NewClient(ctx, "truck-pad-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	for _, layout := range []TripsLayout{SubcollectionTrips, TopLevelTrips} {
+		s := NewFirestoreStore(client, layout)
+		cpf := "52998224725"
+		defer s.EraseDriver(ctx, cpf, false)
+
+		tripTime := time.Date(2020, 2, 14, 15, 0, 0, 0, time.UTC)
+		trip := newFirestoreTestTrip(t, cpf, tripTime)
+		if err = s.AddTrip(ctx, trip); err != nil {
+			t.Fatalf("layout=%d: %v", layout, err)
+		}
+		if err = s.AddTrip(ctx, newFirestoreTestTrip(t, cpf, tripTime)); err != ErrConflict {
+			t.Errorf("layout=%d: got %v adding a trip at the same time, want ErrConflict", layout, err)
+		}
+
+		found, _, err := s.GetTrips(ctx, TripFilter{DriverID: cpf, ID: trip.ID})
+		if err != nil {
+			t.Fatalf("layout=%d: %v", layout, err)
+		}
+		if len(found) != 1 || found[0].ID != trip.ID {
+			t.Errorf("layout=%d: got %d trips, want trip=%s", layout, len(found), trip.ID)
+		}
+		found, _, err = s.GetTrips(ctx, TripFilter{DriverID: cpf, LegacyID: "20200214150000"})
+		if err != nil {
+			t.Fatalf("layout=%d: %v", layout, err)
+		}
+		if len(found) != 1 || found[0].ID != trip.ID {
+			t.Errorf("layout=%d: got %d trips by legacy_id, want trip=%s", layout, len(found), trip.ID)
+		}
+
+		// pages of an area are read in chunks, with a cursor after each
+		later := newFirestoreTestTrip(t, cpf, tripTime.Add(time.Hour))
+		if err = s.AddTrip(ctx, later); err != nil {
+			t.Fatalf("layout=%d: %v", layout, err)
+		}
+		token := ""
+		for _, want := range []string{later.ID, trip.ID} {
+			found, token, err = s.GetTrips(ctx, TripFilter{
+				DriverID:    cpf,
+				Destination: geo.NewCircle(-22.9, -43.2, 10),
+				Fields:      []string{"id"},
+				PageSize:    1,
+				PageToken:   token,
+			})
+			if err != nil {
+				t.Fatalf("layout=%d: %v", layout, err)
+			}
+			if len(found) != 1 || found[0].ID != want {
+				t.Errorf("layout=%d: got %d trips, want trip=%s", layout, len(found), want)
+			}
+		}
+		if err = s.DeleteTrip(ctx, later, models.NewTripCorrection(later, nil)); err != nil {
+			t.Errorf("layout=%d: %v", layout, err)
+		}
+
+		correction := models.NewTripCorrection(trip, nil)
+		if err = s.DeleteTrip(ctx, trip, correction); err != nil {
+			t.Errorf("layout=%d: %v", layout, err)
+		}
+		if err = s.DeleteTrip(ctx, trip, correction); err != ErrNotFound {
+			t.Errorf("layout=%d: got %v deleting a deleted trip, want ErrNotFound", layout, err)
+		}
+		if _, err = s.EraseDriver(ctx, cpf, false); err != nil && err != ErrNotFound {
+			t.Fatalf("layout=%d: %v", layout, err)
+		}
+	}
+}
+
+// TestFirestoreLegacyTrip checks that Trips added with random document
+// IDs, before the Trip's ID was the document's, can be corrected
+func TestFirestoreLegacyTrip(t *testing.T) {
+	if os.Getenv("FIRESTORE_EMULATOR_HOST") == "" {
+		t.Skip("FIRESTORE_EMULATOR_HOST is not set")
+	}
+
+	ctx := context.Background()
+	client, err := firestore.NewClient(ctx, "truck-pad-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	s := NewFirestoreStore(client, SubcollectionTrips)
+	cpf := "48372162000"
+	defer s.EraseDriver(ctx, cpf, false)
+
+	tripTime := time.Date(2019, 6, 1, 12, 0, 0, 0, time.FixedZone("-03", -3*60*60))
+	legacy := newFirestoreTestTrip(t, cpf, tripTime)
+	legacy.ID = tripTime.Format("20060102150405")
+	if _, _, err = client.Collection("drivers").Doc(cpf).Collection("trips").Add(ctx, legacy); err != nil {
+		t.Fatal(err)
+	}
+
+	corrected := *legacy
+	vehicleType := models.VehicleType(3)
+	corrected.VehicleType = &vehicleType
+	if err = s.UpdateTrip(ctx, legacy, &corrected, models.NewTripCorrection(legacy, &corrected)); err != nil {
+		t.Fatal(err)
+	}
+
+	found, _, err := s.GetTrips(ctx, TripFilter{DriverID: cpf, ID: legacy.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 1 || *found[0].VehicleType != vehicleType {
+		t.Fatalf("got %d trips, want the corrected trip=%s", len(found), legacy.ID)
+	}
+
+	if err = s.DeleteTrip(ctx, &corrected, models.NewTripCorrection(&corrected, nil)); err != nil {
+		t.Fatal(err)
+	}
+}
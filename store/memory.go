@@ -0,0 +1,591 @@
+package store
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rafaft/truck-pad/models"
+)
+
+// MemoryStore implements Store keeping everything in memory. It's meant
+// for tests and local development, data is lost when the process exits.
+type MemoryStore struct {
+	mu       sync.RWMutex
+	drivers  map[string]*models.Driver
+	trips    []*models.Trip
+	requests map[string]*IdempotentRequest
+	// the corrections of each Driver's Trips
+	corrections map[string][]*models.TripCorrection
+	// the versions of each Driver
+	history map[string][]*models.DriverVersion
+	apiKeys []*models.APIKey
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		drivers:     make(map[string]*models.Driver),
+		trips:       make([]*models.Trip, 0),
+		requests:    make(map[string]*IdempotentRequest),
+		corrections: make(map[string][]*models.TripCorrection),
+		history:     make(map[string][]*models.DriverVersion),
+		apiKeys:     make([]*models.APIKey, 0),
+	}
+}
+
+func (s *MemoryStore) AddDriver(ctx context.Context, driver *models.Driver) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cpf := string(*driver.CPF)
+	if _, exist := s.drivers[cpf]; exist {
+		return ErrConflict
+	}
+
+	driver.UpdateTime = time.Now().UTC()
+	stored := *driver
+	stored.Age = 0
+	s.drivers[cpf] = &stored
+	s.addVersion(&stored)
+
+	return nil
+}
+
+func (s *MemoryStore) GetDrivers(ctx context.Context, filter DriverFilter) ([]*models.Driver, string, error) {
+	var after *cursor
+	if len(filter.PageToken) > 0 {
+		var err error
+		if after, err = decodeCursor(filter.PageToken); err != nil {
+			return nil, "", err
+		}
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	matched := s.findDrivers(filter, after)
+
+	nextPageToken := ""
+	if filter.PageSize > 0 && len(matched) > filter.PageSize {
+		matched = matched[:filter.PageSize]
+		nextPageToken = encodeCursor(cursor{Key: string(*matched[len(matched)-1].CPF)})
+	}
+
+	result := make([]*models.Driver, len(matched))
+	for i, driver := range matched {
+		result[i] = SelectDriverFields(driver, filter.Fields)
+	}
+
+	return result, nextPageToken, nil
+}
+
+// EachDriver only holds the lock while finding the Drivers, each one is
+// copied as it's passed to fn. Stored Drivers are replaced on updates,
+// never changed, so they're still the ones that were found.
+func (s *MemoryStore) EachDriver(ctx context.Context, filter DriverFilter, fn func(driver *models.Driver) error) error {
+	s.mu.RLock()
+	matched := s.findDrivers(filter, nil)
+	s.mu.RUnlock()
+
+	for _, driver := range matched {
+		// like the other stores, reading stops when the request is canceled
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(SelectDriverFields(driver, filter.Fields)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// findDrivers returns the stored Drivers of filter after the cursor,
+// ordered by CPF. The caller must hold the lock.
+func (s *MemoryStore) findDrivers(filter DriverFilter, after *cursor) []*models.Driver {
+	matched := make([]*models.Driver, 0)
+	for _, driver := range s.drivers {
+		if after != nil && string(*driver.CPF) <= after.Key {
+			continue
+		}
+		if matchDriver(driver, filter) {
+			matched = append(matched, driver)
+		}
+	}
+
+	// Firestore returns documents ordered by ID
+	sort.Slice(matched, func(i, j int) bool {
+		return *matched[i].CPF < *matched[j].CPF
+	})
+
+	return matched
+}
+
+func (s *MemoryStore) UpdateDriver(ctx context.Context, cpf string, driver *models.Driver, lastUpdateTime time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, exist := s.drivers[cpf]
+	if !exist {
+		return ErrNotFound
+	}
+	if !lastUpdateTime.IsZero() && !stored.UpdateTime.Equal(lastUpdateTime) {
+		return ErrPreconditionFailed
+	}
+
+	updated := *stored
+	if driver.Name != nil {
+		updated.Name = driver.Name
+	}
+	if driver.BirthDate != nil {
+		updated.BirthDate = driver.BirthDate
+	}
+	if driver.Gender != nil {
+		updated.Gender = driver.Gender
+	}
+	if driver.HasVehicle != nil {
+		updated.HasVehicle = driver.HasVehicle
+	}
+	if driver.CNHType != nil {
+		updated.CNHType = driver.CNHType
+	}
+	// every update must change the version, even within the clock's resolution
+	updated.UpdateTime = time.Now().UTC()
+	if !updated.UpdateTime.After(stored.UpdateTime) {
+		updated.UpdateTime = stored.UpdateTime.Add(time.Nanosecond)
+	}
+	s.drivers[cpf] = &updated
+	s.addVersion(&updated)
+
+	return nil
+}
+
+func (s *MemoryStore) ImportDrivers(ctx context.Context, drivers []*models.Driver, replace, dryRun bool) ([]ImportResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// a dry run has to remember the CPFs it would have added
+	seen := make(map[string]bool)
+	results := make([]ImportResult, len(drivers))
+	for i, driver := range drivers {
+		cpf := string(*driver.CPF)
+		_, exist := s.drivers[cpf]
+		exist = exist || seen[cpf]
+		seen[cpf] = true
+
+		switch {
+		case !exist:
+			results[i] = ImportCreated
+		case replace:
+			results[i] = ImportReplaced
+		default:
+			results[i] = ImportSkipped
+			continue
+		}
+
+		if !dryRun {
+			stored := *driver
+			stored.Age = 0
+			stored.UpdateTime = time.Now().UTC()
+			s.drivers[cpf] = &stored
+			s.addVersion(&stored)
+		}
+	}
+
+	return results, nil
+}
+
+func (s *MemoryStore) addVersion(driver *models.Driver) {
+	cpf := string(*driver.CPF)
+	s.history[cpf] = append(s.history[cpf], models.NewDriverVersion(driver))
+}
+
+func (s *MemoryStore) GetDriverHistory(ctx context.Context, cpf string) ([]*models.DriverVersion, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := make([]*models.DriverVersion, len(s.history[cpf]))
+	for i, version := range s.history[cpf] {
+		stored := *version
+		result[i] = &stored
+	}
+
+	return result, nil
+}
+
+func (s *MemoryStore) EraseDriver(ctx context.Context, cpf string, keepTrips bool) (*Erasure, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var erasure Erasure
+	if _, exist := s.drivers[cpf]; exist {
+		delete(s.drivers, cpf)
+		erasure.DriverDeleted = true
+	}
+
+	anonymousID := models.DriverID(newAnonymousDriverID())
+	trips := make([]*models.Trip, 0, len(s.trips))
+	for _, trip := range s.trips {
+		if string(*trip.DriverID) != cpf {
+			trips = append(trips, trip)
+			continue
+		}
+
+		if keepTrips {
+			anonymized := *trip
+			anonymized.DriverID = &anonymousID
+			trips = append(trips, &anonymized)
+			erasure.TripsAnonymized++
+		} else {
+			erasure.TripsDeleted++
+		}
+	}
+	s.trips = trips
+	// corrections have the Trips' IDs, which would identify the Driver
+	delete(s.corrections, cpf)
+	delete(s.history, cpf)
+	// the responses of it's idempotent requests have it's Trips
+	for key, req := range s.requests {
+		if req.DriverID == cpf {
+			delete(s.requests, key)
+		}
+	}
+
+	if !erasure.DriverDeleted && erasure.TripsDeleted+erasure.TripsAnonymized == 0 {
+		return nil, ErrNotFound
+	}
+
+	return &erasure, nil
+}
+
+func (s *MemoryStore) AddTrips(ctx context.Context, trips []*models.Trip) ([]error, error) {
+	results := make([]error, len(trips))
+	for i, trip := range trips {
+		results[i] = s.AddTrip(ctx, trip)
+	}
+
+	return results, nil
+}
+
+func (s *MemoryStore) AddTrip(ctx context.Context, trip *models.Trip) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, stored := range s.trips {
+		if *stored.DriverID == *trip.DriverID && stored.Time.Equal(*trip.Time) {
+			return ErrConflict
+		}
+	}
+
+	stored := *trip
+	s.trips = append(s.trips, &stored)
+
+	return nil
+}
+
+func (s *MemoryStore) UpdateTrip(ctx context.Context, old, trip *models.Trip, correction *models.TripCorrection) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	index := s.tripIndex(old)
+	if index < 0 {
+		return ErrNotFound
+	}
+	if !sameTripValues(s.trips[index], old) {
+		return ErrPreconditionFailed
+	}
+	for i, stored := range s.trips {
+		if i != index && *stored.DriverID == *trip.DriverID && stored.Time.Equal(*trip.Time) {
+			return ErrConflict
+		}
+	}
+
+	stored := *trip
+	s.trips[index] = &stored
+	s.addCorrection(correction)
+
+	return nil
+}
+
+func (s *MemoryStore) DeleteTrip(ctx context.Context, trip *models.Trip, correction *models.TripCorrection) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	index := s.tripIndex(trip)
+	if index < 0 {
+		return ErrNotFound
+	}
+	if !sameTripValues(s.trips[index], trip) {
+		return ErrPreconditionFailed
+	}
+
+	s.trips = append(s.trips[:index], s.trips[index+1:]...)
+	s.addCorrection(correction)
+
+	return nil
+}
+
+// tripIndex returns the index of the Trip on s.trips, or -1
+func (s *MemoryStore) tripIndex(trip *models.Trip) int {
+	for i, stored := range s.trips {
+		if *stored.DriverID == *trip.DriverID && stored.ID == trip.ID {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func (s *MemoryStore) addCorrection(correction *models.TripCorrection) {
+	stored := *correction
+	s.corrections[correction.DriverID] = append(s.corrections[correction.DriverID], &stored)
+}
+
+func (s *MemoryStore) GetTripCorrections(ctx context.Context, driverID string) ([]*models.TripCorrection, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := make([]*models.TripCorrection, len(s.corrections[driverID]))
+	for i, correction := range s.corrections[driverID] {
+		stored := *correction
+		result[i] = &stored
+	}
+
+	return result, nil
+}
+
+func (s *MemoryStore) GetTrips(ctx context.Context, filter TripFilter) ([]*models.Trip, string, error) {
+	var after *models.Trip
+	if len(filter.PageToken) > 0 {
+		c, err := decodeTripCursor(filter.PageToken)
+		if err != nil {
+			return nil, "", err
+		}
+		after = &models.Trip{ID: c.Key, Time: c.Time}
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	matched := s.findTrips(filter, after)
+
+	nextPageToken := ""
+	if filter.PageSize > 0 {
+		if len(matched) > filter.PageSize {
+			matched = matched[:filter.PageSize]
+			last := matched[len(matched)-1]
+			nextPageToken = encodeCursor(cursor{Time: last.Time, Key: last.ID})
+		}
+	} else if filter.Limit > 0 && len(matched) > filter.Limit {
+		matched = matched[:filter.Limit]
+	}
+
+	result := make([]*models.Trip, len(matched))
+	for i, trip := range matched {
+		result[i] = selectTripFields(trip, filter.Fields)
+	}
+
+	return result, nextPageToken, nil
+}
+
+// EachTrip only holds the lock while finding the Trips, like EachDriver
+func (s *MemoryStore) EachTrip(ctx context.Context, filter TripFilter, fn func(trip *models.Trip) error) error {
+	s.mu.RLock()
+	matched := s.findTrips(filter, nil)
+	s.mu.RUnlock()
+
+	if filter.Limit > 0 && len(matched) > filter.Limit {
+		matched = matched[:filter.Limit]
+	}
+	for _, trip := range matched {
+		// like the other stores, reading stops when the request is canceled
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(selectTripFields(trip, filter.Fields)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// findTrips returns the stored Trips of filter after the Trip after (if
+// it's not nil), on the requested order. The caller must hold the lock.
+func (s *MemoryStore) findTrips(filter TripFilter, after *models.Trip) []*models.Trip {
+	// comesAfter reports whether a comes after b on the requested order
+	comesAfter := func(a, b *models.Trip) bool {
+		if filter.Ascending {
+			return compareTrips(a, b) > 0
+		}
+		return compareTrips(a, b) < 0
+	}
+
+	matched := make([]*models.Trip, 0)
+	for _, trip := range s.trips {
+		if after != nil && !comesAfter(trip, after) {
+			continue
+		}
+		if matchTrip(trip, filter) {
+			matched = append(matched, trip)
+		}
+	}
+
+	sort.Slice(matched, func(i, j int) bool {
+		return comesAfter(matched[j], matched[i])
+	})
+
+	return matched
+}
+
+// compareTrips orders Trips by Time, breaking ties by ID
+func compareTrips(a, b *models.Trip) int {
+	if a.Time.Before(*b.Time) {
+		return -1
+	}
+	if a.Time.After(*b.Time) {
+		return 1
+	}
+
+	return strings.Compare(a.ID, b.ID)
+}
+
+func (s *MemoryStore) BeginIdempotentRequest(ctx context.Context, req *IdempotentRequest) (*IdempotentRequest, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if existing, exist := s.requests[req.Key]; exist && existing.ExpiresAt.After(time.Now()) {
+		copied := *existing
+		return &copied, nil
+	}
+
+	stored := *req
+	s.requests[req.Key] = &stored
+
+	return nil, nil
+}
+
+func (s *MemoryStore) CompleteIdempotentRequest(ctx context.Context, req *IdempotentRequest) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored := *req
+	stored.Completed = true
+	s.requests[req.Key] = &stored
+
+	return nil
+}
+
+func (s *MemoryStore) ReleaseIdempotentRequest(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.requests, key)
+
+	return nil
+}
+
+func matchDriver(driver *models.Driver, filter DriverFilter) bool {
+	if len(filter.CPF) > 0 && string(*driver.CPF) != filter.CPF {
+		return false
+	}
+	if len(filter.Gender) > 0 && string(*driver.Gender) != filter.Gender {
+		return false
+	}
+	if filter.HasVehicle != nil && *driver.HasVehicle != *filter.HasVehicle {
+		return false
+	}
+	if len(filter.CNHType) > 0 && string(*driver.CNHType) != filter.CNHType {
+		return false
+	}
+
+	return true
+}
+
+func matchTrip(trip *models.Trip, filter TripFilter) bool {
+	if len(filter.DriverID) > 0 && string(*trip.DriverID) != filter.DriverID {
+		return false
+	}
+	if len(filter.ID) > 0 && trip.ID != filter.ID {
+		return false
+	}
+	if len(filter.LegacyID) > 0 && trip.LegacyID != filter.LegacyID {
+		return false
+	}
+	if filter.HasLoad != nil && *trip.HasLoad != *filter.HasLoad {
+		return false
+	}
+	if filter.VehicleType != nil && int(*trip.VehicleType) != *filter.VehicleType {
+		return false
+	}
+	if filter.Time != nil && !trip.Time.Equal(*filter.Time) {
+		return false
+	}
+	if filter.From != nil && trip.Time.Before(*filter.From) {
+		return false
+	}
+	if filter.To != nil && !trip.Time.Before(*filter.To) {
+		return false
+	}
+
+	return inTripAreas(trip, filter)
+}
+
+func (s *MemoryStore) AddAPIKey(ctx context.Context, key *models.APIKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, stored := range s.apiKeys {
+		if stored.ID == key.ID {
+			return ErrConflict
+		}
+	}
+
+	stored := *key
+	s.apiKeys = append(s.apiKeys, &stored)
+
+	return nil
+}
+
+func (s *MemoryStore) GetAPIKeys(ctx context.Context) ([]*models.APIKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := make([]*models.APIKey, len(s.apiKeys))
+	for i, key := range s.apiKeys {
+		stored := *key
+		result[i] = &stored
+	}
+
+	return result, nil
+}
+
+func (s *MemoryStore) GetAPIKeyByHash(ctx context.Context, hash string) (*models.APIKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, key := range s.apiKeys {
+		if key.Hash == hash {
+			stored := *key
+			return &stored, nil
+		}
+	}
+
+	return nil, ErrNotFound
+}
+
+func (s *MemoryStore) DeleteAPIKey(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, key := range s.apiKeys {
+		if key.ID == id {
+			s.apiKeys = append(s.apiKeys[:i], s.apiKeys[i+1:]...)
+			return nil
+		}
+	}
+
+	return ErrNotFound
+}
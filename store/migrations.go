@@ -0,0 +1,246 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// migration is a versioned set of statements that take a SQL schema from
+// version-1 to version. Migrations are applied in order and only once,
+// applied versions are recorded on the schema_migrations table.
+type migration struct {
+	version    int
+	statements []string
+}
+
+// sqliteMigrations must only be appended to, never edited, since
+// databases already migrated won't run them again
+var sqliteMigrations = []migration{
+	{
+		version: 1,
+		statements: []string{
+			`CREATE TABLE drivers (
+				cpf         TEXT PRIMARY KEY,
+				name        TEXT NOT NULL,
+				birth_date  TEXT NOT NULL,
+				gender      TEXT NOT NULL,
+				has_vehicle BOOLEAN NOT NULL,
+				cnh_type    TEXT NOT NULL
+			)`,
+			`CREATE TABLE trips (
+				pk              INTEGER PRIMARY KEY AUTOINCREMENT,
+				id              TEXT NOT NULL,
+				driver_id       TEXT NOT NULL,
+				has_load        BOOLEAN NOT NULL,
+				vehicle_type    INTEGER NOT NULL,
+				time            TEXT NOT NULL,
+				origin_lat      REAL NOT NULL,
+				origin_lng      REAL NOT NULL,
+				destination_lat REAL NOT NULL,
+				destination_lng REAL NOT NULL,
+				UNIQUE (driver_id, id)
+			)`,
+			`CREATE INDEX trips_driver_id ON trips (driver_id)`,
+			`CREATE INDEX trips_time ON trips (time)`,
+			`CREATE INDEX trips_vehicle_type ON trips (vehicle_type)`,
+			`CREATE INDEX trips_has_load ON trips (has_load)`,
+		},
+	},
+	{
+		// Trip IDs became globally unique, so a Driver's Trips are now
+		// unique by time. SQLite can't change constraints in place, so
+		// the table is rebuilt.
+		version: 2,
+		statements: []string{
+			`CREATE TABLE trips_v2 (
+				pk              INTEGER PRIMARY KEY AUTOINCREMENT,
+				id              TEXT NOT NULL,
+				driver_id       TEXT NOT NULL,
+				has_load        BOOLEAN NOT NULL,
+				vehicle_type    INTEGER NOT NULL,
+				time            TEXT NOT NULL,
+				origin_lat      REAL NOT NULL,
+				origin_lng      REAL NOT NULL,
+				destination_lat REAL NOT NULL,
+				destination_lng REAL NOT NULL,
+				UNIQUE (driver_id, time)
+			)`,
+			`INSERT INTO trips_v2 SELECT * FROM trips`,
+			`DROP TABLE trips`,
+			`ALTER TABLE trips_v2 RENAME TO trips`,
+			`CREATE INDEX trips_id ON trips (id)`,
+			`CREATE INDEX trips_driver_id ON trips (driver_id)`,
+			`CREATE INDEX trips_time ON trips (time)`,
+			`CREATE INDEX trips_vehicle_type ON trips (vehicle_type)`,
+			`CREATE INDEX trips_has_load ON trips (has_load)`,
+		},
+	},
+	{
+		// Drivers have a version (their last update time), existing
+		// Drivers get the migration's time
+		version: 3,
+		statements: []string{
+			`ALTER TABLE drivers ADD COLUMN updated_at TEXT NOT NULL DEFAULT ''`,
+			`UPDATE drivers SET updated_at = strftime('%Y-%m-%dT%H:%M:%S', 'now') || '.000000000Z'`,
+		},
+	},
+	{
+		version: 4,
+		statements: []string{
+			`CREATE TABLE idempotency_keys (
+				key         TEXT PRIMARY KEY,
+				fingerprint TEXT NOT NULL,
+				expires_at  TEXT NOT NULL,
+				completed   BOOLEAN NOT NULL,
+				status_code INTEGER NOT NULL,
+				header      TEXT NOT NULL,
+				body        BLOB
+			)`,
+		},
+	},
+	{
+		// corrections of Trips, changes are kept as JSON
+		version: 5,
+		statements: []string{
+			`CREATE TABLE trip_corrections (
+				id          TEXT PRIMARY KEY,
+				driver_id   TEXT NOT NULL,
+				trip_id     TEXT NOT NULL,
+				new_trip_id TEXT NOT NULL,
+				action      TEXT NOT NULL,
+				author      TEXT NOT NULL,
+				time        TEXT NOT NULL,
+				changes     TEXT NOT NULL
+			)`,
+			`CREATE INDEX trip_corrections_driver_id ON trip_corrections (driver_id)`,
+		},
+	},
+	{
+		// versions of Drivers, added by triggers on every write. Existing
+		// Drivers get their current values as the first version.
+		version: 6,
+		statements: []string{
+			`CREATE TABLE driver_history (
+				pk          INTEGER PRIMARY KEY AUTOINCREMENT,
+				cpf         TEXT NOT NULL,
+				name        TEXT NOT NULL,
+				birth_date  TEXT NOT NULL,
+				gender      TEXT NOT NULL,
+				has_vehicle BOOLEAN NOT NULL,
+				cnh_type    TEXT NOT NULL,
+				valid_from  TEXT NOT NULL
+			)`,
+			`CREATE INDEX driver_history_cpf ON driver_history (cpf)`,
+			`INSERT INTO driver_history (cpf, name, birth_date, gender, has_vehicle, cnh_type, valid_from)
+			SELECT cpf, name, birth_date, gender, has_vehicle, cnh_type, updated_at FROM drivers`,
+			`CREATE TRIGGER drivers_history_insert AFTER INSERT ON drivers
+			BEGIN
+				INSERT INTO driver_history (cpf, name, birth_date, gender, has_vehicle, cnh_type, valid_from)
+				VALUES (NEW.cpf, NEW.name, NEW.birth_date, NEW.gender, NEW.has_vehicle, NEW.cnh_type, NEW.updated_at);
+			END`,
+			`CREATE TRIGGER drivers_history_update AFTER UPDATE ON drivers
+			BEGIN
+				INSERT INTO driver_history (cpf, name, birth_date, gender, has_vehicle, cnh_type, valid_from)
+				VALUES (NEW.cpf, NEW.name, NEW.birth_date, NEW.gender, NEW.has_vehicle, NEW.cnh_type, NEW.updated_at);
+			END`,
+		},
+	},
+	{
+		version: 7,
+		statements: []string{
+			`CREATE TABLE api_keys (
+				id          TEXT PRIMARY KEY,
+				name        TEXT NOT NULL,
+				role        TEXT NOT NULL,
+				prefix      TEXT NOT NULL,
+				hash        TEXT NOT NULL UNIQUE,
+				create_time TEXT NOT NULL
+			)`,
+		},
+	},
+	{
+		// idempotent requests are erased with their Driver. The ones
+		// before can't be told apart, so they're dropped (they would
+		// only be replayed for a day).
+		version: 8,
+		statements: []string{
+			`DELETE FROM idempotency_keys`,
+			`ALTER TABLE idempotency_keys ADD COLUMN driver_id TEXT NOT NULL DEFAULT ''`,
+			`CREATE INDEX idempotency_keys_driver_id ON idempotency_keys (driver_id)`,
+		},
+	},
+	{
+		// corrections' author became the authenticated client, the
+		// "From" header is kept apart
+		version: 9,
+		statements: []string{
+			`ALTER TABLE trip_corrections ADD COLUMN author_id TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE trip_corrections ADD COLUMN from_header TEXT NOT NULL DEFAULT ''`,
+		},
+	},
+	{
+		// Trips keep the ID they'd have had before ULIDs. The offset
+		// existing Trips were sent with is lost, so theirs is on UTC.
+		version: 10,
+		statements: []string{
+			`ALTER TABLE trips ADD COLUMN legacy_id TEXT NOT NULL DEFAULT ''`,
+			`UPDATE trips SET legacy_id = CASE WHEN length(id) = 14 THEN id
+				ELSE strftime('%Y%m%d%H%M%S', substr(time, 1, 19)) END`,
+			`CREATE INDEX trips_driver_id_legacy_id ON trips (driver_id, legacy_id)`,
+		},
+	},
+}
+
+// migrate applies every migration newer than the database's current version
+func migrate(db *sql.DB, migrations []migration) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER PRIMARY KEY,
+		applied_at TEXT NOT NULL
+	)`)
+	if err != nil {
+		return err
+	}
+
+	var current int
+	err = db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+
+		if err = applyMigration(db, m); err != nil {
+			return fmt.Errorf("migration %d: %v", m.version, err)
+		}
+	}
+
+	return nil
+}
+
+func applyMigration(db *sql.DB, m migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, statement := range m.statements {
+		if _, err = tx.Exec(statement); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(
+		`INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)`,
+		m.version, formatSQLTime(time.Now()),
+	)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
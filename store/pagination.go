@@ -0,0 +1,48 @@
+package store
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"time"
+)
+
+// cursor points to the last item of a page. Key is whatever uniquely
+// identifies the item on the backend (and breaks ties between Trips with
+// the same Time).
+type cursor struct {
+	Time *time.Time `json:"t,omitempty"`
+	Key  string     `json:"k"`
+}
+
+// encodeCursor returns an opaque page token for c
+func encodeCursor(c cursor) string {
+	b, _ := json.Marshal(&c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(token string) (*cursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, ErrInvalidPageToken
+	}
+
+	var c cursor
+	if err = json.Unmarshal(b, &c); err != nil || len(c.Key) == 0 {
+		return nil, ErrInvalidPageToken
+	}
+
+	return &c, nil
+}
+
+// decodeTripCursor is like decodeCursor, but also requires the Time
+func decodeTripCursor(token string) (*cursor, error) {
+	c, err := decodeCursor(token)
+	if err != nil {
+		return nil, err
+	}
+	if c.Time == nil {
+		return nil, ErrInvalidPageToken
+	}
+
+	return c, nil
+}
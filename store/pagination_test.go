@@ -0,0 +1,162 @@
+package store
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/genproto/googleapis/type/latlng"
+
+	"github.com/rafaft/truck-pad/models"
+)
+
+func TestCursor(t *testing.T) {
+	now := time.Date(2020, 2, 14, 15, 0, 0, 123456789, time.FixedZone("BRT", -3*60*60))
+
+	c, err := decodeTripCursor(encodeCursor(cursor{Time: &now, Key: "01DC5GYN18F0CPKQAZNZ5W3G2R"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.Time.Equal(now) || c.Key != "01DC5GYN18F0CPKQAZNZ5W3G2R" {
+		t.Errorf("got %s %s, want the encoded cursor", c.Time, c.Key)
+	}
+
+	c, err = decodeCursor(encodeCursor(cursor{Key: "52998224725"}))
+	if err != nil || c.Key != "52998224725" || c.Time != nil {
+		t.Errorf("got %+v, %v, want the encoded key", c, err)
+	}
+
+	for _, token := range []string{
+		"not base64!",
+		encodeCursor(cursor{}),               // without key
+		"bm90IGpzb24",                        // base64 of "not json"
+		encodeCursor(cursor{Key: "01DC5GY"}), // a Trip's cursor needs the time
+	} {
+		if _, err = decodeTripCursor(token); err != ErrInvalidPageToken {
+			t.Errorf("%q: got %v, want ErrInvalidPageToken", token, err)
+		}
+	}
+}
+
+func TestTripsPagination(t *testing.T) {
+	forEachTestStore(t, func(t *testing.T, s Store) {
+		ctx := context.Background()
+
+		// Trips of many Drivers at the same time, so pages end between
+		// equal times and the ID breaks the tie
+		start := time.Date(2020, 2, 14, 15, 0, 0, 0, time.UTC)
+		drivers := []string{"52998224725", "48372162000", "11144477735", "12345678909"}
+		ids := make(map[string]bool)
+		for i := 0; i < 3; i++ {
+			for _, driverID := range drivers {
+				trip := newTestTrip(t, driverID, start.Add(time.Duration(i)*time.Hour), &latlng.LatLng{Latitude: -22.9, Longitude: -43.2})
+				if err := s.AddTrip(ctx, trip); err != nil {
+					t.Fatal(err)
+				}
+				ids[trip.ID] = true
+			}
+		}
+
+		for _, ascending := range []bool{false, true} {
+			for _, pageSize := range []int{1, 3, 5, 12, 100} {
+				var previous *models.Trip
+				seen := make(map[string]bool)
+				pages := 0
+				token := ""
+				for {
+					trips, next, err := s.GetTrips(ctx, TripFilter{Ascending: ascending, PageSize: pageSize, PageToken: token})
+					if err != nil {
+						t.Fatal(err)
+					}
+					pages++
+					if len(trips) > pageSize || (len(next) > 0 && len(trips) != pageSize) {
+						t.Fatalf("ascending=%t page_size=%d: got %d trips on a page", ascending, pageSize, len(trips))
+					}
+
+					for _, trip := range trips {
+						if seen[trip.ID] {
+							t.Fatalf("ascending=%t page_size=%d: got %s twice", ascending, pageSize, trip.ID)
+						}
+						seen[trip.ID] = true
+						if previous != nil {
+							if order := compareTrips(previous, trip); (ascending && order >= 0) || (!ascending && order <= 0) {
+								t.Errorf("ascending=%t page_size=%d: got %s after %s", ascending, pageSize, trip.ID, previous.ID)
+							}
+						}
+						previous = trip
+					}
+
+					if len(next) == 0 {
+						break
+					}
+					token = next
+				}
+
+				if len(seen) != len(ids) {
+					t.Errorf("ascending=%t page_size=%d: got %d trips, want %d", ascending, pageSize, len(seen), len(ids))
+				}
+				if want := (len(ids) + pageSize - 1) / pageSize; pages != want {
+					t.Errorf("ascending=%t page_size=%d: got %d pages, want %d", ascending, pageSize, pages, want)
+				}
+			}
+		}
+
+		// the filter still applies on the next pages
+		trips, next, err := s.GetTrips(ctx, TripFilter{DriverID: drivers[0], PageSize: 2})
+		if err != nil || len(trips) != 2 || len(next) == 0 {
+			t.Fatalf("got %d trips, %q, %v, want a page of 2", len(trips), next, err)
+		}
+		trips, next, err = s.GetTrips(ctx, TripFilter{DriverID: drivers[0], PageSize: 2, PageToken: next})
+		if err != nil || len(trips) != 1 || len(next) > 0 || string(*trips[0].DriverID) != drivers[0] {
+			t.Errorf("got %d trips, %q, %v, want the last one of %s", len(trips), next, err, drivers[0])
+		}
+
+		for _, token := range []string{"invalid", encodeCursor(cursor{Key: "01DC5GY"})} {
+			if _, _, err = s.GetTrips(ctx, TripFilter{PageSize: 2, PageToken: token}); err != ErrInvalidPageToken {
+				t.Errorf("%q: got %v, want ErrInvalidPageToken", token, err)
+			}
+		}
+	})
+}
+
+func TestDriversPagination(t *testing.T) {
+	forEachTestStore(t, func(t *testing.T, s Store) {
+		ctx := context.Background()
+
+		cpfs := []string{"11144477735", "12345678909", "48372162000", "52998224725"}
+		for _, cpf := range []string{cpfs[2], cpfs[0], cpfs[3], cpfs[1]} {
+			if err := s.AddDriver(ctx, newTestDriver(t, cpf)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		got := make([]string, 0)
+		token := ""
+		for {
+			drivers, next, err := s.GetDrivers(ctx, DriverFilter{PageSize: 3, PageToken: token})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, driver := range drivers {
+				got = append(got, string(*driver.CPF))
+			}
+			if len(next) == 0 {
+				break
+			}
+			token = next
+		}
+		if len(got) != len(cpfs) {
+			t.Fatalf("got %v, want %v", got, cpfs)
+		}
+		for i := range cpfs {
+			if got[i] != cpfs[i] {
+				t.Errorf("got %v, want %v ordered by CPF", got, cpfs)
+				break
+			}
+		}
+
+		if _, _, err := s.GetDrivers(ctx, DriverFilter{PageSize: 3, PageToken: "invalid"}); err != ErrInvalidPageToken {
+			t.Errorf("got %v, want ErrInvalidPageToken", err)
+		}
+	})
+}
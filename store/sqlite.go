@@ -0,0 +1,1019 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"google.golang.org/genproto/googleapis/type/latlng"
+
+	"github.com/rafaft/truck-pad/geo"
+	"github.com/rafaft/truck-pad/models"
+)
+
+// sqlTimeLayout has a fixed width, so times stored as TEXT (always in UTC)
+// can be compared and ordered lexicographically
+const sqlTimeLayout = "2006-01-02T15:04:05.000000000Z07:00"
+
+// SQLStore implements Store on top of SQLite.
+// Unlike FirestoreStore, Trips are kept on a top level table.
+type SQLStore struct {
+	db *sql.DB
+}
+
+// NewSQLiteStore opens (or creates) the SQLite database at path and
+// migrates it to the latest schema version
+func NewSQLiteStore(path string) (*SQLStore, error) {
+	db, err := sql.Open("sqlite3", path+"?_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+
+	if err = migrate(db, sqliteMigrations); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &SQLStore{
+		db: db,
+	}, nil
+}
+
+func (s *SQLStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *SQLStore) AddDriver(ctx context.Context, driver *models.Driver) error {
+	updateTime := time.Now().UTC()
+	result, err := s.db.ExecContext(ctx,
+		`INSERT INTO drivers (cpf, name, birth_date, gender, has_vehicle, cnh_type, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (cpf) DO NOTHING`,
+		string(*driver.CPF),
+		*driver.Name,
+		formatSQLTime(*driver.BirthDate),
+		string(*driver.Gender),
+		*driver.HasVehicle,
+		string(*driver.CNHType),
+		formatSQLTime(updateTime),
+	)
+	if err != nil {
+		return err
+	}
+	if err = conflictIfUnchanged(result); err != nil {
+		return err
+	}
+
+	driver.UpdateTime = updateTime
+	return nil
+}
+
+func (s *SQLStore) GetDrivers(ctx context.Context, filter DriverFilter) ([]*models.Driver, string, error) {
+	drivers := make([]*models.Driver, 0)
+	err := s.queryDrivers(ctx, filter, func(driver *models.Driver) error {
+		drivers = append(drivers, driver)
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	nextPageToken := ""
+	if filter.PageSize > 0 && len(drivers) > filter.PageSize {
+		drivers = drivers[:filter.PageSize]
+		nextPageToken = encodeCursor(cursor{Key: string(*drivers[len(drivers)-1].CPF)})
+	}
+
+	result := make([]*models.Driver, len(drivers))
+	for i, driver := range drivers {
+		result[i] = SelectDriverFields(driver, filter.Fields)
+	}
+
+	return result, nextPageToken, nil
+}
+
+func (s *SQLStore) EachDriver(ctx context.Context, filter DriverFilter, fn func(driver *models.Driver) error) error {
+	filter.PageSize, filter.PageToken = 0, ""
+	return s.queryDrivers(ctx, filter, func(driver *models.Driver) error {
+		return fn(SelectDriverFields(driver, filter.Fields))
+	})
+}
+
+// queryDrivers calls fn with each Driver of the query of filter, up to
+// it's page size plus one, to know whether there's a next page
+func (s *SQLStore) queryDrivers(ctx context.Context, filter DriverFilter, fn func(driver *models.Driver) error) error {
+	var where whereClause
+	if len(filter.CPF) > 0 {
+		where.add("cpf = ?", filter.CPF)
+	}
+	if len(filter.Gender) > 0 {
+		where.add("gender = ?", filter.Gender)
+	}
+	if filter.HasVehicle != nil {
+		where.add("has_vehicle = ?", *filter.HasVehicle)
+	}
+	if len(filter.CNHType) > 0 {
+		where.add("cnh_type = ?", filter.CNHType)
+	}
+	if len(filter.PageToken) > 0 {
+		after, err := decodeCursor(filter.PageToken)
+		if err != nil {
+			return err
+		}
+		where.add("cpf > ?", after.Key)
+	}
+
+	query := `SELECT cpf, name, birth_date, gender, has_vehicle, cnh_type, updated_at FROM drivers` +
+		where.String() + ` ORDER BY cpf`
+	if filter.PageSize > 0 {
+		// fetch an extra row to know whether there's a next page
+		query += ` LIMIT ?`
+		where.args = append(where.args, filter.PageSize+1)
+	}
+
+	rows, err := s.db.QueryContext(ctx, query, where.args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		driver, err := scanDriver(rows)
+		if err != nil {
+			return err
+		}
+
+		if err = fn(driver); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+func (s *SQLStore) UpdateDriver(ctx context.Context, cpf string, driver *models.Driver, lastUpdateTime time.Time) error {
+	columns := make([]string, 0)
+	args := make([]interface{}, 0)
+	if driver.Name != nil {
+		columns = append(columns, "name = ?")
+		args = append(args, *driver.Name)
+	}
+	if driver.BirthDate != nil {
+		columns = append(columns, "birth_date = ?")
+		args = append(args, formatSQLTime(*driver.BirthDate))
+	}
+	if driver.Gender != nil {
+		columns = append(columns, "gender = ?")
+		args = append(args, string(*driver.Gender))
+	}
+	if driver.HasVehicle != nil {
+		columns = append(columns, "has_vehicle = ?")
+		args = append(args, *driver.HasVehicle)
+	}
+	if driver.CNHType != nil {
+		columns = append(columns, "cnh_type = ?")
+		args = append(args, string(*driver.CNHType))
+	}
+	// every update changes the Driver's version
+	columns = append(columns, "updated_at = ?")
+	args = append(args, formatSQLTime(time.Now().UTC()))
+
+	var where whereClause
+	where.add("cpf = ?", cpf)
+	if !lastUpdateTime.IsZero() {
+		where.add("updated_at = ?", formatSQLTime(lastUpdateTime))
+	}
+	args = append(args, where.args...)
+
+	result, err := s.db.ExecContext(ctx,
+		`UPDATE drivers SET `+strings.Join(columns, ", ")+where.String(),
+		args...,
+	)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected > 0 {
+		return nil
+	}
+
+	// tell a missing Driver from a changed one
+	var exists bool
+	err = s.db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM drivers WHERE cpf = ?)`, cpf).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return ErrPreconditionFailed
+	}
+
+	return ErrNotFound
+}
+
+func (s *SQLStore) ImportDrivers(ctx context.Context, drivers []*models.Driver, replace, dryRun bool) ([]ImportResult, error) {
+	// a dry run writes as well, but it's transaction is rolled back
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	onConflict := `DO NOTHING`
+	if replace {
+		onConflict = `DO UPDATE SET
+			name = excluded.name,
+			birth_date = excluded.birth_date,
+			gender = excluded.gender,
+			has_vehicle = excluded.has_vehicle,
+			cnh_type = excluded.cnh_type,
+			updated_at = excluded.updated_at`
+	}
+
+	results := make([]ImportResult, len(drivers))
+	for i, driver := range drivers {
+		var exist bool
+		err = tx.QueryRowContext(ctx,
+			`SELECT EXISTS (SELECT 1 FROM drivers WHERE cpf = ?)`, string(*driver.CPF),
+		).Scan(&exist)
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case !exist:
+			results[i] = ImportCreated
+		case replace:
+			results[i] = ImportReplaced
+		default:
+			results[i] = ImportSkipped
+			continue
+		}
+
+		_, err = tx.ExecContext(ctx,
+			`INSERT INTO drivers (cpf, name, birth_date, gender, has_vehicle, cnh_type, updated_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (cpf) `+onConflict,
+			string(*driver.CPF),
+			*driver.Name,
+			formatSQLTime(*driver.BirthDate),
+			string(*driver.Gender),
+			*driver.HasVehicle,
+			string(*driver.CNHType),
+			formatSQLTime(time.Now().UTC()),
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if !dryRun {
+		if err = tx.Commit(); err != nil {
+			return nil, err
+		}
+	}
+
+	return results, nil
+}
+
+// GetDriverHistory reads the versions added by the triggers on drivers
+func (s *SQLStore) GetDriverHistory(ctx context.Context, cpf string) ([]*models.DriverVersion, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT cpf, name, birth_date, gender, has_vehicle, cnh_type, valid_from
+		FROM driver_history WHERE cpf = ? ORDER BY valid_from, pk`, cpf,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := make([]*models.DriverVersion, 0)
+	for rows.Next() {
+		driver, err := scanDriver(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		history = append(history, models.NewDriverVersion(driver))
+	}
+
+	return history, rows.Err()
+}
+
+func (s *SQLStore) EraseDriver(ctx context.Context, cpf string, keepTrips bool) (*Erasure, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var erasure Erasure
+
+	result, err := tx.ExecContext(ctx, `DELETE FROM drivers WHERE cpf = ?`, cpf)
+	if err != nil {
+		return nil, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	erasure.DriverDeleted = affected > 0
+
+	if keepTrips {
+		result, err = tx.ExecContext(ctx,
+			`UPDATE trips SET driver_id = ? WHERE driver_id = ?`,
+			newAnonymousDriverID(), cpf,
+		)
+	} else {
+		result, err = tx.ExecContext(ctx, `DELETE FROM trips WHERE driver_id = ?`, cpf)
+	}
+	if err != nil {
+		return nil, err
+	}
+	affected, err = result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if keepTrips {
+		erasure.TripsAnonymized = int(affected)
+	} else {
+		erasure.TripsDeleted = int(affected)
+	}
+
+	// corrections have the Trips' IDs, which would identify the Driver
+	_, err = tx.ExecContext(ctx, `DELETE FROM trip_corrections WHERE driver_id = ?`, cpf)
+	if err != nil {
+		return nil, err
+	}
+
+	// the history has the Driver's personal data
+	_, err = tx.ExecContext(ctx, `DELETE FROM driver_history WHERE cpf = ?`, cpf)
+	if err != nil {
+		return nil, err
+	}
+
+	// and the responses of it's idempotent requests have it's Trips
+	_, err = tx.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE driver_id = ?`, cpf)
+	if err != nil {
+		return nil, err
+	}
+
+	if !erasure.DriverDeleted && affected == 0 {
+		return nil, ErrNotFound
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return &erasure, nil
+}
+
+func (s *SQLStore) AddTrip(ctx context.Context, trip *models.Trip) error {
+	return insertTrip(ctx, s.db, trip)
+}
+
+func (s *SQLStore) AddTrips(ctx context.Context, trips []*models.Trip) ([]error, error) {
+	// a single transaction is much faster than one per Trip
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	results := make([]error, len(trips))
+	for i, trip := range trips {
+		results[i] = insertTrip(ctx, tx, trip)
+		if results[i] != nil && results[i] != ErrConflict {
+			return nil, results[i]
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+// execer is either a *sql.DB or a *sql.Tx
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+func insertTrip(ctx context.Context, db execer, trip *models.Trip) error {
+	result, err := db.ExecContext(ctx,
+		`INSERT INTO trips (id, legacy_id, driver_id, has_load, vehicle_type, time,
+			origin_lat, origin_lng, destination_lat, destination_lng)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (driver_id, time) DO NOTHING`,
+		trip.ID,
+		trip.LegacyID,
+		string(*trip.DriverID),
+		*trip.HasLoad,
+		int(*trip.VehicleType),
+		formatSQLTime(*trip.Time),
+		trip.Origin.Latitude,
+		trip.Origin.Longitude,
+		trip.Destination.Latitude,
+		trip.Destination.Longitude,
+	)
+	if err != nil {
+		return err
+	}
+
+	return conflictIfUnchanged(result)
+}
+
+func (s *SQLStore) UpdateTrip(ctx context.Context, old, trip *models.Trip, correction *models.TripCorrection) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var conflict bool
+	err = tx.QueryRowContext(ctx,
+		`SELECT EXISTS (SELECT 1 FROM trips WHERE driver_id = ? AND time = ? AND id != ?)`,
+		string(*trip.DriverID), formatSQLTime(*trip.Time), old.ID,
+	).Scan(&conflict)
+	if err != nil {
+		return err
+	}
+	if conflict {
+		return ErrConflict
+	}
+
+	result, err := tx.ExecContext(ctx,
+		`UPDATE trips SET id = ?, legacy_id = ?, has_load = ?, vehicle_type = ?, time = ?,
+			origin_lat = ?, origin_lng = ?, destination_lat = ?, destination_lng = ?
+		WHERE driver_id = ? AND id = ?`+tripValuesCondition,
+		append([]interface{}{
+			trip.ID,
+			trip.LegacyID,
+			*trip.HasLoad,
+			int(*trip.VehicleType),
+			formatSQLTime(*trip.Time),
+			trip.Origin.Latitude,
+			trip.Origin.Longitude,
+			trip.Destination.Latitude,
+			trip.Destination.Longitude,
+			string(*old.DriverID),
+			old.ID,
+		}, tripValuesArgs(old)...)...,
+	)
+	if err != nil {
+		return err
+	}
+	if err = notFoundOrModified(ctx, tx, result, old); err != nil {
+		return err
+	}
+
+	if err = insertTripCorrection(ctx, tx, correction); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLStore) DeleteTrip(ctx context.Context, trip *models.Trip, correction *models.TripCorrection) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx,
+		`DELETE FROM trips WHERE driver_id = ? AND id = ?`+tripValuesCondition,
+		append([]interface{}{string(*trip.DriverID), trip.ID}, tripValuesArgs(trip)...)...,
+	)
+	if err != nil {
+		return err
+	}
+	if err = notFoundOrModified(ctx, tx, result, trip); err != nil {
+		return err
+	}
+
+	if err = insertTripCorrection(ctx, tx, correction); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// tripValuesCondition only matches a Trip whose values are still the ones
+// of tripValuesArgs' Trip, the precondition of UpdateTrip and DeleteTrip
+const tripValuesCondition = ` AND has_load = ? AND vehicle_type = ? AND time = ?
+	AND origin_lat = ? AND origin_lng = ? AND destination_lat = ? AND destination_lng = ?`
+
+func tripValuesArgs(trip *models.Trip) []interface{} {
+	return []interface{}{
+		*trip.HasLoad,
+		int(*trip.VehicleType),
+		formatSQLTime(*trip.Time),
+		trip.Origin.Latitude,
+		trip.Origin.Longitude,
+		trip.Destination.Latitude,
+		trip.Destination.Longitude,
+	}
+}
+
+// notFoundOrModified tells why a statement with tripValuesCondition didn't
+// change any row: ErrNotFound if the Trip doesn't exist anymore, or
+// ErrPreconditionFailed if it's values changed
+func notFoundOrModified(ctx context.Context, tx *sql.Tx, result sql.Result, trip *models.Trip) error {
+	if err := notFoundIfUnchanged(result); err != ErrNotFound {
+		return err
+	}
+
+	var exists bool
+	err := tx.QueryRowContext(ctx,
+		`SELECT EXISTS (SELECT 1 FROM trips WHERE driver_id = ? AND id = ?)`, string(*trip.DriverID), trip.ID,
+	).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return ErrPreconditionFailed
+	}
+
+	return ErrNotFound
+}
+
+func insertTripCorrection(ctx context.Context, db execer, correction *models.TripCorrection) error {
+	changes, err := json.Marshal(correction.Changes)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.ExecContext(ctx,
+		`INSERT INTO trip_corrections (id, driver_id, trip_id, new_trip_id, action, author, author_id, from_header, time, changes)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		correction.ID,
+		correction.DriverID,
+		correction.TripID,
+		correction.NewTripID,
+		correction.Action,
+		correction.Author,
+		correction.AuthorID,
+		correction.From,
+		formatSQLTime(correction.Time),
+		string(changes),
+	)
+	return err
+}
+
+func (s *SQLStore) GetTripCorrections(ctx context.Context, driverID string) ([]*models.TripCorrection, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT id, driver_id, trip_id, new_trip_id, action, author, author_id, from_header, time, changes
+		FROM trip_corrections WHERE driver_id = ? ORDER BY time, id`, driverID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	corrections := make([]*models.TripCorrection, 0)
+	for rows.Next() {
+		var correction models.TripCorrection
+		var correctionTime, changes string
+		err = rows.Scan(
+			&correction.ID, &correction.DriverID, &correction.TripID, &correction.NewTripID,
+			&correction.Action, &correction.Author, &correction.AuthorID, &correction.From, &correctionTime, &changes,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		if correction.Time, err = time.Parse(sqlTimeLayout, correctionTime); err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal([]byte(changes), &correction.Changes); err != nil {
+			return nil, err
+		}
+
+		corrections = append(corrections, &correction)
+	}
+
+	return corrections, rows.Err()
+}
+
+func (s *SQLStore) GetTrips(ctx context.Context, filter TripFilter) ([]*models.Trip, string, error) {
+	trips := make([]*models.Trip, 0)
+	err := s.queryTrips(ctx, filter, func(trip *models.Trip) error {
+		trips = append(trips, trip)
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	nextPageToken := ""
+	if filter.PageSize > 0 && len(trips) > filter.PageSize {
+		trips = trips[:filter.PageSize]
+		last := trips[len(trips)-1]
+		nextPageToken = encodeCursor(cursor{Time: last.Time, Key: last.ID})
+	}
+
+	result := make([]*models.Trip, len(trips))
+	for i, trip := range trips {
+		result[i] = selectTripFields(trip, filter.Fields)
+	}
+
+	return result, nextPageToken, nil
+}
+
+func (s *SQLStore) EachTrip(ctx context.Context, filter TripFilter, fn func(trip *models.Trip) error) error {
+	filter.PageSize, filter.PageToken = 0, ""
+	return s.queryTrips(ctx, filter, func(trip *models.Trip) error {
+		return fn(selectTripFields(trip, filter.Fields))
+	})
+}
+
+// queryTrips calls fn with each Trip of the query of filter, up to it's
+// limit (or page size plus one, to know whether there's a next page)
+func (s *SQLStore) queryTrips(ctx context.Context, filter TripFilter, fn func(trip *models.Trip) error) error {
+	var where whereClause
+	if len(filter.DriverID) > 0 {
+		where.add("driver_id = ?", filter.DriverID)
+	}
+	if len(filter.ID) > 0 {
+		where.add("id = ?", filter.ID)
+	}
+	if len(filter.LegacyID) > 0 {
+		where.add("legacy_id = ?", filter.LegacyID)
+	}
+	if filter.HasLoad != nil {
+		where.add("has_load = ?", *filter.HasLoad)
+	}
+	if filter.VehicleType != nil {
+		where.add("vehicle_type = ?", *filter.VehicleType)
+	}
+	if filter.Time != nil {
+		where.add("time = ?", formatSQLTime(*filter.Time))
+	}
+	if filter.From != nil {
+		where.add("time >= ?", formatSQLTime(*filter.From))
+	}
+	if filter.To != nil {
+		where.add("time < ?", formatSQLTime(*filter.To))
+	}
+
+	if filter.Origin != nil {
+		where.addBox("origin_lat", "origin_lng", filter.Origin.Bounds())
+	}
+	if filter.Destination != nil {
+		where.addBox("destination_lat", "destination_lng", filter.Destination.Bounds())
+	}
+
+	direction := "DESC"
+	operator := "<"
+	if filter.Ascending {
+		direction = "ASC"
+		operator = ">"
+	}
+
+	if len(filter.PageToken) > 0 {
+		after, err := decodeTripCursor(filter.PageToken)
+		if err != nil {
+			return err
+		}
+		where.add("(time, id) "+operator+" (?, ?)", formatSQLTime(*after.Time))
+		where.args = append(where.args, after.Key)
+	}
+
+	query := `SELECT id, legacy_id, driver_id, has_load, vehicle_type, time,
+		origin_lat, origin_lng, destination_lat, destination_lng FROM trips` +
+		where.String() + ` ORDER BY time ` + direction + `, id ` + direction
+
+	// when paginating, one extra Trip is read to know whether there's
+	// a next page
+	maxTrips := filter.Limit
+	if filter.PageSize > 0 {
+		maxTrips = filter.PageSize + 1
+	}
+	// with areas the limit is applied while reading, after checking the
+	// exact distances
+	if maxTrips > 0 && filter.Origin == nil && filter.Destination == nil {
+		query += ` LIMIT ?`
+		where.args = append(where.args, maxTrips)
+	}
+
+	rows, err := s.db.QueryContext(ctx, query, where.args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for n := 0; (maxTrips <= 0 || n < maxTrips) && rows.Next(); {
+		trip, err := scanTrip(rows)
+		if err != nil {
+			return err
+		}
+
+		if !inTripAreas(trip, filter) {
+			continue
+		}
+		if err = fn(trip); err != nil {
+			return err
+		}
+		n++
+	}
+
+	return rows.Err()
+}
+
+func (s *SQLStore) BeginIdempotentRequest(ctx context.Context, req *IdempotentRequest) (*IdempotentRequest, error) {
+	// the key is only taken over if it's expired, in a single statement,
+	// so concurrent requests can't both reserve it
+	result, err := s.db.ExecContext(ctx,
+		`INSERT INTO idempotency_keys (key, driver_id, fingerprint, expires_at, completed, status_code, header)
+		VALUES (?, ?, ?, ?, FALSE, 0, '{}')
+		ON CONFLICT (key) DO UPDATE SET
+			driver_id = excluded.driver_id,
+			fingerprint = excluded.fingerprint,
+			expires_at = excluded.expires_at,
+			completed = FALSE,
+			status_code = 0,
+			header = '{}',
+			body = NULL
+		WHERE idempotency_keys.expires_at <= ?`,
+		req.Key,
+		req.DriverID,
+		req.Fingerprint,
+		formatSQLTime(req.ExpiresAt),
+		formatSQLTime(time.Now()),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if err = conflictIfUnchanged(result); err != ErrConflict {
+		return nil, err
+	}
+
+	var existing IdempotentRequest
+	var expiresAt, header string
+	err = s.db.QueryRowContext(ctx,
+		`SELECT key, driver_id, fingerprint, expires_at, completed, status_code, header, body
+		FROM idempotency_keys WHERE key = ?`,
+		req.Key,
+	).Scan(
+		&existing.Key, &existing.DriverID, &existing.Fingerprint, &expiresAt, &existing.Completed,
+		&existing.StatusCode, &header, &existing.Body,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if existing.ExpiresAt, err = time.Parse(sqlTimeLayout, expiresAt); err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal([]byte(header), &existing.Header); err != nil {
+		return nil, err
+	}
+
+	return &existing, nil
+}
+
+func (s *SQLStore) CompleteIdempotentRequest(ctx context.Context, req *IdempotentRequest) error {
+	header, err := json.Marshal(req.Header)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.ExecContext(ctx,
+		`UPDATE idempotency_keys SET completed = TRUE, expires_at = ?, status_code = ?, header = ?, body = ?
+		WHERE key = ?`,
+		formatSQLTime(req.ExpiresAt), req.StatusCode, string(header), req.Body, req.Key,
+	)
+
+	return err
+}
+
+func (s *SQLStore) ReleaseIdempotentRequest(ctx context.Context, key string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE key = ?`, key)
+
+	return err
+}
+
+func (s *SQLStore) AddAPIKey(ctx context.Context, key *models.APIKey) error {
+	result, err := s.db.ExecContext(ctx,
+		`INSERT INTO api_keys (id, name, role, prefix, hash, create_time)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO NOTHING`,
+		key.ID,
+		*key.Name,
+		string(*key.Role),
+		key.Prefix,
+		key.Hash,
+		formatSQLTime(key.CreateTime),
+	)
+	if err != nil {
+		return err
+	}
+
+	return conflictIfUnchanged(result)
+}
+
+func (s *SQLStore) GetAPIKeys(ctx context.Context) ([]*models.APIKey, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT id, name, role, prefix, hash, create_time FROM api_keys ORDER BY create_time, id`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := make([]*models.APIKey, 0)
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+func (s *SQLStore) GetAPIKeyByHash(ctx context.Context, hash string) (*models.APIKey, error) {
+	row := s.db.QueryRowContext(ctx,
+		`SELECT id, name, role, prefix, hash, create_time FROM api_keys WHERE hash = ?`, hash,
+	)
+
+	key, err := scanAPIKey(row)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+
+	return key, err
+}
+
+func (s *SQLStore) DeleteAPIKey(ctx context.Context, id string) error {
+	result, err := s.db.ExecContext(ctx, `DELETE FROM api_keys WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+
+	return notFoundIfUnchanged(result)
+}
+
+// whereClause accumulates AND'ed conditions and their arguments
+type whereClause struct {
+	conditions []string
+	args       []interface{}
+}
+
+func (w *whereClause) add(condition string, arg interface{}) {
+	w.conditions = append(w.conditions, condition)
+	w.args = append(w.args, arg)
+}
+
+// addBox adds the conditions for a point to be within box
+func (w *whereClause) addBox(latColumn, lngColumn string, box geo.BoundingBox) {
+	w.conditions = append(w.conditions, latColumn+" BETWEEN ? AND ?")
+	w.args = append(w.args, box.MinLat, box.MaxLat)
+
+	if box.MinLng <= box.MaxLng {
+		w.conditions = append(w.conditions, lngColumn+" BETWEEN ? AND ?")
+	} else {
+		// the box crosses the antimeridian
+		w.conditions = append(w.conditions, "("+lngColumn+" >= ? OR "+lngColumn+" <= ?)")
+	}
+	w.args = append(w.args, box.MinLng, box.MaxLng)
+}
+
+func (w *whereClause) String() string {
+	if len(w.conditions) == 0 {
+		return ""
+	}
+
+	return " WHERE " + strings.Join(w.conditions, " AND ")
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanDriver(row scanner) (*models.Driver, error) {
+	var cpf, name, birthDate, gender, cnhType, updatedAt string
+	var hasVehicle bool
+	err := row.Scan(&cpf, &name, &birthDate, &gender, &hasVehicle, &cnhType, &updatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	parsedBirthDate, err := time.Parse(sqlTimeLayout, birthDate)
+	if err != nil {
+		return nil, err
+	}
+	updateTime, err := time.Parse(sqlTimeLayout, updatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	modelCPF := models.CPF(cpf)
+	modelGender := models.Gender(gender)
+	modelCNHType := models.CNHType(cnhType)
+
+	return &models.Driver{
+		CPF:        &modelCPF,
+		Name:       &name,
+		BirthDate:  &parsedBirthDate,
+		Gender:     &modelGender,
+		HasVehicle: &hasVehicle,
+		CNHType:    &modelCNHType,
+		UpdateTime: updateTime,
+	}, nil
+}
+
+func scanTrip(row scanner) (*models.Trip, error) {
+	var id, legacyID, driverID, tripTime string
+	var hasLoad bool
+	var vehicleType int
+	var origin, destination latlng.LatLng
+	err := row.Scan(
+		&id, &legacyID, &driverID, &hasLoad, &vehicleType, &tripTime,
+		&origin.Latitude, &origin.Longitude,
+		&destination.Latitude, &destination.Longitude,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	parsedTime, err := time.Parse(sqlTimeLayout, tripTime)
+	if err != nil {
+		return nil, err
+	}
+
+	modelDriverID := models.DriverID(driverID)
+	modelVehicleType := models.VehicleType(vehicleType)
+
+	return &models.Trip{
+		ID:          id,
+		LegacyID:    legacyID,
+		DriverID:    &modelDriverID,
+		HasLoad:     &hasLoad,
+		VehicleType: &modelVehicleType,
+		Time:        &parsedTime,
+		Origin:      &origin,
+		Destination: &destination,
+	}, nil
+}
+
+func scanAPIKey(row scanner) (*models.APIKey, error) {
+	var key models.APIKey
+	var name, role, createTime string
+	err := row.Scan(&key.ID, &name, &role, &key.Prefix, &key.Hash, &createTime)
+	if err != nil {
+		return nil, err
+	}
+
+	if key.CreateTime, err = time.Parse(sqlTimeLayout, createTime); err != nil {
+		return nil, err
+	}
+	modelRole := models.Role(role)
+	key.Name = &name
+	key.Role = &modelRole
+
+	return &key, nil
+}
+
+func formatSQLTime(t time.Time) string {
+	return t.UTC().Format(sqlTimeLayout)
+}
+
+// conflictIfUnchanged returns ErrConflict when an
+// "INSERT ... ON CONFLICT DO NOTHING" didn't insert any row
+func conflictIfUnchanged(result sql.Result) error {
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrConflict
+	}
+
+	return nil
+}
+
+// notFoundIfUnchanged returns ErrNotFound when an UPDATE or DELETE didn't
+// change any row
+func notFoundIfUnchanged(result sql.Result) error {
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
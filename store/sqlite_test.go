@@ -0,0 +1,72 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newTestSQLitePath returns the path of a new database, and a function to
+// remove it
+func newTestSQLitePath(t *testing.T) (string, func()) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "truck-pad")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return filepath.Join(dir, "truck-pad.db"), func() { os.RemoveAll(dir) }
+}
+
+func TestSQLiteLegacyIDMigration(t *testing.T) {
+	path, remove := newTestSQLitePath(t)
+	defer remove()
+
+	// a database from before Trips kept their legacy ID
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = migrate(db, sqliteMigrations[:9]); err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(
+		`INSERT INTO trips (id, driver_id, has_load, vehicle_type, time,
+			origin_lat, origin_lng, destination_lat, destination_lng)
+		VALUES
+			('20190601120000', '52998224725', TRUE, 1, '2019-06-01T15:00:00.000000000Z', 0, 0, 0, 0),
+			('01E1199GJ0VM7HF4AQGJRPE0V3', '52998224725', TRUE, 1, '2020-02-14T15:00:00.000000000Z', 0, 0, 0, 0)`,
+	)
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewSQLiteStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	tests := []struct {
+		legacyID string
+		id       string
+	}{
+		{"20190601120000", "20190601120000"},
+		// the offset the Trip was sent with was lost
+		{"20200214150000", "01E1199GJ0VM7HF4AQGJRPE0V3"},
+	}
+	for _, test := range tests {
+		trips, _, err := s.GetTrips(context.Background(), TripFilter{DriverID: "52998224725", LegacyID: test.legacyID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(trips) != 1 || trips[0].ID != test.id {
+			t.Errorf("legacy_id=%s: got %d trips, want trip %s", test.legacyID, len(trips), test.id)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package store
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"time"
+
+	"github.com/oklog/ulid"
+
+	"github.com/rafaft/truck-pad/geo"
+	"github.com/rafaft/truck-pad/models"
+)
+
+var (
+	// ErrNotFound is returned when the requested document does not exist
+	ErrNotFound = errors.New("not found")
+	// ErrConflict is returned when a document with the same key already exists
+	ErrConflict = errors.New("conflict")
+	// ErrInvalidPageToken is returned when a page token cannot be decoded
+	ErrInvalidPageToken = errors.New("invalid page token")
+	// ErrPreconditionFailed is returned when a document changed since the
+	// version the caller expected
+	ErrPreconditionFailed = errors.New("precondition failed")
+)
+
+// DriverFilter holds the supported filters for querying Drivers.
+// Zero values are ignored.
+type DriverFilter struct {
+	CPF        string
+	Gender     string
+	HasVehicle *bool
+	CNHType    string
+	Fields     []string
+	PageSize   int    // Drivers are paginated (ordered by CPF) if greater than 0
+	PageToken  string // returned by the previous page
+}
+
+// TripFilter holds the supported filters for querying Trips.
+// Zero values are ignored.
+type TripFilter struct {
+	DriverID    string
+	ID          string
+	LegacyID    string // see models.Trip.LegacyID
+	HasLoad     *bool
+	VehicleType *int
+	Time        *time.Time // exact match
+	From        *time.Time // inclusive
+	To          *time.Time // exclusive
+	Origin      *geo.Area
+	Destination *geo.Area
+	Ascending   bool // trips are ordered by time, descending by default
+	Limit       int
+	Fields      []string
+	PageSize    int    // Trips are paginated if greater than 0
+	PageToken   string // returned by the previous page
+}
+
+// Erasure reports what was removed when erasing a Driver
+type Erasure struct {
+	DriverDeleted   bool // false if only the Driver's Trips existed
+	TripsDeleted    int
+	TripsAnonymized int
+}
+
+// ImportResult is what happened to an imported Driver (or would happen,
+// on a dry run)
+type ImportResult int
+
+const (
+	ImportCreated ImportResult = iota
+	ImportReplaced
+	ImportSkipped
+)
+
+// DriverStore is the persistence layer for Drivers
+type DriverStore interface {
+	// AddDriver returns ErrConflict if a Driver with the same CPF exists.
+	// Sets the Driver's UpdateTime.
+	AddDriver(ctx context.Context, driver *models.Driver) error
+	// GetDrivers returns the token of the next page, if there's one
+	GetDrivers(ctx context.Context, filter DriverFilter) ([]*models.Driver, string, error)
+	// EachDriver calls fn with each Driver as it's read, instead of
+	// returning all of them at once, and stops at fn's first error. The
+	// filter is the same as GetDrivers', without pagination.
+	EachDriver(ctx context.Context, filter DriverFilter, fn func(driver *models.Driver) error) error
+	// UpdateDriver applies every non nil field of driver to the Driver
+	// of the given CPF, returns ErrNotFound if it doesn't exist. If
+	// lastUpdateTime is not zero, the Driver is only updated if it's
+	// UpdateTime is the same, otherwise returns ErrPreconditionFailed.
+	UpdateDriver(ctx context.Context, cpf string, driver *models.Driver, lastUpdateTime time.Time) error
+	// ImportDrivers adds many Drivers. Drivers whose CPF already exists
+	// (or is repeated within drivers) are replaced if replace is true,
+	// otherwise skipped. Nothing is written on a dry run.
+	ImportDrivers(ctx context.Context, drivers []*models.Driver, replace, dryRun bool) ([]ImportResult, error)
+	// GetDriverHistory returns the versions of the Driver of the given
+	// CPF, oldest first. Every write of a Driver adds a version. Drivers
+	// written before versions were kept may have none until their next
+	// write.
+	GetDriverHistory(ctx context.Context, cpf string) ([]*models.DriverVersion, error)
+	// EraseDriver deletes the Driver of the given CPF, it's history, the
+	// stored responses of it's idempotent requests and all of it's Trips. If keepTrips is true, Trips are anonymized
+	// instead: their driver_id is replaced by a random pseudonym shared by
+	// all of them.
+	// Returns ErrNotFound if there's neither a Driver nor Trips to erase.
+	EraseDriver(ctx context.Context, cpf string, keepTrips bool) (*Erasure, error)
+}
+
+// TripStore is the persistence layer for Trips
+type TripStore interface {
+	// AddTrip returns ErrConflict if the Driver already has a Trip with
+	// the same Time
+	AddTrip(ctx context.Context, trip *models.Trip) error
+	// AddTrips adds many Trips, returning the result of each one: nil or
+	// ErrConflict (also for Trips repeated within trips). Any other error
+	// aborts the remaining Trips, but the ones before may have been added.
+	AddTrips(ctx context.Context, trips []*models.Trip) ([]error, error)
+	// GetTrips returns the token of the next page, if there's one
+	GetTrips(ctx context.Context, filter TripFilter) ([]*models.Trip, string, error)
+	// EachTrip calls fn with each Trip as it's read, instead of returning
+	// all of them at once, and stops at fn's first error. The filter is
+	// the same as GetTrips', without pagination.
+	EachTrip(ctx context.Context, filter TripFilter, fn func(trip *models.Trip) error) error
+	// UpdateTrip replaces the Trip old with trip, whose ID changes with
+	// it's time, and adds the correction atomically. Returns ErrNotFound
+	// if old doesn't exist, ErrPreconditionFailed if it's stored values
+	// aren't old's anymore (another request changed it), and ErrConflict
+	// if the Driver already has another Trip at trip's time.
+	UpdateTrip(ctx context.Context, old, trip *models.Trip, correction *models.TripCorrection) error
+	// DeleteTrip deletes the Trip and adds the correction atomically.
+	// Returns ErrNotFound if the Trip doesn't exist, and
+	// ErrPreconditionFailed if it's stored values aren't trip's anymore.
+	DeleteTrip(ctx context.Context, trip *models.Trip, correction *models.TripCorrection) error
+	// GetTripCorrections returns the corrections of a Driver's Trips,
+	// oldest first
+	GetTripCorrections(ctx context.Context, driverID string) ([]*models.TripCorrection, error)
+}
+
+// IdempotentRequest is a request sent with an Idempotency-Key, and it's
+// response once it's completed
+type IdempotentRequest struct {
+	Key string `firestore:"key"`
+	// DriverID is the Driver the request is about, so it's response is
+	// erased with the Driver
+	DriverID string `firestore:"driver_id"`
+	// Fingerprint identifies the request, a key can't be reused for a
+	// different request
+	Fingerprint string            `firestore:"fingerprint"`
+	ExpiresAt   time.Time         `firestore:"expires_at"`
+	Completed   bool              `firestore:"completed"`
+	StatusCode  int               `firestore:"status_code"`
+	Header      map[string]string `firestore:"header"`
+	Body        []byte            `firestore:"body"`
+}
+
+// IdempotencyStore keeps the responses of requests with an Idempotency-Key
+type IdempotencyStore interface {
+	// BeginIdempotentRequest reserves req.Key until req.ExpiresAt. If the
+	// key is already reserved and not expired, the existing request is
+	// returned instead, otherwise nil.
+	BeginIdempotentRequest(ctx context.Context, req *IdempotentRequest) (*IdempotentRequest, error)
+	// CompleteIdempotentRequest stores the response of a reserved request,
+	// until req.ExpiresAt
+	CompleteIdempotentRequest(ctx context.Context, req *IdempotentRequest) error
+	// ReleaseIdempotentRequest removes a reserved request, so it can be
+	// retried
+	ReleaseIdempotentRequest(ctx context.Context, key string) error
+}
+
+// APIKeyStore keeps the API keys of clients, by their hash
+type APIKeyStore interface {
+	// AddAPIKey returns ErrConflict if a key with the same ID exists
+	AddAPIKey(ctx context.Context, key *models.APIKey) error
+	// GetAPIKeys returns every API key, oldest first
+	GetAPIKeys(ctx context.Context) ([]*models.APIKey, error)
+	// GetAPIKeyByHash returns ErrNotFound if there's no key with the hash
+	GetAPIKeyByHash(ctx context.Context, hash string) (*models.APIKey, error)
+	// DeleteAPIKey returns ErrNotFound if there's no key with the ID
+	DeleteAPIKey(ctx context.Context, id string) error
+}
+
+// Store is a persistence layer for Drivers, Trips, idempotent requests and
+// API keys
+type Store interface {
+	DriverStore
+	TripStore
+	IdempotencyStore
+	APIKeyStore
+}
+
+// newAnonymousDriverID returns a pseudonym for the Trips of an erased
+// Driver. It's random, so it cannot be traced back to the Driver's CPF.
+func newAnonymousDriverID() string {
+	return "anonymous-" + ulid.MustNew(ulid.Now(), rand.Reader).String()
+}
+
+// sameTripValues reports whether the Trips have the same correctable
+// values, the precondition of UpdateTrip and DeleteTrip
+func sameTripValues(a, b *models.Trip) bool {
+	return *a.HasLoad == *b.HasLoad &&
+		*a.VehicleType == *b.VehicleType &&
+		a.Time.Equal(*b.Time) &&
+		a.Origin.Latitude == b.Origin.Latitude &&
+		a.Origin.Longitude == b.Origin.Longitude &&
+		a.Destination.Latitude == b.Destination.Latitude &&
+		a.Destination.Longitude == b.Destination.Longitude
+}
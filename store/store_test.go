@@ -0,0 +1,68 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"google.golang.org/genproto/googleapis/type/latlng"
+
+	"github.com/rafaft/truck-pad/models"
+)
+
+// forEachTestStore runs test against a new MemoryStore and SQLStore
+func forEachTestStore(t *testing.T, test func(t *testing.T, s Store)) {
+	t.Run("memory", func(t *testing.T) {
+		test(t, NewMemoryStore())
+	})
+	t.Run("sqlite", func(t *testing.T) {
+		path, remove := newTestSQLitePath(t)
+		defer remove()
+
+		s, err := NewSQLiteStore(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+
+		test(t, s)
+	})
+}
+
+// newTestTrip returns a valid Trip of the Driver at tripTime, arriving at
+// destination
+func newTestTrip(t *testing.T, driverID string, tripTime time.Time, destination *latlng.LatLng) *models.Trip {
+	t.Helper()
+
+	id := models.DriverID(driverID)
+	hasLoad := false
+	vehicleType := models.Truck
+	trip := &models.Trip{
+		DriverID:    &id,
+		HasLoad:     &hasLoad,
+		VehicleType: &vehicleType,
+		Time:        &tripTime,
+		Origin:      &latlng.LatLng{Latitude: -23.55, Longitude: -46.63},
+		Destination: destination,
+	}
+	if err := trip.SetID(); err != nil {
+		t.Fatal(err)
+	}
+	if err := trip.SetGeohashes(); err != nil {
+		t.Fatal(err)
+	}
+
+	return trip
+}
+
+// newTestDriver returns a valid Driver with the CPF
+func newTestDriver(t *testing.T, cpf string) *models.Driver {
+	t.Helper()
+
+	driver, err := models.NewDriver([]byte(`{"cpf":"` + cpf + `","name":"Ana","birth_date":"1980-05-01T00:00:00Z",` +
+		`"gender":"F","has_vehicle":true,"cnh_type":"E"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return driver
+}